@@ -0,0 +1,162 @@
+// Package audit describes the security events of the service, such as
+// logins and password changes, kept as a trail in which each event holds
+// the hash of the one before it, so an event changed, removed or inserted
+// after it was recorded breaks the chain.  The hashes are keyed, so the
+// chain can't be made again over changed events without the key.
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Actions recorded.
+const (
+	ActionLogin                = "login"
+	ActionLogout               = "logout"
+	ActionTokenRefreshed       = "token_refreshed"
+	ActionPasswordChanged      = "password_changed"
+	ActionPasswordResetRequest = "password_reset_requested"
+	ActionPasswordReset        = "password_reset"
+	ActionEmailChanged         = "email_changed"
+	ActionEmailVerified        = "email_verified"
+	ActionRemoteApproved       = "remote_approved"
+	ActionUserCreated          = "user_created"
+	ActionUserDeleted          = "user_deleted"
+	ActionRoleChanged          = "role_changed"
+	ActionWebhookCreated       = "webhook_created"
+	ActionWebhookDeleted       = "webhook_deleted"
+)
+
+// Actions lists the actions recorded.
+var Actions = []string{ActionLogin, ActionLogout, ActionTokenRefreshed,
+	ActionPasswordChanged, ActionPasswordResetRequest, ActionPasswordReset,
+	ActionEmailChanged, ActionEmailVerified, ActionRemoteApproved,
+	ActionUserCreated, ActionUserDeleted, ActionRoleChanged,
+	ActionWebhookCreated, ActionWebhookDeleted}
+
+// Outcomes of an action.
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+// Event is a security event: the action the actor took on the target, from
+// the address and user agent given, and its outcome, with the reason it
+// failed.  The actor is a user's id, or "service:" and the name of the
+// internal service which made the request.  Seq orders the events of the
+// trail, and Hash covers the event and the hash of the one before it.
+type Event struct {
+	Seq       int64     `gorm:"column:seq;primaryKey;autoIncrement:false" json:"seq"`
+	At        time.Time `gorm:"column:at" json:"at"`
+	Action    string    `gorm:"column:action" json:"action"`
+	Outcome   string    `gorm:"column:outcome" json:"outcome"`
+	Reason    string    `gorm:"column:reason" json:"reason,omitempty"`
+	ActorID   string    `gorm:"column:actorid" json:"actorId,omitempty"`
+	TargetID  string    `gorm:"column:targetid" json:"targetId,omitempty"`
+	IP        string    `gorm:"column:ip" json:"ip,omitempty"`
+	UserAgent string    `gorm:"column:useragent" json:"userAgent,omitempty"`
+	RequestID string    `gorm:"column:requestid" json:"requestId,omitempty"`
+	PrevHash  string    `gorm:"column:prevhash" json:"prevHash"`
+	Hash      string    `gorm:"column:hash" json:"hash"`
+}
+
+// Key keys the hashes of the trail: events are sealed and checked with the
+// same key, so it must not change once events are recorded.
+type Key []byte
+
+// TableName gives the table the events are kept in.
+func (Event) TableName() string {
+	return "audit_events"
+}
+
+// Seal places the event after the last one of the trail, nil when the
+// trail is empty, setting its sequence number and hashes, made with the
+// key.  Its time is kept to the millisecond, as every database stores it.
+func (e *Event) Seal(last *Event, key Key) {
+	e.Seq, e.PrevHash = 1, ""
+	if last != nil {
+		e.Seq, e.PrevHash = last.Seq+1, last.Hash
+	}
+	e.At = e.At.UTC().Truncate(time.Millisecond)
+	e.Hash = e.digest(key)
+}
+
+// digest returns the HMAC-SHA256, keyed by the key, of the event's fields
+// and the hash before it, each prefixed by its length so they can't run
+// into one another.
+func (e *Event) digest(key Key) string {
+	h := hmac.New(sha256.New, key)
+	for _, field := range []string{strconv.FormatInt(e.Seq, 10),
+		e.At.UTC().Format(time.RFC3339Nano), e.Action, e.Outcome, e.Reason,
+		e.ActorID, e.TargetID, e.IP, e.UserAgent, e.RequestID,
+		e.PrevHash} {
+		fmt.Fprintf(h, "%d:%s;", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Query selects the events of the trail: those of the action, outcome,
+// actor and target given, when not empty, recorded within the times given,
+// when not zero, and before the sequence number Before, when not 0.  At
+// most Limit events are returned, newest first.
+type Query struct {
+	Action   string
+	Outcome  string
+	ActorID  string
+	TargetID string
+	Since    time.Time
+	Until    time.Time
+	Before   int64
+	Limit    int
+}
+
+// Chain checks the events of a trail, given in order, link by link, with
+// the key they were sealed with.
+type Chain struct {
+	Key  Key
+	last *Event
+}
+
+// Check returns a BrokenError when the event doesn't follow the events
+// checked before it, or its hash doesn't match its contents.
+func (c *Chain) Check(e Event) error {
+	seq, prev := int64(1), ""
+	if c.last != nil {
+		seq, prev = c.last.Seq+1, c.last.Hash
+	}
+	switch {
+	case e.Seq != seq:
+		return &BrokenError{Seq: seq, Problem: fmt.Sprintf(
+			"is missing, the next event is %d", e.Seq)}
+	case e.PrevHash != prev:
+		return &BrokenError{Seq: e.Seq,
+			Problem: "doesn't hold the hash of the event before it"}
+	case !hmac.Equal([]byte(e.Hash), []byte(e.digest(c.Key))):
+		return &BrokenError{Seq: e.Seq,
+			Problem: "doesn't match its hash"}
+	}
+	c.last = &e
+	return nil
+}
+
+// Last returns the last event checked, nil when none was.  Its hash
+// vouches for every event before it, so keeping a copy elsewhere also
+// shows whether events were removed from the end of the trail.
+func (c *Chain) Last() *Event {
+	return c.last
+}
+
+// BrokenError is returned when the trail was changed at the event given.
+type BrokenError struct {
+	Seq     int64
+	Problem string
+}
+
+func (e *BrokenError) Error() string {
+	return fmt.Sprintf("audit event %d %s", e.Seq, e.Problem)
+}
@@ -0,0 +1,115 @@
+package audit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var testKey = Key("0123456789abcdef0123456789abcdef")
+
+// trail returns n events sealed one after the other with the key.
+func trail(n int, key Key) []Event {
+	events := make([]Event, n)
+	var last *Event
+	for i := range events {
+		events[i] = Event{At: time.Now(), Action: ActionLogin,
+			Outcome: Success, ActorID: "user-1", IP: "192.0.2.1"}
+		events[i].Seal(last, key)
+		last = &events[i]
+	}
+	return events
+}
+
+// check checks the events in order with the key, returning the first
+// error.
+func check(events []Event, key Key) error {
+	chain := Chain{Key: key}
+	for _, e := range events {
+		if err := chain.Check(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSeal(t *testing.T) {
+	events := trail(3, testKey)
+	for i, e := range events {
+		if e.Seq != int64(i+1) {
+			t.Errorf("event %d sealed as %d", i+1, e.Seq)
+		}
+		if i > 0 && e.PrevHash != events[i-1].Hash {
+			t.Errorf("event %d doesn't hold the hash before it", e.Seq)
+		}
+		if e.At.Location() != time.UTC || e.At.Nanosecond()%1e6 != 0 {
+			t.Errorf("event %d time %v not kept to the millisecond in utc",
+				e.Seq, e.At)
+		}
+	}
+	chain := Chain{Key: testKey}
+	for _, e := range events {
+		if err := chain.Check(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if last := chain.Last(); last == nil || last.Seq != 3 {
+		t.Errorf("last event checked %v, want 3", last)
+	}
+	if (&Chain{}).Last() != nil {
+		t.Error("last event of an empty chain isn't nil")
+	}
+}
+
+func TestCheckBroken(t *testing.T) {
+	tests := []struct {
+		name string
+		// change breaks the trail, returning it.
+		change func(events []Event) []Event
+		key    Key
+		seq    int64
+	}{
+		{name: "changed event", seq: 2,
+			change: func(events []Event) []Event {
+				events[1].Outcome = Failure
+				return events
+			}},
+		{name: "changed event sealed again with another key", seq: 2,
+			change: func(events []Event) []Event {
+				events[1].Outcome = Failure
+				for i := 1; i < len(events); i++ {
+					events[i].Seal(&events[i-1], Key("another key"))
+				}
+				return events
+			}},
+		{name: "removed event", seq: 2,
+			change: func(events []Event) []Event {
+				return append(events[:1], events[2:]...)
+			}},
+		{name: "inserted event", seq: 4,
+			change: func(events []Event) []Event {
+				inserted := Event{At: time.Now(), Action: ActionLogout,
+					Outcome: Success}
+				inserted.Seal(&events[1], testKey)
+				return append(events[:2], inserted, events[2])
+			}},
+		{name: "checked with another key", key: Key("another key"), seq: 1,
+			change: func(events []Event) []Event { return events }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := tt.key
+			if key == nil {
+				key = testKey
+			}
+			err := check(tt.change(trail(4, testKey)), key)
+			var broken *BrokenError
+			if !errors.As(err, &broken) {
+				t.Fatalf("check returned %v, want a BrokenError", err)
+			}
+			if broken.Seq != tt.seq {
+				t.Errorf("broken at %d, want %d: %v", broken.Seq, tt.seq, err)
+			}
+		})
+	}
+}
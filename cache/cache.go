@@ -0,0 +1,87 @@
+// Package cache keeps short lived values, such as the validity of tokens,
+// in front of the store.  An in-memory LRU cache is used by a single
+// instance of the service, and a client for servers speaking the redis
+// protocol when the cache is shared by several.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Cache keeps values by key for the time given when they are set.  Get
+// reports whether the key was found; a missing or expired key isn't an
+// error.  Close releases the connections of a shared cache.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+	Close() error
+}
+
+// Open returns the cache the url names: an LRU cache of the size given when
+// the url is empty, or a client of the redis server at a "redis://" url,
+// whose password and database number are optional
+// ("redis://:password@host:6379/1").
+func Open(rawURL string, size int) (Cache, error) {
+	if rawURL == "" {
+		return NewLRU(size), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("cache url %q: unknown scheme", rawURL)
+	}
+	password, _ := u.User.Password()
+	db := 0
+	if path := u.Path; len(path) > 1 {
+		if db, err = strconv.Atoi(path[1:]); err != nil {
+			return nil, fmt.Errorf("cache url %q: bad database number",
+				rawURL)
+		}
+	}
+	return NewRESP(u.Host, password, db), nil
+}
+
+// Stats holds the number of lookups which found their key and which didn't.
+type Stats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// Metered counts the hits and misses of the cache it wraps.
+type Metered struct {
+	Cache
+	hits   uint64
+	misses uint64
+}
+
+// NewMetered returns the cache counting its hits and misses.
+func NewMetered(c Cache) *Metered {
+	return &Metered{Cache: c}
+}
+
+func (m *Metered) Get(ctx context.Context, key string) ([]byte, bool,
+	error) {
+	value, ok, err := m.Cache.Get(ctx, key)
+	if ok {
+		atomic.AddUint64(&m.hits, 1)
+	} else {
+		atomic.AddUint64(&m.misses, 1)
+	}
+	return value, ok, err
+}
+
+// Stats returns the hits and misses counted so far.
+func (m *Metered) Stats() Stats {
+	return Stats{
+		Hits:   atomic.LoadUint64(&m.hits),
+		Misses: atomic.LoadUint64(&m.misses),
+	}
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// LRU is an in-memory cache holding a limited number of values, removing
+// the least recently used when it is full.
+type LRU struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// entry is a value held by the LRU cache.
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRU returns an empty LRU cache holding up to size values.
+func NewLRU(size int) *LRU {
+	if size < 1 {
+		size = 1
+	}
+	return &LRU{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (l *LRU) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	element, ok := l.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	e := element.Value.(*entry)
+	if time.Now().After(e.expires) {
+		l.order.Remove(element)
+		delete(l.entries, key)
+		return nil, false, nil
+	}
+	l.order.MoveToFront(element)
+	return append([]byte(nil), e.value...), true, nil
+}
+
+func (l *LRU) Set(ctx context.Context, key string, value []byte,
+	ttl time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := &entry{key: key, value: append([]byte(nil), value...),
+		expires: time.Now().Add(ttl)}
+	if element, ok := l.entries[key]; ok {
+		element.Value = e
+		l.order.MoveToFront(element)
+		return nil
+	}
+	l.entries[key] = l.order.PushFront(e)
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*entry).key)
+	}
+	return nil
+}
+
+func (l *LRU) Delete(ctx context.Context, keys ...string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		if element, ok := l.entries[key]; ok {
+			l.order.Remove(element)
+			delete(l.entries, key)
+		}
+	}
+	return nil
+}
+
+// Close does nothing, as the cache holds no connections.
+func (l *LRU) Close() error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLRUGetSet(t *testing.T) {
+	ctx := context.Background()
+	l := NewLRU(10)
+	if _, ok, err := l.Get(ctx, "missing"); ok || err != nil {
+		t.Fatalf("missing key found: %v %v", ok, err)
+	}
+	value := []byte("editor")
+	if err := l.Set(ctx, "role", value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	value[0] = 'X'
+	got, ok, err := l.Get(ctx, "role")
+	if !ok || err != nil || string(got) != "editor" {
+		t.Fatalf("got %q %v %v, want editor", got, ok, err)
+	}
+	got[0] = 'X'
+	if again, _, _ := l.Get(ctx, "role"); string(again) != "editor" {
+		t.Errorf("value shared with the caller: %q", again)
+	}
+}
+
+func TestLRUExpiry(t *testing.T) {
+	ctx := context.Background()
+	l := NewLRU(10)
+	l.Set(ctx, "short", []byte("1"), 20*time.Millisecond)
+	l.Set(ctx, "long", []byte("1"), time.Minute)
+	time.Sleep(40 * time.Millisecond)
+	if _, ok, _ := l.Get(ctx, "short"); ok {
+		t.Error("expired key found")
+	}
+	if _, ok, _ := l.Get(ctx, "long"); !ok {
+		t.Error("unexpired key not found")
+	}
+	if _, ok := l.entries["short"]; ok {
+		t.Error("expired key kept")
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	ctx := context.Background()
+	l := NewLRU(3)
+	for i := 0; i < 3; i++ {
+		l.Set(ctx, strconv.Itoa(i), []byte("v"), time.Minute)
+	}
+	// using 0 makes 1 the least recently used.
+	l.Get(ctx, "0")
+	l.Set(ctx, "3", []byte("v"), time.Minute)
+	for key, want := range map[string]bool{"0": true, "1": false, "2": true,
+		"3": true} {
+		if _, ok, _ := l.Get(ctx, key); ok != want {
+			t.Errorf("key %s found %v, want %v", key, ok, want)
+		}
+	}
+	if l.order.Len() != 3 || len(l.entries) != 3 {
+		t.Errorf("%d values held, want 3", l.order.Len())
+	}
+}
+
+func TestLRUDelete(t *testing.T) {
+	ctx := context.Background()
+	l := NewLRU(10)
+	l.Set(ctx, "a", []byte("1"), time.Minute)
+	l.Set(ctx, "b", []byte("1"), time.Minute)
+	if err := l.Delete(ctx, "a", "b", "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := l.Get(ctx, "a"); ok {
+		t.Error("deleted key found")
+	}
+	if l.order.Len() != 0 {
+		t.Errorf("%d values held, want 0", l.order.Len())
+	}
+}
+
+func TestMeteredStats(t *testing.T) {
+	ctx := context.Background()
+	m := NewMetered(NewLRU(10))
+	m.Set(ctx, "a", []byte("1"), time.Minute)
+	m.Get(ctx, "a")
+	m.Get(ctx, "a")
+	m.Get(ctx, "b")
+	if got := m.Stats(); got != (Stats{Hits: 2, Misses: 1}) {
+		t.Errorf("stats %+v, want 2 hits and 1 miss", got)
+	}
+}
@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// maxIdle is the number of idle connections a RESP client keeps open.
+const maxIdle = 8
+
+// RESP is a cache kept by a server speaking the redis protocol, such as
+// redis, valkey or dragonfly, shared by every instance of the service.
+type RESP struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *respConn
+}
+
+// respConn is a connection to the server.
+type respConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// ServerError is an error reply from the server.
+type ServerError string
+
+func (e ServerError) Error() string {
+	return "cache server: " + string(e)
+}
+
+// NewRESP returns a client of the server at the address, which connects
+// when first used.  The password is sent when it isn't empty, and the
+// database is selected when it isn't 0.
+func NewRESP(addr, password string, db int) *RESP {
+	return &RESP{addr: addr, password: password, db: db,
+		idle: make(chan *respConn, maxIdle)}
+}
+
+func (r *RESP) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := r.do(ctx, "GET", key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("cache server: unexpected reply %v",
+			reply)
+	}
+	return value, true, nil
+}
+
+func (r *RESP) Set(ctx context.Context, key string, value []byte,
+	ttl time.Duration) error {
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	_, err := r.do(ctx, "SET", key, string(value), "PX",
+		strconv.FormatInt(ms, 10))
+	return err
+}
+
+func (r *RESP) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := r.do(ctx, append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+// Close closes the idle connections.
+func (r *RESP) Close() error {
+	for {
+		select {
+		case c := <-r.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends the command on an idle connection, or a new one, and returns the
+// reply.  Connections are reused unless the command failed on them.
+func (r *RESP) do(ctx context.Context, args ...string) (interface{},
+	error) {
+	c, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(ctx, args...)
+	var serverErr ServerError
+	if err != nil && !errors.As(err, &serverErr) {
+		c.conn.Close()
+		return nil, err
+	}
+	select {
+	case r.idle <- c:
+	default:
+		c.conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns an idle connection, or connects to the server, logging in
+// and selecting the database.
+func (r *RESP) conn(ctx context.Context) (*respConn, error) {
+	select {
+	case c := <-r.idle:
+		return c, nil
+	default:
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &respConn{conn: conn, reader: bufio.NewReader(conn)}
+	if r.password != "" {
+		if _, err := c.do(ctx, "AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err := c.do(ctx, "SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do writes the command as an array of bulk strings and reads the reply,
+// within the context's deadline.
+func (c *respConn) do(ctx context.Context, args ...string) (interface{},
+	error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Time{}
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	buffer := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buffer = append(buffer, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buffer = append(buffer, arg...)
+		buffer = append(buffer, "\r\n"...)
+	}
+	if _, err := c.conn.Write(buffer); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read reads a reply: a string, an integer, a bulk string as bytes, nil for
+// a missing value, or an array of replies.  An error reply is returned as a
+// ServerError.
+func (c *respConn) read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("cache server: malformed reply %q", line)
+	}
+	kind, text := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return text, nil
+	case '-':
+		return nil, ServerError(text)
+	case ':':
+		return strconv.ParseInt(text, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		replies := make([]interface{}, count)
+		for i := range replies {
+			if replies[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("cache server: unknown reply %q", line)
+}
@@ -0,0 +1,292 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respServer is a miniature in-process server of the redis protocol,
+// answering AUTH, SELECT, GET, SET with PX and DEL.
+type respServer struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+	commands []string
+}
+
+// newRESPServer starts the server on a port of the loopback address,
+// requiring the password when it isn't empty, and closes it when the test
+// ends.
+func newRESPServer(t *testing.T, password string) *respServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &respServer{listener: listener, password: password,
+		values: make(map[string]string), expires: make(map[string]time.Time)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *respServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// serve answers the commands sent on the connection until it is closed.
+func (s *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.ToUpper(args[0]))
+		s.mu.Unlock()
+		var reply string
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if len(args) == 2 && args[1] == s.password {
+				authed = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case "SELECT":
+			reply = "+OK\r\n"
+		default:
+			if !authed {
+				reply = "-NOAUTH Authentication required.\r\n"
+			} else {
+				reply = s.run(args)
+			}
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// run answers GET, SET and DEL.
+func (s *respServer) run(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		value, ok := s.values[args[1]]
+		if !ok || time.Now().After(s.expires[args[1]]) {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	case "SET":
+		if len(args) != 5 || strings.ToUpper(args[3]) != "PX" {
+			return "-ERR syntax error\r\n"
+		}
+		ms, err := strconv.Atoi(args[4])
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		s.values[args[1]] = args[2]
+		s.expires[args[1]] = time.Now().Add(time.Duration(ms) *
+			time.Millisecond)
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := s.values[key]; ok {
+				delete(s.values, key)
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("not an array")
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func TestRESPGetSetDelete(t *testing.T) {
+	s := newRESPServer(t, "")
+	c := NewRESP(s.addr(), "", 0)
+	defer c.Close()
+	ctx := context.Background()
+
+	if _, ok, err := c.Get(ctx, "token:1"); ok || err != nil {
+		t.Fatalf("missing key found: %v %v", ok, err)
+	}
+	if err := c.Set(ctx, "token:1", []byte("1"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	value, ok, err := c.Get(ctx, "token:1")
+	if !ok || err != nil || string(value) != "1" {
+		t.Fatalf("got %q %v %v, want 1", value, ok, err)
+	}
+	if err := c.Delete(ctx, "token:1", "role:1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Get(ctx, "token:1"); ok || err != nil {
+		t.Fatalf("deleted key found: %v %v", ok, err)
+	}
+}
+
+func TestRESPSharedByInstances(t *testing.T) {
+	s := newRESPServer(t, "")
+	ctx := context.Background()
+	// each instance of the service has a client of its own.
+	first, second := NewRESP(s.addr(), "", 0), NewRESP(s.addr(), "", 0)
+	defer first.Close()
+	defer second.Close()
+	if err := first.Set(ctx, "token:1", []byte("1"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := second.Get(ctx, "token:1"); !ok || err != nil {
+		t.Fatalf("key set by the other instance not found: %v %v", ok, err)
+	}
+	// a token revoked by one instance is forgotten by the other.
+	if err := second.Delete(ctx, "token:1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := first.Get(ctx, "token:1"); ok || err != nil {
+		t.Fatalf("key deleted by the other instance found: %v %v", ok, err)
+	}
+}
+
+func TestRESPExpiry(t *testing.T) {
+	s := newRESPServer(t, "")
+	c := NewRESP(s.addr(), "", 0)
+	defer c.Close()
+	ctx := context.Background()
+	if err := c.Set(ctx, "role:1", []byte("editor"),
+		20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok, err := c.Get(ctx, "role:1"); ok || err != nil {
+		t.Fatalf("expired key found: %v %v", ok, err)
+	}
+}
+
+func TestRESPAuth(t *testing.T) {
+	s := newRESPServer(t, "secret")
+	ctx := context.Background()
+
+	c := NewRESP(s.addr(), "secret", 2)
+	defer c.Close()
+	if err := c.Set(ctx, "token:1", []byte("1"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Get(ctx, "token:1"); !ok || err != nil {
+		t.Fatalf("key not found: %v %v", ok, err)
+	}
+	s.mu.Lock()
+	commands := strings.Join(s.commands, " ")
+	s.mu.Unlock()
+	// the connection is logged in and its database selected once, then
+	// reused.
+	if commands != "AUTH SELECT SET GET" {
+		t.Errorf("commands sent %q", commands)
+	}
+
+	wrong := NewRESP(s.addr(), "wrong", 0)
+	defer wrong.Close()
+	_, _, err := wrong.Get(ctx, "token:1")
+	var serverErr ServerError
+	if !errors.As(err, &serverErr) {
+		t.Errorf("got %v, want the server's error", err)
+	}
+
+	none := NewRESP(s.addr(), "", 0)
+	defer none.Close()
+	if _, _, err := none.Get(ctx, "token:1"); !errors.As(err, &serverErr) {
+		t.Errorf("got %v, want the server's error", err)
+	}
+}
+
+func TestRESPUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	c := NewRESP(addr, "", 0)
+	if _, _, err := c.Get(context.Background(), "token:1"); err == nil {
+		t.Error("no error from an unreachable server")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	c, err := Open("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(*LRU); !ok {
+		t.Errorf("got %T for no url, want *LRU", c)
+	}
+	c, err = Open("redis://:secret@cache:6379/3", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := c.(*RESP)
+	if !ok || r.addr != "cache:6379" || r.password != "secret" || r.db != 3 {
+		t.Errorf("got %+v", c)
+	}
+	for _, bad := range []string{"memcache://cache", "redis://cache/x"} {
+		if _, err := Open(bad, 10); err == nil {
+			t.Errorf("no error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-soapauth/audit"
+	"go-soapauth/config"
+	"go-soapauth/migrations"
+	"go-soapauth/store"
+	"time"
+)
+
+// runConfig carries out the config subcommand, printing the settings the
+// service would start with, secrets redacted, and every problem with them.
+func runConfig(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: authserver config [file]")
+	}
+	path := ""
+	if len(args) == 1 {
+		path = args[0]
+	}
+	cfg, err := config.Load(path, config.CommandServe)
+	if cfg != nil {
+		fmt.Print(cfg)
+	}
+	return err
+}
+
+// runMigrate carries out the migrate subcommand, applying, reverting or
+// listing the migrations of the configured database.
+func runMigrate(cfg *config.Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: authserver migrate up|down|status")
+	}
+	if cfg.Database.Driver == store.DriverMongo {
+		return errors.New("migrations apply to sql databases; mongo indexes " +
+			"are created when the service starts")
+	}
+	db, err := openDatabase(cfg.Database)
+	if err != nil {
+		return err
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	migrator, err := migrations.New(db)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		count, err := migrator.Up()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d migrations applied\n", count)
+	case "down":
+		migration, err := migrator.Down()
+		if err != nil {
+			return err
+		}
+		if migration == nil {
+			fmt.Printf("no migrations to revert\n")
+		} else {
+			fmt.Printf("reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied {
+				applied = "applied " +
+					status.AppliedAt.Local().Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-20s %s\n", status.Version, status.Name, applied)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+	return nil
+}
+
+// auditPage is the number of audit events checked at once.
+const auditPage = 500
+
+// runAudit carries out the audit subcommand, checking the hash chain of the
+// audit trail from its first event to its last.  The last hash is printed,
+// so it can be kept elsewhere to show later that no events were removed
+// from the end.
+func runAudit(cfg *config.Config, args []string) (err error) {
+	if len(args) != 1 || args[0] != "verify" {
+		return errors.New("usage: authserver audit verify")
+	}
+	st, _, err := openStore(cfg.Database, nil)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	defer func() {
+		if cerr := st.Close(ctx); err == nil {
+			err = cerr
+		}
+	}()
+
+	chain := audit.Chain{Key: audit.Key(cfg.Audit.Key)}
+	count, after := 0, int64(0)
+	for {
+		events, err := st.Audit.Chain(ctx, after, auditPage)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err := chain.Check(event); err != nil {
+				return err
+			}
+			count++
+			after = event.Seq
+		}
+		if len(events) < auditPage {
+			break
+		}
+	}
+	if last := chain.Last(); last != nil {
+		fmt.Printf("%d audit events verified, last hash %s\n", count,
+			last.Hash)
+	} else {
+		fmt.Printf("no audit events recorded\n")
+	}
+	return nil
+}
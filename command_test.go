@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go-soapauth/audit"
+	"go-soapauth/config"
+	"go-soapauth/store"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunAudit(t *testing.T) {
+	cfg := &config.Config{
+		Database: config.Database{Driver: store.DriverSQLite,
+			Path: filepath.Join(t.TempDir(), "audit.db"), AutoMigrate: true},
+		Audit: config.Audit{Key: "0123456789abcdef0123456789abcdef"},
+	}
+	ctx := context.Background()
+	st, db, err := openStore(cfg.Database, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := st.Audit.Append(ctx, &audit.Event{At: time.Now(),
+			Action: audit.ActionLogin, Outcome: audit.Success},
+			audit.Key(cfg.Audit.Key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer st.Close(ctx)
+
+	if err := runAudit(cfg, []string{"verify"}); err != nil {
+		t.Errorf("verify of an intact trail returned %v", err)
+	}
+	if err := runAudit(cfg, nil); err == nil {
+		t.Error("audit without a command returned nil")
+	}
+
+	other := *cfg
+	other.Audit.Key = "another key, of thirty-two chars"
+	var broken *audit.BrokenError
+	if err := runAudit(&other, []string{"verify"}); !errors.As(err,
+		&broken) {
+		t.Errorf("verify with another key returned %v", err)
+	}
+
+	if err := db.Exec("UPDATE audit_events SET outcome = ? WHERE seq = 2",
+		audit.Failure).Error; err != nil {
+		t.Fatal(err)
+	}
+	err = runAudit(cfg, []string{"verify"})
+	if !errors.As(err, &broken) || broken.Seq != 2 {
+		t.Errorf("verify of a changed trail returned %v, want event 2 "+
+			"broken", err)
+	}
+}
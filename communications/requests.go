@@ -28,6 +28,8 @@ type NewUserRequest struct {
 	LastName   string `json:"last"`
 	NameSuffix string `json:"suffix,omitempty"`
 	Password   string `json:"password"`
+	Locale     string `json:"locale,omitempty"`
+	Brand      string `json:"brand,omitempty"`
 }
 
 type UpdateUserRequest struct {
@@ -36,3 +38,9 @@ type UpdateUserRequest struct {
 	Field string `json:"field"`
 	Value string `json:"value"`
 }
+
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret,omitempty"`
+}
@@ -0,0 +1,399 @@
+// Package config loads the settings of the service from its environment,
+// an optional .env file and an optional YAML or TOML file, checking them
+// all when the service starts rather than when each is first used.
+package config
+
+import (
+	"go-soapauth/logging"
+	"go-soapauth/server"
+	"go-soapauth/store"
+	"go-soapauth/tracing"
+	"go-soapauth/webhook"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds the settings of the service.  Each setting is read from the
+// environment variable named by its env tag, or else from the file named by
+// that variable with a "_FILE" suffix, or else from the config file under
+// its section and key, or else takes its default.  Settings tagged as
+// secret are redacted when the configuration is printed, and when not set
+// in the environment are looked up in the secret store first.
+type Config struct {
+	Server      Server      `key:"server"`
+	Database    Database    `key:"database"`
+	Cache       Cache       `key:"cache"`
+	SMTP        SMTP        `key:"smtp"`
+	SecretStore SecretStore `key:"secrets"`
+	Tracing     Tracing     `key:"tracing"`
+	Log         Log         `key:"log"`
+	Webhook     Webhook     `key:"webhook"`
+	Audit       Audit       `key:"audit"`
+
+	secrets *Secrets
+}
+
+// Secrets returns the secret settings read from files and the secret
+// store, which are kept current by refreshing them.
+func (c *Config) Secrets() *Secrets {
+	return c.secrets
+}
+
+// Server holds the settings of the http service.  It serves https when
+// given a certificate and key, verifying the certificates of clients
+// signed by the CAs in TLSClientCA when set, and requiring them when
+// TLSClientAuth is "require".  Plain http requests to RedirectPort are
+// redirected to https.
+type Server struct {
+	Host          string `key:"host" env:"HOST"`
+	Port          int    `key:"port" env:"PORT" default:"5001"`
+	TLSCert       string `key:"tlscert" env:"TLS_CERT_PATH"`
+	TLSKey        string `key:"tlskey" env:"TLS_KEY_PATH"`
+	TLSClientCA   string `key:"tlsclientca" env:"TLS_CLIENT_CA_PATH"`
+	TLSClientAuth string `key:"tlsclientauth" env:"TLS_CLIENT_AUTH" default:"verify"`
+	RedirectPort  int    `key:"redirectport" env:"HTTP_REDIRECT_PORT"`
+	// on SIGTERM or SIGINT the service reports it isn't ready for
+	// ShutdownDelay, then stops taking requests and gives those in flight
+	// ShutdownTimeout to finish, and then the webhook events waiting as
+	// long to be delivered.
+	ShutdownDelay   time.Duration `key:"shutdowndelay" env:"SHUTDOWN_DELAY" default:"5s"`
+	ShutdownTimeout time.Duration `key:"shutdowntimeout" env:"SHUTDOWN_TIMEOUT" default:"30s"`
+	// PublicURL is the public address of the service, used to build the
+	// links in emails.
+	PublicURL string `key:"publicurl" env:"PUBLIC_URL"`
+	// RequestTimeout is the time each request has to finish its database
+	// calls.
+	RequestTimeout time.Duration `key:"requesttimeout" env:"REQUEST_TIMEOUT" default:"30s"`
+	// TemplateDir holds files replacing the embedded email and page
+	// templates, which are watched for changes with TemplateReload.
+	TemplateDir    string `key:"templatedir" env:"TEMPLATE_DIR"`
+	TemplateReload bool   `key:"templatereload" env:"TEMPLATE_RELOAD"`
+	// Instances is the number of instances of the service sharing the
+	// store.  Each clears only its own cache when a token is revoked or a
+	// role changed, so with more than one the cache must be shared through
+	// CACHE_URL, or the others would go on accepting the token until it
+	// expires from theirs.
+	Instances int `key:"instances" env:"INSTANCES" default:"1"`
+	// JWTSecret signs the tokens.  The models read it from the environment,
+	// where it is set when it comes from a file or the secret store.
+	JWTSecret string `key:"jwtsecret" env:"JWT_SECRET" secret:"true"`
+}
+
+// Addr returns the address the service listens on.
+func (s Server) Addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// TLS reports whether the service serves https.
+func (s Server) TLS() bool {
+	return s.TLSCert != ""
+}
+
+// Database holds the settings of the database.  Host, Port, User, Password
+// and Name are those of a postgres database, Path is the file of a sqlite
+// database, and MongoURI and Name locate a mongo database.
+type Database struct {
+	Driver   string `key:"driver" env:"DB_DRIVER" default:"postgres"`
+	Host     string `key:"host" env:"DBHOST"`
+	Port     int    `key:"port" env:"DBPORT" default:"5432"`
+	User     string `key:"user" env:"DBUSER"`
+	Password string `key:"password" env:"DBPASSWD" secret:"true"`
+	Name     string `key:"name" env:"DATABASE"`
+	Path     string `key:"path" env:"DB_PATH" default:"authserver.db"`
+	MongoURI string `key:"mongouri" env:"MONGO_URI" secret:"true"`
+	// Replicas are the connection strings of read replicas of a postgres
+	// database; a caller's reads go to the primary for ReplicaPin after it
+	// writes.
+	Replicas    []string      `key:"replicas" env:"DB_REPLICAS" secret:"true"`
+	ReplicaPin  time.Duration `key:"replicapin" env:"DB_REPLICA_PIN" default:"5s"`
+	AutoMigrate bool          `key:"automigrate" env:"AUTO_MIGRATE"`
+}
+
+// Cache holds the settings of the cache of token and role lookups, kept in
+// memory unless URL names a redis server, as it must when more than one
+// instance of the service runs.
+type Cache struct {
+	URL  string        `key:"url" env:"CACHE_URL" secret:"true"`
+	Size int           `key:"size" env:"CACHE_SIZE" default:"10000"`
+	TTL  time.Duration `key:"ttl" env:"CACHE_TTL" default:"5m"`
+}
+
+// Ways the certificate of the mail server is checked.
+const (
+	SMTPVerify   = "verify"
+	SMTPInsecure = "insecure"
+)
+
+// SMTP holds the settings of the mail server emails are sent through.  Its
+// certificate is verified unless TLSVerify is "insecure", which accepts any
+// certificate and is only meant for a server on a trusted network whose
+// certificate can't be checked.
+type SMTP struct {
+	Server    string `key:"server" env:"SMTP_SERVER"`
+	Port      int    `key:"port" env:"SMTP_PORT" default:"587"`
+	User      string `key:"user" env:"SMTP_USER"`
+	Password  string `key:"password" env:"SMTP_PASSWORD" secret:"true"`
+	From      string `key:"from" env:"SMTP_FROM_EMAIL"`
+	TLSVerify string `key:"tlsverify" env:"SMTP_TLS_VERIFY" default:"verify"`
+
+	secrets *Secrets
+}
+
+// CurrentPassword returns the password of the mail server, as last
+// refreshed when it was rotated.
+func (s SMTP) CurrentPassword() string {
+	return s.secrets.Get("SMTP_PASSWORD", s.Password)
+}
+
+// SecretStore holds the settings of where secrets are kept besides the
+// environment: a directory holding a file for each, named by its variable,
+// or the key/value store of a vault server at VaultAddr, whose secret at
+// VaultPath holds them by variable name.  Secrets read from files or the
+// store are read again every Refresh, unless it is 0.
+type SecretStore struct {
+	Dir        string        `key:"dir" env:"SECRETS_DIR"`
+	VaultAddr  string        `key:"vaultaddr" env:"VAULT_ADDR"`
+	VaultToken string        `key:"vaulttoken" env:"VAULT_TOKEN" secret:"true"`
+	VaultPath  string        `key:"vaultpath" env:"VAULT_PATH" default:"secret/data/authserver"`
+	Refresh    time.Duration `key:"refresh" env:"SECRETS_REFRESH"`
+}
+
+// Tracing holds the settings of the spans the service records: they are
+// sent to the OTLP collector set by the standard OTEL_EXPORTER_OTLP_*
+// variables, printed to stderr for local use, or not recorded at all.
+// SampleRatio of the traces begun here are kept, while those of callers
+// are kept when the caller kept them.
+type Tracing struct {
+	Exporter    string  `key:"exporter" env:"TRACE_EXPORTER" default:"none"`
+	SampleRatio float64 `key:"sampleratio" env:"TRACE_SAMPLE_RATIO" default:"1"`
+}
+
+// Log holds the settings of the service's logs, written at Level and above
+// as JSON, or as text for reading locally.  They go to stdout unless Dir is
+// set, when they go to a file there which is rotated once it reaches
+// MaxSize megabytes; rotated files are removed once older than MaxAge or
+// when more than MaxBackups are kept.
+type Log struct {
+	Level      string        `key:"level" env:"LOG_LEVEL" default:"info"`
+	Format     string        `key:"format" env:"LOG_FORMAT" default:"json"`
+	Dir        string        `key:"dir" env:"LOGLOCATION"`
+	MaxSize    int           `key:"maxsize" env:"LOG_MAX_SIZE" default:"100"`
+	MaxAge     time.Duration `key:"maxage" env:"LOG_MAX_AGE" default:"720h"`
+	MaxBackups int           `key:"maxbackups" env:"LOG_MAX_BACKUPS" default:"10"`
+}
+
+// Rotation returns when the log file is rotated and its rotated files
+// removed.
+func (l Log) Rotation() logging.Rotation {
+	return logging.Rotation{MaxSize: l.MaxSize, MaxAge: l.MaxAge,
+		MaxBackups: l.MaxBackups}
+}
+
+// Webhook holds the settings of the delivery of events to webhook
+// subscribers: each attempt is given Timeout, and a failed delivery is
+// tried up to MaxAttempts times in all, waiting Backoff before the second
+// attempt and twice as long before each after it, up to MaxBackoff.
+// Workers deliver the events, up to QueueSize of them waiting at once.
+type Webhook struct {
+	Timeout     time.Duration `key:"timeout" env:"WEBHOOK_TIMEOUT" default:"10s"`
+	MaxAttempts int           `key:"maxattempts" env:"WEBHOOK_MAX_ATTEMPTS" default:"6"`
+	Backoff     time.Duration `key:"backoff" env:"WEBHOOK_BACKOFF" default:"30s"`
+	MaxBackoff  time.Duration `key:"maxbackoff" env:"WEBHOOK_MAX_BACKOFF" default:"1h"`
+	Workers     int           `key:"workers" env:"WEBHOOK_WORKERS" default:"4"`
+	QueueSize   int           `key:"queuesize" env:"WEBHOOK_QUEUE_SIZE" default:"1000"`
+}
+
+// Audit holds the settings of the audit trail, whose hashes are keyed by
+// Key.  The key must stay the same once events are recorded, or the trail
+// no longer verifies.
+type Audit struct {
+	Key string `key:"key" env:"AUDIT_KEY" secret:"true"`
+}
+
+// minAuditKeyLength is the length of the shortest audit key accepted.
+const minAuditKeyLength = 32
+
+// Options returns how the events are delivered.
+func (w Webhook) Options() webhook.Options {
+	return webhook.Options{Timeout: w.Timeout, MaxAttempts: w.MaxAttempts,
+		Backoff: w.Backoff, MaxBackoff: w.MaxBackoff, Workers: w.Workers,
+		QueueSize: w.QueueSize}
+}
+
+// Command is the command the settings are loaded for, which decides the
+// settings it needs.
+type Command string
+
+// Commands of the service.  The database is used by every command and the
+// audit key by all but migrate, while the rest of the settings are only
+// needed to serve.
+const (
+	CommandServe   Command = "serve"
+	CommandMigrate Command = "migrate"
+	CommandAudit   Command = "audit"
+)
+
+// Validate returns the problems with the settings the command needs, in
+// addition to those with their types found when loading them.
+func (c *Config) Validate(command Command) Errors {
+	var errs Errors
+	required := func(name, value string) {
+		if value == "" {
+			errs = errs.add(name, "is required")
+		}
+	}
+	port := func(name string, value int) {
+		if value < 1 || value > 65535 {
+			errs = errs.add(name, "must be a port number")
+		}
+	}
+	positive := func(name string, value time.Duration) {
+		if value <= 0 {
+			errs = errs.add(name, "must be positive")
+		}
+	}
+	readable := func(name, path string) {
+		if path == "" {
+			return
+		}
+		if f, err := os.Open(path); err != nil {
+			errs = errs.add(name, "can't be read: "+err.Error())
+		} else {
+			f.Close()
+		}
+	}
+
+	switch c.Database.Driver {
+	case store.DriverPostgres:
+		required("DBHOST", c.Database.Host)
+		required("DBUSER", c.Database.User)
+		required("DATABASE", c.Database.Name)
+		port("DBPORT", c.Database.Port)
+	case store.DriverSQLite:
+		required("DB_PATH", c.Database.Path)
+	case store.DriverMongo:
+		required("MONGO_URI", c.Database.MongoURI)
+		required("DATABASE", c.Database.Name)
+	default:
+		errs = errs.add("DB_DRIVER", "must be postgres, sqlite or mongo")
+	}
+	if c.Database.ReplicaPin < 0 {
+		errs = errs.add("DB_REPLICA_PIN", "must not be negative")
+	}
+
+	if c.SecretStore.Dir != "" && c.SecretStore.VaultAddr != "" {
+		errs = errs.add("SECRETS_DIR", "can't be used with VAULT_ADDR")
+	}
+	if c.SecretStore.Refresh < 0 {
+		errs = errs.add("SECRETS_REFRESH", "must not be negative")
+	}
+
+	if command != CommandMigrate {
+		required("AUDIT_KEY", c.Audit.Key)
+		if c.Audit.Key != "" && len(c.Audit.Key) < minAuditKeyLength {
+			errs = errs.add("AUDIT_KEY", "must be at least 32 characters")
+		}
+	}
+	if command != CommandServe {
+		return errs
+	}
+
+	required("PUBLIC_URL", c.Server.PublicURL)
+	if u, err := url.Parse(c.Server.PublicURL); c.Server.PublicURL != "" &&
+		(err != nil || u.Scheme == "" || u.Host == "") {
+		errs = errs.add("PUBLIC_URL", "must be an absolute url")
+	}
+	required("JWT_SECRET", c.Server.JWTSecret)
+	positive("REQUEST_TIMEOUT", c.Server.RequestTimeout)
+	port("PORT", c.Server.Port)
+	if c.Server.ShutdownDelay < 0 {
+		errs = errs.add("SHUTDOWN_DELAY", "must not be negative")
+	}
+	positive("SHUTDOWN_TIMEOUT", c.Server.ShutdownTimeout)
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		errs = errs.add("TLS_CERT_PATH", "and TLS_KEY_PATH must be set together")
+	}
+	readable("TLS_CERT_PATH", c.Server.TLSCert)
+	readable("TLS_KEY_PATH", c.Server.TLSKey)
+	readable("TLS_CLIENT_CA_PATH", c.Server.TLSClientCA)
+	if c.Server.TLSClientCA != "" && !c.Server.TLS() {
+		errs = errs.add("TLS_CLIENT_CA_PATH", "needs TLS_CERT_PATH")
+	}
+	if c.Server.TLSClientAuth != server.ClientAuthVerify &&
+		c.Server.TLSClientAuth != server.ClientAuthRequire {
+		errs = errs.add("TLS_CLIENT_AUTH", "must be verify or require")
+	}
+	if c.Server.RedirectPort != 0 {
+		port("HTTP_REDIRECT_PORT", c.Server.RedirectPort)
+		if !c.Server.TLS() {
+			errs = errs.add("HTTP_REDIRECT_PORT", "needs TLS_CERT_PATH")
+		}
+	}
+
+	if c.Server.Instances < 1 {
+		errs = errs.add("INSTANCES", "must be positive")
+	}
+	if c.Server.Instances > 1 && c.Cache.URL == "" {
+		errs = errs.add("CACHE_URL", "is required when INSTANCES is more "+
+			"than 1")
+	}
+	if c.Cache.Size < 1 {
+		errs = errs.add("CACHE_SIZE", "must be positive")
+	}
+	positive("CACHE_TTL", c.Cache.TTL)
+
+	required("SMTP_SERVER", c.SMTP.Server)
+	port("SMTP_PORT", c.SMTP.Port)
+	if c.SMTP.TLSVerify != SMTPVerify && c.SMTP.TLSVerify != SMTPInsecure {
+		errs = errs.add("SMTP_TLS_VERIFY", "must be verify or insecure")
+	}
+
+	switch c.Tracing.Exporter {
+	case tracing.ExporterNone, tracing.ExporterOTLP, tracing.ExporterStdout:
+	default:
+		errs = errs.add("TRACE_EXPORTER", "must be otlp, stdout or none")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = errs.add("TRACE_SAMPLE_RATIO", "must be between 0 and 1")
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = errs.add("LOG_LEVEL", "must be debug, info, warn or error")
+	}
+	switch c.Log.Format {
+	case logging.FormatJSON, logging.FormatText:
+	default:
+		errs = errs.add("LOG_FORMAT", "must be json or text")
+	}
+	if c.Log.MaxSize < 1 {
+		errs = errs.add("LOG_MAX_SIZE", "must be positive")
+	}
+	if c.Log.MaxAge < 0 {
+		errs = errs.add("LOG_MAX_AGE", "must not be negative")
+	}
+	if c.Log.MaxBackups < 0 {
+		errs = errs.add("LOG_MAX_BACKUPS", "must not be negative")
+	}
+
+	positive("WEBHOOK_TIMEOUT", c.Webhook.Timeout)
+	if c.Webhook.MaxAttempts < 1 {
+		errs = errs.add("WEBHOOK_MAX_ATTEMPTS", "must be positive")
+	}
+	positive("WEBHOOK_BACKOFF", c.Webhook.Backoff)
+	if c.Webhook.MaxBackoff < c.Webhook.Backoff {
+		errs = errs.add("WEBHOOK_MAX_BACKOFF", "must not be less than "+
+			"WEBHOOK_BACKOFF")
+	}
+	if c.Webhook.Workers < 1 {
+		errs = errs.add("WEBHOOK_WORKERS", "must be positive")
+	}
+	if c.Webhook.QueueSize < 1 {
+		errs = errs.add("WEBHOOK_QUEUE_SIZE", "must be positive")
+	}
+	return errs
+}
@@ -0,0 +1,297 @@
+package config
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets every setting, and the files holding them, for the
+// test.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	each(&Config{}, func(_ string, field reflect.StructField,
+		_ reflect.Value) {
+		name := field.Tag.Get("env")
+		t.Setenv(name, "")
+		t.Setenv(name+"_FILE", "")
+	})
+}
+
+// serveEnv sets the settings the service needs to serve from a sqlite
+// database.
+func serveEnv(t *testing.T) {
+	t.Helper()
+	clearEnv(t)
+	t.Setenv("DB_DRIVER", "sqlite")
+	t.Setenv("PUBLIC_URL", "https://auth.example.com")
+	t.Setenv("JWT_SECRET", "jwt secret")
+	t.Setenv("AUDIT_KEY", "0123456789abcdef0123456789abcdef")
+	t.Setenv("SMTP_SERVER", "mail.example.com")
+}
+
+// problems returns the settings the error of Load reports problems with,
+// sorted, failing the test when it isn't Errors.
+func problems(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("error %v isn't Errors", err)
+	}
+	return settings(t, errs)
+}
+
+// settings returns the settings with the problems, sorted.
+func settings(t *testing.T, errs Errors) []string {
+	t.Helper()
+	var names []string
+	for _, e := range errs {
+		var setting *Error
+		if !errors.As(e, &setting) {
+			t.Fatalf("error %v isn't about a setting", e)
+		}
+		names = append(names, setting.Setting)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLoadDefaults(t *testing.T) {
+	serveEnv(t)
+	cfg, err := Load("", CommandServe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 5001 ||
+		cfg.Server.ShutdownTimeout != 30*time.Second ||
+		cfg.Server.TLSClientAuth != "verify" || cfg.Server.Instances != 1 {
+		t.Errorf("server settings %+v not defaulted", cfg.Server)
+	}
+	if cfg.Database.Path != "authserver.db" || cfg.Database.ReplicaPin !=
+		5*time.Second {
+		t.Errorf("database settings %+v not defaulted", cfg.Database)
+	}
+	if cfg.Cache.Size != 10000 || cfg.Cache.TTL != 5*time.Minute {
+		t.Errorf("cache settings %+v not defaulted", cfg.Cache)
+	}
+	if cfg.SMTP.Port != 587 || cfg.SMTP.TLSVerify != SMTPVerify {
+		t.Errorf("smtp settings %+v not defaulted", cfg.SMTP)
+	}
+	if cfg.Tracing.Exporter != "none" || cfg.Tracing.SampleRatio != 1 {
+		t.Errorf("tracing settings %+v not defaulted", cfg.Tracing)
+	}
+	if cfg.Log.Level != "info" || cfg.Log.Format != "json" {
+		t.Errorf("log settings %+v not defaulted", cfg.Log)
+	}
+	if cfg.Webhook.MaxAttempts != 6 || cfg.Webhook.Backoff != 30*time.Second {
+		t.Errorf("webhook settings %+v not defaulted", cfg.Webhook)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `server:
+  port: 6001
+smtp:
+  server: file.example.com
+  user: file-user
+  from: file@example.com
+cache:
+  size: 50
+`,
+		"config.toml": `[server]
+port = 6001
+
+[smtp]
+server = "file.example.com"
+user = "file-user"
+from = "file@example.com"
+
+[cache]
+size = 50
+`,
+	}
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			serveEnv(t)
+			dir := t.TempDir()
+			path := filepath.Join(dir, name)
+			write(t, path, contents)
+			secret := filepath.Join(dir, "secret")
+			write(t, secret, "secret-value\n")
+
+			// the environment comes before a file named in it, which comes
+			// before the config file, which comes before the default.
+			t.Setenv("PORT", "6002")
+			t.Setenv("SMTP_SERVER", "env.example.com")
+			t.Setenv("SMTP_SERVER_FILE", secret)
+			t.Setenv("SMTP_USER_FILE", secret)
+			cfg, err := Load(path, CommandServe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tests := []struct {
+				setting   string
+				got, want interface{}
+			}{
+				{"PORT", cfg.Server.Port, 6002},
+				{"SMTP_SERVER", cfg.SMTP.Server, "env.example.com"},
+				{"SMTP_USER", cfg.SMTP.User, "secret-value"},
+				{"SMTP_FROM_EMAIL", cfg.SMTP.From, "file@example.com"},
+				{"CACHE_SIZE", cfg.Cache.Size, 50},
+				{"SMTP_PORT", cfg.SMTP.Port, 587},
+			}
+			for _, tt := range tests {
+				if tt.got != tt.want {
+					t.Errorf("%s = %v, want %v", tt.setting, tt.got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	serveEnv(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write(t, path, "server:\n  port: 6001\n  unknown: 1\n")
+	t.Setenv("CONFIG_FILE", path)
+	_, err := Load("", CommandServe)
+	if got := problems(t, err); len(got) != 1 ||
+		got[0] != path+": server.unknown" {
+		t.Errorf("problems with %v, want the unknown setting", got)
+	}
+}
+
+func TestLoadCommand(t *testing.T) {
+	tests := []struct {
+		command Command
+		// env sets the settings besides the database driver.
+		env  map[string]string
+		want []string
+	}{
+		{command: CommandServe,
+			want: []string{"AUDIT_KEY", "JWT_SECRET", "PUBLIC_URL",
+				"SMTP_SERVER"}},
+		{command: CommandMigrate},
+		{command: CommandAudit, want: []string{"AUDIT_KEY"}},
+		{command: CommandAudit,
+			env: map[string]string{"AUDIT_KEY": "0123456789abcdef" +
+				"0123456789abcdef"}},
+		// settings the command doesn't use aren't checked.
+		{command: CommandMigrate,
+			env: map[string]string{"SMTP_TLS_VERIFY": "never",
+				"PUBLIC_URL": "not a url"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.command), func(t *testing.T) {
+			clearEnv(t)
+			t.Setenv("DB_DRIVER", "sqlite")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			_, err := Load("", tt.command)
+			if got := problems(t, err); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("problems with %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSharedCache(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances int
+		url       string
+		want      []string
+	}{
+		{name: "one instance", instances: 1},
+		{name: "instances sharing the cache", instances: 3,
+			url: "redis://cache:6379"},
+		{name: "instances each with their own cache", instances: 3,
+			want: []string{"CACHE_URL"}},
+		{name: "no instances", want: []string{"INSTANCES"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveEnv(t)
+			cfg, err := Load("", CommandServe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.Server.Instances, cfg.Cache.URL = tt.instances, tt.url
+			got := settings(t, cfg.Validate(CommandServe))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("problems with %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRequired(t *testing.T) {
+	tests := []struct {
+		setting  string
+		commands []Command
+		// unset unsets the setting.
+		unset func(c *Config)
+	}{
+		{"PUBLIC_URL", []Command{CommandServe},
+			func(c *Config) { c.Server.PublicURL = "" }},
+		{"JWT_SECRET", []Command{CommandServe},
+			func(c *Config) { c.Server.JWTSecret = "" }},
+		{"SMTP_SERVER", []Command{CommandServe},
+			func(c *Config) { c.SMTP.Server = "" }},
+		{"AUDIT_KEY", []Command{CommandServe, CommandAudit},
+			func(c *Config) { c.Audit.Key = "" }},
+		{"DB_PATH", []Command{CommandServe, CommandMigrate, CommandAudit},
+			func(c *Config) { c.Database.Path = "" }},
+		{"DBHOST", []Command{CommandServe, CommandMigrate, CommandAudit},
+			func(c *Config) {
+				c.Database.Driver, c.Database.User = "postgres", "user"
+				c.Database.Name = "auth"
+			}},
+		{"DBUSER", []Command{CommandServe, CommandMigrate, CommandAudit},
+			func(c *Config) {
+				c.Database.Driver, c.Database.Host = "postgres", "db"
+				c.Database.Name = "auth"
+			}},
+		{"DATABASE", []Command{CommandServe, CommandMigrate, CommandAudit},
+			func(c *Config) {
+				c.Database.Driver, c.Database.Host = "postgres", "db"
+				c.Database.User = "user"
+			}},
+		{"MONGO_URI", []Command{CommandServe, CommandMigrate, CommandAudit},
+			func(c *Config) {
+				c.Database.Driver, c.Database.Name = "mongo", "auth"
+			}},
+	}
+	for _, tt := range tests {
+		for _, command := range []Command{CommandServe, CommandMigrate,
+			CommandAudit} {
+			t.Run(tt.setting+" "+string(command), func(t *testing.T) {
+				serveEnv(t)
+				cfg, err := Load("", CommandServe)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.unset(cfg)
+				var want []string
+				for _, c := range tt.commands {
+					if c == command {
+						want = []string{tt.setting}
+					}
+				}
+				got := settings(t, cfg.Validate(command))
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("problems with %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
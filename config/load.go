@@ -0,0 +1,346 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v2"
+)
+
+// redacted replaces the values of secret settings when printed.
+const redacted = "[redacted]"
+
+// Errors lists every problem found with the settings, so they can all be
+// fixed at once.
+type Errors []error
+
+func (e Errors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return "invalid configuration:\n  " + strings.Join(lines, "\n  ")
+}
+
+func (e Errors) add(name, problem string) Errors {
+	return append(e, &Error{Setting: name, Problem: problem})
+}
+
+// Error is a problem with a setting, named by its environment variable.
+type Error struct {
+	Setting string
+	Problem string
+}
+
+func (e *Error) Error() string {
+	return e.Setting + " " + e.Problem
+}
+
+// Load returns the settings of the service.  The variables in a .env file
+// in the working directory are added to the environment first, when there
+// is one.  The config file at the path given, or at CONFIG_FILE when the
+// path is empty, is read when there is one, as TOML when its name ends in
+// ".toml" and as YAML otherwise.  Secrets are then looked up in the secret
+// store, when there is one.  Every problem with the settings the command
+// needs is returned together as Errors.
+func Load(path string, command Command) (*Config, error) {
+	if err := godotenv.Load(); err != nil &&
+		!errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf(".env: %w", err)
+	}
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	file := make(map[string]string)
+	if path != "" {
+		var err error
+		if file, err = readFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := &Config{secrets: newSecrets(nil)}
+	var errs Errors
+	unparsed := make(map[string]bool)
+	set := make(map[string]bool)
+	each(cfg, func(key string, field reflect.StructField,
+		value reflect.Value) {
+		name := field.Tag.Get("env")
+		fromFile, inFile := file[key]
+		delete(file, key)
+		raw, ok := os.LookupEnv(name)
+		set[name] = ok && raw != ""
+		if path := os.Getenv(name + "_FILE"); !set[name] && path != "" {
+			var err error
+			set[name] = true
+			if raw, err = cfg.secrets.fromFile(name, path); err != nil {
+				errs = errs.add(name+"_FILE", err.Error())
+				return
+			}
+			ok = true
+		}
+		if !set[name] {
+			raw, ok = fromFile, inFile
+		}
+		if !ok {
+			raw = field.Tag.Get("default")
+		}
+		if err := parse(value, raw); err != nil {
+			errs = errs.add(name, err.Error())
+			unparsed[name] = true
+		}
+	})
+
+	// secrets not set in the environment are looked up in the secret
+	// store, and those found anywhere but the environment are set there
+	// for the libraries which read it.
+	switch secretStore := cfg.SecretStore; {
+	case secretStore.Dir != "":
+		cfg.secrets.provider = Dir(secretStore.Dir)
+	case secretStore.VaultAddr != "":
+		cfg.secrets.provider = NewVaultKV(secretStore.VaultAddr,
+			secretStore.VaultPath, func() string {
+				return cfg.secrets.Get("VAULT_TOKEN", secretStore.VaultToken)
+			})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	each(cfg, func(key string, field reflect.StructField,
+		value reflect.Value) {
+		name := field.Tag.Get("env")
+		if field.Tag.Get("secret") != "true" || set[name] ||
+			strings.HasPrefix(key, "secrets.") {
+			return
+		}
+		raw, ok, err := cfg.secrets.fromProvider(ctx, name)
+		if err != nil {
+			errs = errs.add(name, "couldn't be read from the secret store: "+
+				err.Error())
+			return
+		}
+		if !ok {
+			return
+		}
+		if err := parse(value, raw); err != nil {
+			errs = errs.add(name, err.Error())
+			unparsed[name] = true
+		}
+	})
+	cfg.secrets.mu.RLock()
+	for name, value := range cfg.secrets.values {
+		os.Setenv(name, value)
+	}
+	cfg.secrets.mu.RUnlock()
+	cfg.SMTP.secrets = cfg.secrets
+
+	for key := range file {
+		errs = errs.add(path+": "+key, "is not a known setting")
+	}
+	// settings which couldn't be parsed aren't also reported as invalid.
+	for _, err := range cfg.Validate(command) {
+		var setting *Error
+		if !errors.As(err, &setting) || !unparsed[setting.Setting] {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool {
+			return errs[i].Error() < errs[j].Error()
+		})
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// String returns the settings one per line as their environment variables
+// would set them, with the values of secrets redacted.
+func (c *Config) String() string {
+	var b strings.Builder
+	c.settings(func(name, text string) {
+		fmt.Fprintf(&b, "%s=%s\n", name, text)
+	})
+	return b.String()
+}
+
+// LogValue returns the settings as a group keyed by their environment
+// variables, with the values of secrets redacted, for the logs.
+func (c *Config) LogValue() slog.Value {
+	var attrs []slog.Attr
+	c.settings(func(name, text string) {
+		attrs = append(attrs, slog.String(name, text))
+	})
+	return slog.GroupValue(attrs...)
+}
+
+// settings calls fn with the environment variable of each setting and its
+// value as text, redacted for secrets.
+func (c *Config) settings(fn func(name, text string)) {
+	each(c, func(key string, field reflect.StructField,
+		value reflect.Value) {
+		text := format(value)
+		if field.Tag.Get("secret") == "true" && text != "" {
+			text = redacted
+		}
+		fn(field.Tag.Get("env"), text)
+	})
+}
+
+// each calls fn with the key, field and value of each setting of the
+// config, the key joining the keys of its section and the setting with a
+// dot.
+func each(cfg *Config, fn func(key string, field reflect.StructField,
+	value reflect.Value)) {
+	sections := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Type().Field(i)
+		if section.Tag.Get("key") == "" {
+			continue
+		}
+		settings := sections.Field(i)
+		for j := 0; j < settings.NumField(); j++ {
+			field := settings.Type().Field(j)
+			if field.Tag.Get("env") == "" {
+				continue
+			}
+			fn(section.Tag.Get("key")+"."+field.Tag.Get("key"), field,
+				settings.Field(j))
+		}
+	}
+}
+
+// parse sets the setting to the text parsed as its type.  Lists are
+// separated by commas.
+func parse(value reflect.Value, text string) error {
+	text = strings.TrimSpace(text)
+	switch value.Interface().(type) {
+	case string:
+		value.SetString(text)
+	case int:
+		if text == "" {
+			value.SetInt(0)
+			return nil
+		}
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("must be a whole number, not %q", text)
+		}
+		value.SetInt(int64(n))
+	case float64:
+		if text == "" {
+			value.SetFloat(0)
+			return nil
+		}
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number, not %q", text)
+		}
+		value.SetFloat(f)
+	case bool:
+		if text == "" {
+			value.SetBool(false)
+			return nil
+		}
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("must be true or false, not %q", text)
+		}
+		value.SetBool(b)
+	case time.Duration:
+		if text == "" {
+			value.SetInt(0)
+			return nil
+		}
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return fmt.Errorf("must be a duration such as 30s, not %q", text)
+		}
+		value.SetInt(int64(d))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(text, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		value.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("has unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+// format returns the setting as parse would read it.
+func format(value reflect.Value) string {
+	switch v := value.Interface().(type) {
+	case []string:
+		return strings.Join(v, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// readFile reads the config file into settings keyed by their section and
+// key, holding their values as text.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, &doc)
+	} else {
+		err = yaml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	settings := make(map[string]string)
+	flatten(settings, "", doc)
+	return settings, nil
+}
+
+// flatten adds the values of the document to the settings, the keys of
+// nested tables joined with dots and lists joined with commas.
+func flatten(settings map[string]string, prefix string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			flatten(settings, join(prefix, key), item)
+		}
+	case map[interface{}]interface{}:
+		for key, item := range v {
+			flatten(settings, join(prefix, fmt.Sprint(key)), item)
+		}
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		settings[prefix] = strings.Join(items, ",")
+	case nil:
+		settings[prefix] = ""
+	default:
+		settings[prefix] = fmt.Sprint(v)
+	}
+}
+
+func join(prefix, key string) string {
+	key = strings.ToLower(key)
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
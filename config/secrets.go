@@ -0,0 +1,256 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider looks up secrets kept outside the environment by the name of
+// the variable which would otherwise hold them.  A secret the provider
+// doesn't have isn't an error.
+type Provider interface {
+	Secret(ctx context.Context, name string) (string, bool, error)
+}
+
+// Dir provides the secrets in a directory holding a file for each, named
+// by its variable in upper or lower case, as Docker and Kubernetes mount
+// them.
+type Dir string
+
+func (d Dir) Secret(ctx context.Context, name string) (string, bool, error) {
+	for _, file := range []string{name, strings.ToLower(name)} {
+		value, err := readSecret(filepath.Join(string(d), file))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return value, true, nil
+	}
+	return "", false, nil
+}
+
+// VaultKV provides the secrets held by a secret of a vault server's
+// key/value store, by their variable names in upper or lower case.  Both
+// versions of the store are read: the path of a version 2 store includes
+// its "data" segment ("secret/data/authserver").
+type VaultKV struct {
+	Addr   string
+	Path   string
+	Token  func() string
+	Client *http.Client
+}
+
+// NewVaultKV returns the provider of the secrets at the path of the vault
+// server, reading them with the token token returns.
+func NewVaultKV(addr, path string, token func() string) *VaultKV {
+	return &VaultKV{Addr: addr, Path: path, Token: token,
+		Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (v *VaultKV) Secret(ctx context.Context, name string) (string, bool,
+	error) {
+	url := strings.TrimRight(v.Addr, "/") + "/v1/" +
+		strings.Trim(v.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token())
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("vault %s: %s", v.Path, resp.Status)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", false, fmt.Errorf("vault %s: %w", v.Path, err)
+	}
+	data := body.Data
+	// a version 2 store nests the secret's data beside its metadata.
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	for _, key := range []string{name, strings.ToLower(name)} {
+		if value, ok := data[key]; ok {
+			return fmt.Sprint(value), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// Secrets keeps the settings read from files named by "_FILE" variables
+// or from the secret store, so they can be read again when rotated.  Only
+// what reads them through Get, or from the environment, sees new values:
+// database connections keep the password they were opened with.
+type Secrets struct {
+	provider Provider
+
+	mu      sync.RWMutex
+	files   map[string]string
+	sourced map[string]bool
+	values  map[string]string
+}
+
+func newSecrets(provider Provider) *Secrets {
+	return &Secrets{provider: provider, files: make(map[string]string),
+		sourced: make(map[string]bool), values: make(map[string]string)}
+}
+
+// Get returns the current value of the setting, or the fallback when it
+// wasn't read from a file or the secret store.
+func (s *Secrets) Get(name, fallback string) string {
+	if s == nil {
+		return fallback
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if value, ok := s.values[name]; ok {
+		return value
+	}
+	return fallback
+}
+
+// fromFile reads the setting from the file, keeping it to refresh.
+func (s *Secrets) fromFile(name, path string) (string, error) {
+	value, err := readSecret(path)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = path
+	s.values[name] = value
+	return value, nil
+}
+
+// fromProvider looks the setting up in the secret store, keeping it to
+// refresh when it is there.
+func (s *Secrets) fromProvider(ctx context.Context, name string) (string,
+	bool, error) {
+	if s.provider == nil {
+		return "", false, nil
+	}
+	value, ok, err := s.provider.Secret(ctx, name)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sourced[name] = true
+	s.values[name] = value
+	return value, true, nil
+}
+
+// Refresh reads the settings again from their files and the secret store,
+// setting those which changed in the environment as well, and returns
+// their names.  A setting which can't be read keeps its value.
+func (s *Secrets) Refresh(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	files := make(map[string]string, len(s.files))
+	for name, path := range s.files {
+		files[name] = path
+	}
+	var sourced []string
+	for name := range s.sourced {
+		sourced = append(sourced, name)
+	}
+	s.mu.RUnlock()
+
+	// files are read first, as they may hold the token of the store.
+	var errs Errors
+	fresh := make(map[string]string)
+	for name, path := range files {
+		value, err := readSecret(path)
+		if err != nil {
+			errs = errs.add(name+"_FILE", err.Error())
+			continue
+		}
+		fresh[name] = value
+	}
+	changed := s.update(fresh)
+	fresh = make(map[string]string)
+	for _, name := range sourced {
+		value, ok, err := s.provider.Secret(ctx, name)
+		if err != nil {
+			errs = errs.add(name, err.Error())
+			continue
+		}
+		if ok {
+			fresh[name] = value
+		}
+	}
+	changed = append(changed, s.update(fresh)...)
+	if len(errs) > 0 {
+		return changed, errs
+	}
+	return changed, nil
+}
+
+// update sets the settings to the fresh values, in the environment as
+// well, returning the names of those which changed.
+func (s *Secrets) update(fresh map[string]string) []string {
+	var changed []string
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, value := range fresh {
+		if s.values[name] != value {
+			s.values[name] = value
+			os.Setenv(name, value)
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// Watch refreshes the settings every interval until the context ends,
+// reporting the names of those which changed and any errors.
+func (s *Secrets) Watch(ctx context.Context, interval time.Duration,
+	onChange func(names []string), onError func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := s.Refresh(ctx)
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		if len(changed) > 0 && onChange != nil {
+			onChange(changed)
+		}
+	}
+}
+
+// readSecret returns the contents of the file without the line ending
+// editors and "echo" leave at its end.
+func readSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// vaultServer answers reads of the secret at path, made with the token,
+// with the body given.
+func vaultServer(t *testing.T, path, token, body string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		switch {
+		case r.Header.Get("X-Vault-Token") != token:
+			http.Error(w, `{"errors":["permission denied"]}`,
+				http.StatusForbidden)
+		case r.URL.Path != "/v1/"+path:
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// checkSecrets checks the provider gives the secrets wanted, by name, and
+// doesn't have SMTP_USER.
+func checkSecrets(t *testing.T, p Provider, want map[string]string) {
+	t.Helper()
+	ctx := context.Background()
+	for name, value := range want {
+		got, ok, err := p.Secret(ctx, name)
+		if err != nil || !ok || got != value {
+			t.Errorf("%s = %q %v %v, want %q", name, got, ok, err, value)
+		}
+	}
+	if got, ok, err := p.Secret(ctx, "SMTP_USER"); ok || err != nil {
+		t.Errorf("SMTP_USER = %q %v %v, want none", got, ok, err)
+	}
+}
+
+func TestVaultKVVersion1(t *testing.T) {
+	server := vaultServer(t, "secret/authserver", "root", `{
+		"data": {"SMTP_PASSWORD": "mail", "db_password": "db", "port": 5432},
+		"lease_duration": 2764800
+	}`)
+	v := NewVaultKV(server.URL+"/", "/secret/authserver/",
+		func() string { return "root" })
+	checkSecrets(t, v, map[string]string{"SMTP_PASSWORD": "mail",
+		"DB_PASSWORD": "db", "PORT": "5432"})
+}
+
+func TestVaultKVVersion2(t *testing.T) {
+	server := vaultServer(t, "secret/data/authserver", "root", `{
+		"data": {
+			"data": {"SMTP_PASSWORD": "mail", "db_password": "db"},
+			"metadata": {"version": 3}
+		}
+	}`)
+	v := NewVaultKV(server.URL, "secret/data/authserver",
+		func() string { return "root" })
+	checkSecrets(t, v, map[string]string{"SMTP_PASSWORD": "mail",
+		"DB_PASSWORD": "db"})
+}
+
+func TestVaultKVErrors(t *testing.T) {
+	server := vaultServer(t, "secret/authserver", "root",
+		`{"data": {"SMTP_PASSWORD": "mail"}}`)
+	ctx := context.Background()
+
+	missing := NewVaultKV(server.URL, "secret/other",
+		func() string { return "root" })
+	if _, ok, err := missing.Secret(ctx, "SMTP_PASSWORD"); ok || err != nil {
+		t.Errorf("missing secret: %v %v, want none", ok, err)
+	}
+
+	token := "expired"
+	denied := NewVaultKV(server.URL, "secret/authserver",
+		func() string { return token })
+	if _, _, err := denied.Secret(ctx, "SMTP_PASSWORD"); err == nil {
+		t.Error("no error when permission is denied")
+	}
+	// the token is asked for on every read, so a renewed one is used.
+	token = "root"
+	if value, ok, err := denied.Secret(ctx,
+		"SMTP_PASSWORD"); !ok || err != nil || value != "mail" {
+		t.Errorf("with the renewed token: %q %v %v", value, ok, err)
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "SMTP_PASSWORD"), "mail\n")
+	write(t, filepath.Join(dir, "db_password"), "db\r\n")
+	checkSecrets(t, Dir(dir), map[string]string{"SMTP_PASSWORD": "mail",
+		"DB_PASSWORD": "db"})
+
+	unreadable := filepath.Join(dir, "VAULT_TOKEN")
+	if err := os.Mkdir(unreadable, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Dir(dir).Secret(context.Background(),
+		"VAULT_TOKEN"); err == nil {
+		t.Error("no error for a secret which can't be read")
+	}
+}
+
+func TestSecretsRefreshFile(t *testing.T) {
+	t.Setenv("SMTP_PASSWORD", "")
+	path := filepath.Join(t.TempDir(), "smtp_password")
+	write(t, path, "first\n")
+	s := newSecrets(nil)
+	if value, err := s.fromFile("SMTP_PASSWORD", path); err != nil ||
+		value != "first" {
+		t.Fatalf("read %q %v, want first", value, err)
+	}
+
+	changed, err := s.Refresh(context.Background())
+	if err != nil || len(changed) != 0 {
+		t.Errorf("unchanged file: %v %v", changed, err)
+	}
+
+	write(t, path, "second\n")
+	changed, err = s.Refresh(context.Background())
+	if err != nil || len(changed) != 1 || changed[0] != "SMTP_PASSWORD" {
+		t.Fatalf("changed %v %v, want SMTP_PASSWORD", changed, err)
+	}
+	if got := s.Get("SMTP_PASSWORD", "fallback"); got != "second" {
+		t.Errorf("Get = %q, want second", got)
+	}
+	if got := os.Getenv("SMTP_PASSWORD"); got != "second" {
+		t.Errorf("environment holds %q, want second", got)
+	}
+
+	// a file which can't be read keeps the value last read.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = s.Refresh(context.Background())
+	var errs Errors
+	if !errors.As(err, &errs) || len(changed) != 0 {
+		t.Errorf("removed file: %v %v", changed, err)
+	}
+	if got := s.Get("SMTP_PASSWORD", "fallback"); got != "second" {
+		t.Errorf("Get = %q after a failed read, want second", got)
+	}
+}
+
+func TestSecretsRefreshProvider(t *testing.T) {
+	t.Setenv("SMTP_PASSWORD", "")
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "SMTP_PASSWORD"), "first")
+	s := newSecrets(Dir(dir))
+	ctx := context.Background()
+	if _, ok, err := s.fromProvider(ctx, "SMTP_PASSWORD"); !ok || err != nil {
+		t.Fatalf("not found: %v %v", ok, err)
+	}
+	if _, ok, _ := s.fromProvider(ctx, "DB_PASSWORD"); ok {
+		t.Fatal("missing secret found")
+	}
+
+	write(t, filepath.Join(dir, "SMTP_PASSWORD"), "second")
+	write(t, filepath.Join(dir, "DB_PASSWORD"), "db")
+	changed, err := s.Refresh(ctx)
+	if err != nil || len(changed) != 1 || changed[0] != "SMTP_PASSWORD" {
+		t.Fatalf("changed %v %v, want SMTP_PASSWORD", changed, err)
+	}
+	if got := s.Get("SMTP_PASSWORD", ""); got != "second" {
+		t.Errorf("Get = %q, want second", got)
+	}
+	// only the secrets found at first are refreshed.
+	if got := s.Get("DB_PASSWORD", "fallback"); got != "fallback" {
+		t.Errorf("DB_PASSWORD = %q, want the fallback", got)
+	}
+}
+
+func TestLoadFileSetting(t *testing.T) {
+	for _, name := range []string{"SMTP_PASSWORD", "CONFIG_FILE",
+		"SECRETS_DIR", "VAULT_ADDR"} {
+		t.Setenv(name, "")
+	}
+	path := filepath.Join(t.TempDir(), "smtp_password")
+	write(t, path, "first\n")
+	t.Setenv("SMTP_PASSWORD_FILE", path)
+
+	cfg, err := Load("", CommandServe)
+	var errs Errors
+	if err != nil && !errors.As(err, &errs) {
+		t.Fatal(err)
+	}
+	for _, e := range errs {
+		var setting *Error
+		if errors.As(e, &setting) &&
+			setting.Setting == "SMTP_PASSWORD_FILE" {
+			t.Fatalf("file not read: %v", e)
+		}
+	}
+	if cfg.SMTP.Password != "first" || cfg.SMTP.CurrentPassword() != "first" {
+		t.Fatalf("password %q, current %q, want first", cfg.SMTP.Password,
+			cfg.SMTP.CurrentPassword())
+	}
+
+	write(t, path, "second\n")
+	if _, err := cfg.Secrets().Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.SMTP.CurrentPassword(); got != "second" {
+		t.Errorf("current password %q after refresh, want second", got)
+	}
+}
+
+// write writes the file, failing the test when it can't.
+func write(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"go-soapauth/audit"
+	"go-soapauth/communications"
+	"go-soapauth/logging"
+	"go-soapauth/store"
+	"go-soapauth/webhook"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditLimit is the number of events returned when the caller doesn't ask
+// for a number, and maxAuditLimit the most returned at once.
+const (
+	auditLimit    = 100
+	maxAuditLimit = 1000
+)
+
+// Reasons recorded for failures other than those of a login.
+const (
+	reasonInvalidToken  = "invalid_token"
+	reasonTokenMismatch = "token_mismatch"
+	reasonTokenExpired  = "token_expired"
+)
+
+// record adds the security event to the audit trail, with the time, the
+// client's address and user agent and the id of the request, and the
+// authorized user or service as its actor unless it names one, sealed with
+// the key, and publishes it to the webhook subscribers.  An event which
+// can't be recorded is logged, and the request goes on.
+func record(c *gin.Context, st *store.Store, key audit.Key,
+	hooks *webhook.Dispatcher, event audit.Event) {
+	if event.ActorID == "" {
+		event.ActorID = actor(c)
+	}
+	if event.Outcome == "" {
+		event.Outcome = audit.Success
+	}
+	event.At = time.Now()
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	event.RequestID = c.Writer.Header().Get(logging.RequestIDHeader)
+	if err := st.Audit.Append(c.Request.Context(), &event,
+		key); err != nil {
+		logger(c).Error("audit event not recorded", "event", "audit_failed",
+			"action", event.Action, "error", err)
+	}
+	hooks.Publish(c.Request.Context(), event)
+}
+
+// record records the security event of the request and publishes it.
+func (con *Controller) record(c *gin.Context, event audit.Event) {
+	record(c, con.Store, con.AuditKey, con.Webhooks, event)
+}
+
+// record records the security event of the request and publishes it.
+func (u *UserController) record(c *gin.Context, event audit.Event) {
+	record(c, u.Store, u.AuditKey, u.Webhooks, event)
+}
+
+// actor returns the id of the authorized user, or the name of the internal
+// service, making the request.
+func actor(c *gin.Context) string {
+	if id := c.GetString("userid"); id != "" {
+		return id
+	}
+	if service := c.GetString("service"); service != "" {
+		return "service:" + service
+	}
+	return ""
+}
+
+// RequireEditor is middleware, following Authorize, letting only editors
+// and internal services through.
+func (con *Controller) RequireEditor(c *gin.Context) {
+	if c.GetBool("editor") || c.GetString("service") != "" {
+		c.Next()
+		return
+	}
+	con.respondError(c, &communications.ErrorMessage{
+		ErrorType:  "authorization",
+		StatusCode: http.StatusForbidden,
+		Message:    "Not Authorized",
+	})
+	c.Abort()
+}
+
+// AuditEvents godoc
+// @Summary Query the audit trail
+// @Description Lists the security events matching the query, newest first.
+// Pass the next value returned as before to get the page after.
+// @ID audit-events
+// @Produce json
+// @Security ApiKeyAuth
+// @Param action query string false "action, such as login"
+// @Param outcome query string false "success or failure"
+// @Param actor query string false "id of the user or service acting"
+// @Param target query string false "id of the user acted on"
+// @Param since query string false "RFC 3339 time of the earliest event"
+// @Param until query string false "RFC 3339 time after the latest event"
+// @Param before query int false "sequence number after the last event"
+// @Param limit query int false "most events returned, up to 1000"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,401,403 {object} communications.ErrorMessage
+// @Router /audit [get]
+func (con *Controller) AuditEvents(c *gin.Context) {
+	query := audit.Query{
+		Action:   c.Query("action"),
+		Outcome:  c.Query("outcome"),
+		ActorID:  c.Query("actor"),
+		TargetID: c.Query("target"),
+		Limit:    auditLimit,
+	}
+	var problem string
+	for name, dest := range map[string]*time.Time{
+		"since": &query.Since, "until": &query.Until} {
+		if text := c.Query(name); text != "" {
+			t, err := time.Parse(time.RFC3339, text)
+			if err != nil {
+				problem = name + " must be an RFC 3339 time"
+			}
+			*dest = t
+		}
+	}
+	if text := c.Query("before"); text != "" {
+		before, err := strconv.ParseInt(text, 10, 64)
+		if err != nil || before < 1 {
+			problem = "before must be a sequence number"
+		}
+		query.Before = before
+	}
+	if text := c.Query("limit"); text != "" {
+		limit, err := strconv.Atoi(text)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			problem = "limit must be between 1 and 1000"
+		}
+		query.Limit = limit
+	}
+	if problem != "" {
+		con.respondError(c, &communications.ErrorMessage{
+			ErrorType:  "request",
+			StatusCode: http.StatusBadRequest,
+			Message:    problem,
+		})
+		return
+	}
+
+	events, err := con.Store.Audit.Find(c.Request.Context(), query)
+	if err != nil {
+		con.respondStoreError(c, "Unable to Query Audit Trail", err)
+		return
+	}
+	if events == nil {
+		events = []audit.Event{}
+	}
+	body := gin.H{
+		"events": events,
+	}
+	if len(events) == query.Limit {
+		body["next"] = events[len(events)-1].Seq
+	}
+	c.JSON(http.StatusOK, body)
+}
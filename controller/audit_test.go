@@ -0,0 +1,38 @@
+package controller_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	models "github.com/antonerne/go-soap/models"
+)
+
+func TestAuditEventsTranslated(t *testing.T) {
+	tests := []struct {
+		locale string
+		want   string
+	}{
+		{locale: "en", want: "limit must be between 1 and 1000"},
+		{locale: "es", want: "limit debe estar entre 1 y 1000"},
+		{locale: "pt-BR", want: "limit deve estar entre 1 e 1000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.locale, func(t *testing.T) {
+			s := newServer(t)
+			s.update(t, func(u *models.User) { u.Editor = true })
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/audit?limit=0",
+				nil)
+			req.Header.Set("Authorization", "Bearer "+s.login(t, testPassword))
+			req.Header.Set("Accept-Language", tt.locale)
+			status, body := s.send(t, req)
+			if status != http.StatusBadRequest {
+				t.Fatalf("status %d %v, want %d", status, body,
+					http.StatusBadRequest)
+			}
+			if body["error"] != tt.want {
+				t.Errorf("error %q, want %q", body["error"], tt.want)
+			}
+		})
+	}
+}
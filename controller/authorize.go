@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"go-soapauth/communications"
+	"go-soapauth/logging"
+	"net/http"
+	"strings"
+
+	models "github.com/antonerne/go-soap/models"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+// Authorize is middleware allowing the request through only with a valid
+// bearer token which is still on record, so tokens removed at logout or
+// refresh are refused, for a user who hasn't been deleted.  The user's id
+// and whether they are an editor are set on the context as "userid" and
+// "editor".  Both checks are cached.  Internal services may instead present
+// a client certificate the server verified, and are let through with its
+// common name set as "service".
+func (con *Controller) Authorize(c *gin.Context) {
+	cErr := &communications.ErrorMessage{
+		ErrorType:  "authorization",
+		StatusCode: http.StatusUnauthorized,
+		Message:    "Not Authorized",
+	}
+	authHeader := c.GetHeader("Authorization")
+	if tls := c.Request.TLS; authHeader == "" && tls != nil &&
+		len(tls.VerifiedChains) > 0 {
+		service := tls.PeerCertificates[0].Subject.CommonName
+		c.Set("service", service)
+		logging.With(c, "service", service)
+		c.Next()
+		return
+	}
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		con.respondError(c, cErr)
+		c.Abort()
+		return
+	}
+
+	creds := new(models.Credentials)
+	token, err := creds.ValidateToken(authHeader[len("Bearer "):])
+	if err != nil || token == nil || !token.Valid {
+		con.respondError(c, cErr)
+		c.Abort()
+		return
+	}
+	claims := creds.GetClaims(token.Claims.(jwt.MapClaims))
+	ctx := readAs(c, claims.Id)
+	_, err = cached(ctx, con.Cache, con.CacheTTL, tokenKey(claims.Uuid),
+		func() ([]byte, error) {
+			_, err := con.Store.Tokens.ByID(ctx, claims.Uuid)
+			return []byte("1"), err
+		})
+	var role []byte
+	if err == nil {
+		role, err = cached(ctx, con.Cache, con.CacheTTL, roleKey(claims.Id),
+			func() ([]byte, error) {
+				user, err := con.Store.Users.ByID(ctx, claims.Id)
+				if err != nil {
+					return nil, err
+				}
+				if user.Editor {
+					return []byte("editor"), nil
+				}
+				return []byte("user"), nil
+			})
+	}
+	if err != nil {
+		if isStoreError(err) {
+			con.respondStoreError(c, "Unable to Check Token", err)
+		} else {
+			con.respondError(c, cErr)
+		}
+		c.Abort()
+		return
+	}
+	c.Set("userid", claims.Id)
+	c.Set("editor", string(role) == "editor")
+	logging.With(c, "user_id", claims.Id)
+	c.Next()
+}
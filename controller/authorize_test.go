@@ -0,0 +1,180 @@
+package controller_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	models "github.com/antonerne/go-soap/models"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// resign returns the token with its claims changed, signed with the key.
+func resign(t *testing.T, token string, key string,
+	change func(jwt.MapClaims)) string {
+	t.Helper()
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token,
+		claims); err != nil {
+		t.Fatal(err)
+	}
+	change(claims)
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256,
+		claims).SignedString([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// withService makes the request carry a client certificate the server
+// verified, of the service named.
+func withService(req *http.Request, name string) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	secret := os.Getenv("JWT_SECRET")
+	tests := []struct {
+		name string
+		// header returns the Authorization header of the request.
+		header  func(t *testing.T, s *testServer) string
+		service string
+		status  int
+	}{
+		{
+			name: "valid token",
+			header: func(t *testing.T, s *testServer) string {
+				return "Bearer " + s.login(t, testPassword)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name:   "missing token",
+			header: func(*testing.T, *testServer) string { return "" },
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "not a bearer token",
+			header: func(t *testing.T, s *testServer) string {
+				return "Basic " + s.login(t, testPassword)
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "invalid token",
+			header: func(*testing.T, *testServer) string {
+				return "Bearer not-a-token"
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "signed with another key",
+			header: func(t *testing.T, s *testServer) string {
+				return "Bearer " + resign(t, s.login(t, testPassword),
+					"another key", func(jwt.MapClaims) {})
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "expired token",
+			header: func(t *testing.T, s *testServer) string {
+				return "Bearer " + resign(t, s.login(t, testPassword), secret,
+					func(claims jwt.MapClaims) {
+						claims["exp"] = time.Now().Add(-time.Minute).Unix()
+					})
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "token removed at logout",
+			header: func(t *testing.T, s *testServer) string {
+				token := s.login(t, testPassword)
+				if status, _ := s.do(t, http.MethodDelete, "/api/v1/auth",
+					token, nil); status != http.StatusOK {
+					t.Fatalf("logout answered %d", status)
+				}
+				return "Bearer " + token
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "user deleted",
+			header: func(t *testing.T, s *testServer) string {
+				token := s.login(t, testPassword)
+				if err := s.store.Users.Delete(context.Background(),
+					s.user.ID); err != nil {
+					t.Fatal(err)
+				}
+				return "Bearer " + token
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:    "service certificate",
+			header:  func(*testing.T, *testServer) string { return "" },
+			service: "scheduler",
+			status:  http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t)
+			req := httptest.NewRequest(http.MethodGet,
+				"/api/v1/auth/users/"+s.user.ID, nil)
+			if header := tt.header(t, s); header != "" {
+				req.Header.Set("Authorization", header)
+			}
+			if tt.service != "" {
+				withService(req, tt.service)
+			}
+			status, body := s.send(t, req)
+			if status != tt.status {
+				t.Errorf("status %d %v, want %d", status, body, tt.status)
+			}
+			if status == http.StatusOK && body["user"] == nil {
+				t.Errorf("no user answered: %v", body)
+			}
+		})
+	}
+}
+
+func TestRequireEditor(t *testing.T) {
+	tests := []struct {
+		name    string
+		editor  bool
+		service string
+		status  int
+	}{
+		{name: "user", status: http.StatusForbidden},
+		{name: "editor", editor: true, status: http.StatusOK},
+		{name: "service", service: "scheduler", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t)
+			s.update(t, func(u *models.User) { u.Editor = tt.editor })
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil)
+			if tt.service != "" {
+				withService(req, tt.service)
+			} else {
+				req.Header.Set("Authorization",
+					"Bearer "+s.login(t, testPassword))
+			}
+			status, body := s.send(t, req)
+			if status != tt.status {
+				t.Errorf("status %d %v, want %d", status, body, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"context"
+	"go-soapauth/cache"
+	"go-soapauth/logging"
+	"time"
+)
+
+// tokenKey is the cache key noting the token with the uuid is on record.
+func tokenKey(uuid string) string {
+	return "token:" + uuid
+}
+
+// roleKey is the cache key of the role, "editor" or "user", of the user.
+func roleKey(userID string) string {
+	return "role:" + userID
+}
+
+// cached returns the value kept under the key, or else the value load
+// returns, keeping it for the ttl.  Errors of the cache are logged and
+// passed over, so requests are answered from the store while it is down.
+func cached(ctx context.Context, c cache.Cache, ttl time.Duration,
+	key string, load func() ([]byte, error)) ([]byte, error) {
+	if c == nil {
+		return load()
+	}
+	value, ok, err := c.Get(ctx, key)
+	if err != nil {
+		cacheUnavailable(ctx, err)
+	}
+	if ok {
+		return value, nil
+	}
+	value, err = load()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Set(ctx, key, value, ttl); err != nil {
+		cacheUnavailable(ctx, err)
+	}
+	return value, nil
+}
+
+// forget removes the keys from the cache, once the records they were loaded
+// from have changed.  Only the cache given is cleared, so instances of the
+// service must share it for the others to forget them too, which the
+// INSTANCES setting makes sure of.
+func forget(ctx context.Context, c cache.Cache, keys ...string) {
+	if c == nil {
+		return
+	}
+	if err := c.Delete(ctx, keys...); err != nil {
+		cacheUnavailable(ctx, err)
+	}
+}
+
+// cacheUnavailable logs the error of the cache, passed over by the request.
+func cacheUnavailable(ctx context.Context, err error) {
+	logging.From(ctx).Warn("cache unavailable", "event", "cache_error",
+		"error", err)
+}
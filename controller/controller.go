@@ -1,29 +1,36 @@
 package controller
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"fmt"
+	"go-soapauth/audit"
+	"go-soapauth/cache"
 	"go-soapauth/communications"
+	"go-soapauth/config"
+	"go-soapauth/metrics"
+	"go-soapauth/store"
+	"go-soapauth/templates"
+	"go-soapauth/webhook"
 	"net/http"
-	"os"
-	"strconv"
-	"text/template"
+	"strings"
 	"time"
 
 	models "github.com/antonerne/go-soap/models"
-	"gorm.io/gorm"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
-
-	gomail "gopkg.in/mail.v2"
 )
 
 type Controller struct {
-	DB        *gorm.DB
-	ErrorLog  *models.LogFile
-	AccessLog *models.LogFile
+	Store     *store.Store
+	BaseURL   string
+	Templates *templates.Templates
+	Mail      config.SMTP
+	Cache     cache.Cache
+	CacheTTL  time.Duration
+	Metrics   *metrics.Metrics
+	Webhooks  *webhook.Dispatcher
+	AuditKey  audit.Key
 }
 
 // Login godoc
@@ -37,177 +44,150 @@ type Controller struct {
 // @Failure 400,401,404 {object} communications.ErrorMessage
 // @Router /auth [post]
 func (con *Controller) Login(c *gin.Context) {
+	ctx := c.Request.Context()
 	// get request from the context
 	var request communications.AuthenticationRequest
 	if err := c.BindJSON(&request); err == nil {
 		// get requested user
-		var user models.User
-
-		con.DB.Preload("Name").Preload("Creds.Remotes").
-			Preload("Studies.Periods.StudyDays.References").
-			Where("email = ?", request.Email).Find(&user)
+		user, uerr := con.Store.Users.ByEmail(ctx, request.Email)
+		if isStoreError(uerr) {
+			con.respondStoreError(c, "Unable to Find User", uerr)
+			return
+		}
 
-		if user.ID != "" {
+		if uerr == nil {
+			ctx = readAs(c, user.ID)
 			// user found, so now compare the password authentication
-			_, err := user.Creds.LogIn(request.Password, c.ClientIP())
+			_, err := logIn(ctx, &user.Creds, request.Password,
+				c.ClientIP())
 			if err != nil {
+				reason := loginFailure(user, err.Message)
+				con.Metrics.Login(reason)
+				logger(c).Warn("login failed", "event", "login_failed",
+					"user_id", user.ID, "reason", reason)
+				con.record(c, audit.Event{Action: audit.ActionLogin,
+					Outcome: audit.Failure, Reason: reason, ActorID: user.ID,
+					TargetID: user.ID})
 				if err.Message == "Account Not Verified" {
 					verifyToken := user.Creds.StartVerification()
-					uerr := con.DB.Save(&user.Creds).Error
+					uerr := con.Store.Credentials.Save(ctx, &user.Creds)
 					if uerr != nil {
-						c.JSON(http.StatusNotFound, gin.H{
-							"error": "Update Error: " + uerr.Error(),
-						})
+						con.respondStoreError(c, "Unable to Save Credentials",
+							uerr)
 						return
 					}
-					serr := con.SendVerificationEmail(&user, verifyToken)
+					serr := con.SendVerificationEmail(c, user, verifyToken)
 					if serr != nil {
-						con.ErrorLog.WriteToLog(serr.Error())
+						logger(c).Error("verification email not sent",
+							"event", "email_failed", "user_id", user.ID,
+							"error", serr)
 					}
 				}
 				if err.Message == "New Remote" {
 					status := err.StatusCode
 					// send new client ip message.
 					remoteToken := user.Creds.StartRemoteToken()
-					c.JSON(int(status), gin.H{
-						"error": "New Remote",
-					})
 					user.Creds.BadAttempts = 0
 					user.Creds.Locked = false
-					con.DB.Save(&user.Creds)
-					con.SendNewComputerEmail(&user, remoteToken)
+					uerr := con.Store.Credentials.Save(ctx, &user.Creds)
+					if uerr != nil {
+						con.respondStoreError(c, "Unable to Save Credentials",
+							uerr)
+						return
+					}
+					c.JSON(int(status), gin.H{
+						"error": translate(c, con.Templates, "New Remote"),
+					})
+					con.SendNewComputerEmail(c, user, remoteToken)
+					return
+				}
+				if uerr := con.Store.Users.Save(ctx, user); uerr != nil {
+					con.respondStoreError(c, "Unable to Save User", uerr)
 					return
 				}
-				con.DB.Save(&user)
 				c.JSON(http.StatusUnauthorized, gin.H{
-					"error": err.Message,
+					"error": translate(c, con.Templates, err.Message),
 				})
 				return
 			}
 
 			tokenString, token, terr := user.Creds.CreateJWTToken(
 				user.ID, user.Email, user.Editor, "")
-			con.DB.Create(&token)
 			if terr != nil {
 				aerr := &communications.ErrorMessage{
 					ErrorType:  "credentials",
 					StatusCode: http.StatusBadRequest,
 					Message:    "Unable to Create JWT Token: " + terr.Error(),
 				}
-				con.ErrorLog.WriteToLog(aerr.String())
+				logger(c).Error("token not created", "event", "token_failed",
+					"user_id", user.ID, "error", terr)
 				c.JSON(http.StatusBadRequest, gin.H{
 					"error": aerr.Message,
 				})
 				return
 			}
-			accessMsg := fmt.Sprintf("%s - Logged In", user.Name.FullName())
-			con.AccessLog.WriteToLog(accessMsg)
+			if uerr := con.Store.Tokens.Create(ctx, token); uerr != nil {
+				con.respondStoreError(c, "Unable to Save Token", uerr)
+				return
+			}
+			con.Metrics.Login("")
+			con.Metrics.Token(metrics.TokenIssued)
+			logger(c).Info("logged in", "event", "login", "user_id", user.ID)
+			con.record(c, audit.Event{Action: audit.ActionLogin,
+				ActorID: user.ID, TargetID: user.ID})
 			c.JSON(http.StatusOK, gin.H{
 				"token": tokenString,
 			})
 			return
 		}
+		con.Metrics.Login(metrics.ReasonUnknownUser)
+		logger(c).Warn("login failed", "event", "login_failed",
+			"reason", metrics.ReasonUnknownUser)
+		con.record(c, audit.Event{Action: audit.ActionLogin,
+			Outcome: audit.Failure, Reason: metrics.ReasonUnknownUser})
 		err := communications.ErrorMessage{
 			ErrorType:  "user",
 			StatusCode: http.StatusNotFound,
 			Message:    "No User for Email Address",
 		}
-		con.ErrorLog.WriteToLog(err.String())
 		c.JSON(int(err.StatusCode), gin.H{
-			"error": err.Message,
+			"error": translate(c, con.Templates, err.Message),
 		})
 	}
 }
 
-func (con *Controller) SendVerificationEmail(user *models.User,
-	token string) error {
-
-	t, err := template.ParseFiles("email.template.html")
-	if err != nil {
-		return err
+// loginFailure returns the reason counted for the login failure with the
+// message given.
+func loginFailure(user *models.User, message string) string {
+	switch {
+	case message == "Account Not Verified":
+		return metrics.ReasonUnverified
+	case message == "New Remote":
+		return metrics.ReasonNewRemote
+	case user.Creds.Locked:
+		return metrics.ReasonLocked
 	}
-
-	data := struct {
-		Subject string
-		Message string
-		Link    string
-	}{
-		Subject: "SOAP Bible Study Email Confirmation",
-		Message: `You must verify your email address in the system before you
-			are allowed to log into the system.  Use the following token string
-			to verify your email address.  Type it in the space provided by the
-			web site.`,
-		Link: token,
-	}
-
-	fmt.Println(user.Email)
-
-	buffer := new(bytes.Buffer)
-	if err := t.Execute(buffer, data); err != nil {
-		return err
-	}
-	body := buffer.String()
-
-	mailer := gomail.NewMessage()
-
-	mailer.SetHeader("From", os.Getenv("SMTP_FROM_EMAIL"))
-	mailer.SetHeader("To", user.Email)
-	mailer.SetHeader("Subject", data.Subject)
-	mailer.SetBody("text/html", body)
-
-	port, _ := strconv.Atoi(os.Getenv("SMTP_PORT"))
-	dialer := gomail.NewDialer(os.Getenv("SMTP_SERVER"), port,
-		os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"))
-	dialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-
-	if err := dialer.DialAndSend(mailer); err != nil {
-		return err
-	}
-	return nil
+	return metrics.ReasonBadPassword
 }
 
-func (con *Controller) SendNewComputerEmail(user *models.User,
-	token string) error {
-
-	t, err := template.ParseFiles("email.template.html")
-	if err != nil {
-		return err
-	}
-
-	data := struct {
-		Subject string
-		Message string
-		Link    string
-	}{
-		Subject: "SOAP Bible Study Remote Verification",
-		Message: `It appears you are trying to access the site from a new 
-			computer/device.  Please use the code provided to verify the new
-			computer access.`,
-		Link: token,
-	}
-
-	buffer := new(bytes.Buffer)
-	if err := t.Execute(buffer, data); err != nil {
-		return err
-	}
-	body := buffer.String()
-
-	mailer := gomail.NewMessage()
-
-	mailer.SetHeader("From", os.Getenv("SMTP_FROM_EMAIL"))
-	mailer.SetHeader("To", user.Email)
-	mailer.SetHeader("Subject", data.Subject)
-	mailer.SetBody("text/html", body)
-
-	port, _ := strconv.Atoi(os.Getenv("SMTP_PORT"))
-	dialer := gomail.NewDialer(os.Getenv("SMTP_SERVER"), port,
-		os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"))
-	dialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+// SendVerificationEmail sends the user an email containing the link used to
+// verify their email address.
+func (con *Controller) SendVerificationEmail(c *gin.Context,
+	user *models.User, token string) error {
+	return sendEmail(c.Request.Context(), con.Templates, con.Mail,
+		con.Metrics, user.Email, templates.VerificationEmail,
+		userPreference(c, con.Store, con.Templates, user.ID),
+		PublicLink(con.BaseURL, "api/v1/auth/verify", token))
+}
 
-	if err := dialer.DialAndSend(mailer); err != nil {
-		return err
-	}
-	return nil
+// SendNewComputerEmail sends the user an email containing the link used to
+// approve access from a new computer or device.
+func (con *Controller) SendNewComputerEmail(c *gin.Context,
+	user *models.User, token string) error {
+	return sendEmail(c.Request.Context(), con.Templates, con.Mail,
+		con.Metrics, user.Email, templates.RemoteEmail,
+		userPreference(c, con.Store, con.Templates, user.ID),
+		PublicLink(con.BaseURL, "api/v1/auth/remote", token))
 }
 
 // Logout godoc
@@ -215,50 +195,56 @@ func (con *Controller) SendNewComputerEmail(user *models.User,
 // @Description Actions to remove token reference from database and annotate the user's logout
 // @ID logout-user
 // @Accept json
-// @Produce json
+// @Produce json,html
 // @Security ApiKeyAuth
-// @Success 200 {string} string
-// @Failure 400,401,404 {string} string
+// @Success 200 {object} communications.MessageResponse
+// @Failure 400,500 {object} communications.ErrorMessage
 // @Router /auth [delete]
 func (con *Controller) Logout(c *gin.Context) {
+	ctx := c.Request.Context()
 	// get the current JWT token UUID and delete it from the database
 	// add log entry for the log out.
 	creds := new(models.Credentials)
 	authHeader := c.GetHeader("Authorization")
-	tokenString := authHeader[len("Bearer")+1:]
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 	token, err := creds.ValidateToken(tokenString)
-	if token.Valid {
+	if token != nil && token.Valid {
 		claims := creds.GetClaims(token.Claims.(jwt.MapClaims))
-		var user models.User
+		ctx = readAs(c, claims.Id)
 
-		uerr := con.DB.Preload("Name").Where("id = ?", claims.Id).Find(&user).Error
+		uerr := con.Store.Tokens.Delete(ctx, claims.Uuid)
 		if uerr != nil {
-			con.ErrorLog.WriteToLog(uerr.Error())
-		}
-
-		uerr = con.DB.Where("id = ?", claims.Uuid).Delete(models.Token{}).Error
-		if uerr != nil {
-			con.ErrorLog.WriteToLog(uerr.Error())
+			cErr := &communications.ErrorMessage{
+				ErrorType:  "database",
+				StatusCode: http.StatusInternalServerError,
+				Message:    "Unable to Remove Token: " + uerr.Error(),
+			}
+			logger(c).Error("token not removed", "event", "logout_failed",
+				"user_id", claims.Id, "error", uerr)
+			con.respondError(c, cErr)
 			return
 		}
-
-		con.AccessLog.WriteToLog(fmt.Sprintf("%s Logged Out", user.Name.FullName()))
+		forget(ctx, con.Cache, tokenKey(claims.Uuid))
+		con.Metrics.Token(metrics.TokenRevoked)
+
+		logger(c).Info("logged out", "event", "logout", "user_id", claims.Id)
+		con.record(c, audit.Event{Action: audit.ActionLogout,
+			ActorID: claims.Id, TargetID: claims.Id})
+		con.respondMessage(c, "Logged Out", verificationData{
+			Title:   "Logged Out",
+			Message: "You are logged out of the site.",
+		})
 	} else {
 		cErr := &communications.ErrorMessage{
 			ErrorType:  "unknown",
 			StatusCode: http.StatusBadRequest,
 			Message:    fmt.Sprintf("%s: %s", "Verification Failed", err.Error()),
 		}
-		con.ErrorLog.WriteToLog(cErr.String())
-		t, _ := template.ParseFiles("error.template.html")
-		buffer := new(bytes.Buffer)
-		if err := t.Execute(buffer, cErr); err != nil {
-			fmt.Println(err)
-			con.ErrorLog.WriteToLog(err.Error())
-		}
-		body := buffer.String()
-
-		c.Data(int(cErr.StatusCode), "text/html; charset=utf-8", []byte(body))
+		logger(c).Warn("logout refused", "event", "logout_failed",
+			"error", err)
+		con.record(c, audit.Event{Action: audit.ActionLogout,
+			Outcome: audit.Failure, Reason: reasonInvalidToken})
+		con.respondError(c, cErr)
 	}
 }
 
@@ -267,19 +253,23 @@ func (con *Controller) Logout(c *gin.Context) {
 // @Description Complete Email Verification process and return HTML
 // @ID verify-email
 // @Accept json
-// @Produce html
+// @Produce json,html
 // @Param token path string true "verification token"
-// @Success 200 {string} string
-// @Failure 400,401,404 {string} string
+// @Success 200 {object} communications.MessageResponse
+// @Failure 400 {object} communications.ErrorMessage
 // @Router /auth/verify/{token} [get]
 func (con *Controller) VerifyEmailAddress(c *gin.Context) {
+	ctx := c.Request.Context()
 	// get the verification code in the parameters
 	verifyToken := c.Param("token")
-	var cred models.Credentials
 
-	con.DB.Where("verificationtoken = ?", verifyToken).Find(&cred)
+	cred, cerr := con.Store.Credentials.ByVerificationToken(ctx, verifyToken)
+	if isStoreError(cerr) {
+		con.respondStoreError(c, "Unable to Find Credentials", cerr)
+		return
+	}
 
-	if cred.UserID != "" {
+	if cerr == nil {
 		verified, cErr := cred.Verify(verifyToken)
 		if cErr != nil || !verified {
 			if !verified && cErr == nil {
@@ -288,17 +278,29 @@ func (con *Controller) VerifyEmailAddress(c *gin.Context) {
 					StatusCode: http.StatusBadRequest,
 					Message:    "Verification Failed",
 				}
-				con.ErrorLog.WriteToLog(cErr.String())
 			}
-			c.JSON(int(cErr.StatusCode), gin.H{
-				"error": cErr.Message,
-			})
+			logger(c).Warn("email not verified", "event", "verify_failed",
+				"user_id", cred.UserID, "error", cErr.Message)
+			con.record(c, audit.Event{
+				Action: audit.ActionEmailVerified, Outcome: audit.Failure,
+				Reason: cErr.Message, ActorID: cred.UserID,
+				TargetID: cred.UserID})
+			con.respondError(c, toErrorMessage(cErr))
+			return
+		}
+		if err := con.Store.Credentials.Save(ctx, cred); err != nil {
+			con.respondStoreError(c, "Unable to Save Credentials", err)
 			return
 		}
-		con.DB.Save(&cred)
 
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Account Verified",
+		logger(c).Info("email verified", "event", "email_verified",
+			"user_id", cred.UserID)
+		con.record(c, audit.Event{Action: audit.ActionEmailVerified,
+			ActorID: cred.UserID, TargetID: cred.UserID})
+		con.respondMessage(c, "Account Verified", verificationData{
+			Title:   "Account Verified",
+			Message: "Your email address is verified.",
+			Action:  "You may now log in to the site.",
 		})
 	} else {
 		cErr := &communications.ErrorMessage{
@@ -306,9 +308,7 @@ func (con *Controller) VerifyEmailAddress(c *gin.Context) {
 			StatusCode: http.StatusBadRequest,
 			Message:    "Verification Failed",
 		}
-		c.JSON(int(cErr.StatusCode), gin.H{
-			"error": cErr.Message,
-		})
+		con.respondError(c, cErr)
 	}
 }
 
@@ -323,47 +323,65 @@ func (con *Controller) VerifyEmailAddress(c *gin.Context) {
 // @Failure 400,401,404 {object} communications.ErrorMessage
 // @Router /auth [put]
 func (con *Controller) RefreshToken(c *gin.Context) {
+	ctx := c.Request.Context()
 	// first get the current token from the header.  If valid, create a new
 	// token from the data in the current token and return it.
 	creds := new(models.Credentials)
 	authHeader := c.GetHeader("Authorization")
-	tokenString := authHeader[len("Bearer")+1:]
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 	token, err := creds.ValidateToken(tokenString)
-	if token.Valid {
+	if token != nil && token.Valid {
 		claims := creds.GetClaims(token.Claims.(jwt.MapClaims))
-
-		con.DB.Where("id = ?", claims.Uuid).Delete(models.Token{})
+		ctx = readAs(c, claims.Id)
 
 		tokenString, tk, err := creds.CreateJWTToken(claims.Id, claims.Email,
 			claims.Editor, "")
 		if err != nil {
-			con.ErrorLog.WriteToLog(err.Error())
+			logger(c).Error("token not created", "event", "token_failed",
+				"user_id", claims.Id, "error", err)
 			cErr := communications.ErrorMessage{
 				ErrorType:  "credentials",
 				StatusCode: http.StatusNotAcceptable,
 				Message:    err.Error(),
 			}
 			c.JSON(http.StatusNotAcceptable, gin.H{
-				"error": cErr.Message,
+				"error": translate(c, con.Templates, cErr.Message),
 			})
 			return
 		}
-		con.DB.Create(&tk)
-		accessMsg := fmt.Sprintf("%s - Token Refreshed", claims.Id)
-		con.AccessLog.WriteToLog(accessMsg)
+		// the old token is only removed if the new one is saved.
+		err = con.Store.Transaction(ctx,
+			func(ctx context.Context, tx *store.Store) error {
+				if err := tx.Tokens.Delete(ctx, claims.Uuid); err != nil {
+					return err
+				}
+				return tx.Tokens.Create(ctx, tk)
+			})
+		if err != nil {
+			con.respondStoreError(c, "Unable to Refresh Token", err)
+			return
+		}
+		forget(ctx, con.Cache, tokenKey(claims.Uuid))
+		con.Metrics.Token(metrics.TokenRefreshed)
+		logger(c).Info("token refreshed", "event", "token_refreshed",
+			"user_id", claims.Id)
+		con.record(c, audit.Event{Action: audit.ActionTokenRefreshed,
+			ActorID: claims.Id, TargetID: claims.Id})
 		c.JSON(http.StatusOK, gin.H{
 			"token": tokenString,
 		})
 	} else {
-		con.ErrorLog.WriteToLog(err.Error())
-		fmt.Println(err)
+		logger(c).Warn("token refresh refused", "event", "refresh_failed",
+			"error", err)
+		con.record(c, audit.Event{Action: audit.ActionTokenRefreshed,
+			Outcome: audit.Failure, Reason: reasonInvalidToken})
 		cErr := communications.ErrorMessage{
 			ErrorType:  "credentials",
 			StatusCode: http.StatusNotAcceptable,
 			Message:    err.Error(),
 		}
 		c.JSON(http.StatusNotAcceptable, gin.H{
-			"error": cErr.Message,
+			"error": translate(c, con.Templates, cErr.Message),
 		})
 	}
 }
@@ -372,37 +390,72 @@ func (con *Controller) RefreshToken(c *gin.Context) {
 // @Summary Approve new computer or device for use
 // @Description This routine will add the current client IP Address to the user's
 // list of approved computers and devices.
+// @ID approve-remote
+// @Accept json
+// @Produce json,html
+// @Param token path string true "remote approval token"
+// @Success 200 {object} communications.MessageResponse
+// @Failure 404 {object} communications.ErrorMessage
+// @Router /auth/remote/{token} [get]
 func (con *Controller) ApproveRemote(c *gin.Context) {
+	ctx := c.Request.Context()
 	verifyToken := c.Param("token")
-	var user models.User
-	var cred models.Credentials
-	con.DB.Where("newremotetoken = ?", verifyToken).Find(&cred)
-
-	if cred.UserID != "" {
-		cred.NewRemoteToken = ""
-		con.DB.Save(&cred)
+	cred, cerr := con.Store.Credentials.ByRemoteToken(ctx, verifyToken)
+	if isStoreError(cerr) {
+		con.respondStoreError(c, "Unable to Find Credentials", cerr)
+		return
+	}
 
-		con.DB.Preload("Name").Preload("Creds.Remotes").
-			Where("id = ?", cred.UserID).Find(&user)
+	if cerr == nil {
+		user, uerr := con.Store.Users.ByID(ctx, cred.UserID)
+		if isStoreError(uerr) {
+			con.respondStoreError(c, "Unable to Find User", uerr)
+			return
+		}
+		if uerr != nil {
+			con.respondError(c, &communications.ErrorMessage{
+				ErrorType:  "user",
+				StatusCode: http.StatusNotFound,
+				Message:    "User Not Found",
+			})
+			return
+		}
 
-		if !user.Creds.HasRemote(c.ClientIP()) {
-			remote := models.UserRemote{
-				CredentialsUserID: user.ID,
-				RemoteIP:          c.ClientIP(),
-			}
-			con.DB.Create(&remote)
-			user.Creds.Remotes = append(user.Creds.Remotes, remote)
+		// the token is only cleared once the remote is added.
+		cred.NewRemoteToken = ""
+		err := con.Store.Transaction(ctx,
+			func(ctx context.Context, tx *store.Store) error {
+				if err := tx.Credentials.Save(ctx, cred); err != nil {
+					return err
+				}
+				if user.Creds.HasRemote(c.ClientIP()) {
+					return nil
+				}
+				return tx.Remotes.Create(ctx, &models.UserRemote{
+					CredentialsUserID: user.ID,
+					RemoteIP:          c.ClientIP(),
+				})
+			})
+		if err != nil {
+			con.respondStoreError(c, "Unable to Approve Computer/Device", err)
+			return
 		}
 
-		accessMsg := fmt.Sprintf("%s - Logged In", user.Name.FullName())
-		con.AccessLog.WriteToLog(accessMsg)
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Remote Added",
+		logger(c).Info("remote approved", "event", "remote_approved",
+			"user_id", user.ID)
+		con.record(c, audit.Event{Action: audit.ActionRemoteApproved,
+			ActorID: user.ID, TargetID: user.ID})
+		con.respondMessage(c, "Remote Added", verificationData{
+			Title:   "Computer/Device Approved",
+			Message: "This computer/device is now approved for your account.",
+			Action:  "You may now log in to the site.",
 		})
 		return
 	}
-	c.JSON(http.StatusNotFound, gin.H{
-		"error": "Remote Token not found",
+	con.respondError(c, &communications.ErrorMessage{
+		ErrorType:  "remote",
+		StatusCode: http.StatusNotFound,
+		Message:    "Remote Token not found",
 	})
 }
 
@@ -418,26 +471,46 @@ func (con *Controller) ApproveRemote(c *gin.Context) {
 // @Failure 400,401,404 {object} communications.ErrorMessage
 // @Router /auth/password [put]
 func (con *Controller) ChangePassword(c *gin.Context) {
+	ctx := c.Request.Context()
 	creds := new(models.Credentials)
 	authHeader := c.GetHeader("Authorization")
-	tokenString := authHeader[len("Bearer")+1:]
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 	token, err := creds.ValidateToken(tokenString)
 
-	if token.Valid {
+	if token != nil && token.Valid {
+		claims := creds.GetClaims(token.Claims.(jwt.MapClaims))
+		ctx = readAs(c, claims.Id)
 		var request communications.NewPasswordRequest
 		if err = c.BindJSON(&request); err == nil {
-			var user models.User
-
-			con.DB.Preload("Name").Preload("Creds").Preload("Remotes").
-				Preload("Studies.Periods.StudyDays.References").
-				Where("id = ?", request.UserID).Find(&user)
+			user, uerr := con.Store.Users.ByID(ctx, request.UserID)
+			if isStoreError(uerr) {
+				con.respondStoreError(c, "Unable to Find User", uerr)
+				return
+			}
+			if uerr != nil {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": translate(c, con.Templates, "User Not Found"),
+				})
+				return
+			}
 
-			login, cErr := user.Creds.LogIn(request.OldPassword, c.ClientIP())
+			login, cErr := logIn(ctx, &user.Creds, request.OldPassword,
+				c.ClientIP())
 			if !login || cErr != nil {
+				reason := metrics.ReasonBadPassword
+				if cErr != nil {
+					reason = loginFailure(user, cErr.Message)
+				}
+				logger(c).Warn("password change refused",
+					"event", "password_change_failed", "user_id", user.ID,
+					"reason", reason)
+				con.record(c, audit.Event{
+					Action:  audit.ActionPasswordChanged,
+					Outcome: audit.Failure, Reason: reason,
+					ActorID: claims.Id, TargetID: user.ID})
 				if cErr != nil {
-					con.ErrorLog.WriteToLog(cErr.String())
 					c.JSON(http.StatusNotAcceptable, gin.H{
-						"error": cErr.Message,
+						"error": translate(c, con.Templates, cErr.Message),
 					})
 				} else {
 					cErr = &models.ErrorMessage{
@@ -446,51 +519,74 @@ func (con *Controller) ChangePassword(c *gin.Context) {
 						Message:    "Bad Password",
 					}
 					c.JSON(int(cErr.StatusCode), gin.H{
-						"error": cErr.Message,
+						"error": translate(c, con.Templates, cErr.Message),
 					})
 				}
 				return
 			}
 
-			user.Creds.SetPassword(request.NewPassword)
-
-			con.DB.Save(&user.Creds)
+			if _, pErr := setPassword(ctx, &user.Creds,
+				request.NewPassword); pErr != nil {
+				con.respondError(c, toErrorMessage(pErr))
+				return
+			}
 
-			claims := user.Creds.GetClaims(token.Claims.(jwt.MapClaims))
 			tokenString, tk, err := user.Creds.CreateJWTToken(user.ID,
 				user.Email, user.Editor, "")
 			if err != nil {
-				con.ErrorLog.WriteToLog(err.Error())
+				logger(c).Error("token not created", "event", "token_failed",
+					"user_id", user.ID, "error", err)
 				cErr := communications.ErrorMessage{
 					ErrorType:  "credentials",
 					StatusCode: http.StatusNotAcceptable,
 					Message:    err.Error(),
 				}
 				c.JSON(http.StatusNotAcceptable, gin.H{
-					"error": cErr.Message,
+					"error": translate(c, con.Templates, cErr.Message),
 				})
 				return
 			}
 
-			con.DB.Where("id = ?", claims.Uuid).Delete(models.Token{})
-			con.DB.Create(&tk)
-
-			accessMsg := fmt.Sprintf("%s - Logged In", user.Name.FullName())
-			con.AccessLog.WriteToLog(accessMsg)
+			// the new password and token are kept only if all are saved.
+			err = con.Store.Transaction(ctx,
+				func(ctx context.Context, tx *store.Store) error {
+					if err := tx.Credentials.Save(ctx, &user.Creds); err != nil {
+						return err
+					}
+					if err := tx.Tokens.Delete(ctx, claims.Uuid); err != nil {
+						return err
+					}
+					return tx.Tokens.Create(ctx, tk)
+				})
+			if err != nil {
+				con.respondStoreError(c, "Unable to Change Password", err)
+				return
+			}
+			forget(ctx, con.Cache, tokenKey(claims.Uuid))
+			con.Metrics.Token(metrics.TokenRevoked)
+			con.Metrics.Token(metrics.TokenIssued)
+
+			logger(c).Info("password changed", "event", "password_changed",
+				"user_id", user.ID)
+			con.record(c, audit.Event{
+				Action: audit.ActionPasswordChanged, ActorID: claims.Id,
+				TargetID: user.ID})
 			c.JSON(http.StatusOK, gin.H{
 				"token": tokenString,
 			})
 		}
 	} else {
-		con.ErrorLog.WriteToLog(err.Error())
-		fmt.Println(err)
+		logger(c).Warn("password change refused",
+			"event", "password_change_failed", "error", err)
+		con.record(c, audit.Event{Action: audit.ActionPasswordChanged,
+			Outcome: audit.Failure, Reason: reasonInvalidToken})
 		cErr := communications.ErrorMessage{
 			ErrorType:  "credentials",
 			StatusCode: http.StatusNotAcceptable,
 			Message:    err.Error(),
 		}
 		c.JSON(http.StatusNotAcceptable, gin.H{
-			"error": cErr.Message,
+			"error": translate(c, con.Templates, cErr.Message),
 		})
 	}
 }
@@ -498,96 +594,68 @@ func (con *Controller) ChangePassword(c *gin.Context) {
 // Start Forgot Password (godoc)
 // @Summary Start Forgot Password Process
 // @Description Process email address in the forgot password process
-// @ID forgot-password-put
+// @ID forgot-password-post
 // @Accept json
-// @Produce json
+// @Produce json,html
 // @Param request body communications.ForgotPasswordStartRequest true "User's Email Address"
-// @Success 200 {string} message
-// @Failure 400,401,404 {object} communications.ErrorMessage
-// @Router /auth/forgot [put]
+// @Success 200 {object} communications.MessageResponse
+// @Failure 400,404,406 {object} communications.ErrorMessage
+// @Router /auth/forgot [post]
 func (con *Controller) ForgotPassword(c *gin.Context) {
+	ctx := c.Request.Context()
 	// step one is the default step of sending the user an email with the
-	// forgot password (reset) token.  This is based on the user's email
-	// address.
+	// link to the forgot password (reset) page.  This is based on the user's
+	// email address.
 	var forgotStart communications.ForgotPasswordStartRequest
 	if err := c.BindJSON(&forgotStart); err == nil {
-		var user models.User
-
-		con.DB.Preload("Name").Preload("Creds").Preload("Remotes").
-			Preload("Studies.Periods.StudyDays.References").
-			Where("email = ?", forgotStart.Email).Find(&user)
-
-		token := user.Creds.StartForgot()
-
-		con.DB.Save(&user.Creds)
-
-		if user.ID != "" {
-			t, err := template.ParseFiles("email.template.html")
-			if err != nil {
-				c.JSON(http.StatusNotAcceptable, gin.H{
-					"error": err.Error(),
-				})
-			}
+		user, uerr := con.Store.Users.ByEmail(ctx, forgotStart.Email)
+		if isStoreError(uerr) {
+			con.respondStoreError(c, "Unable to Find User", uerr)
+			return
+		}
 
-			data := struct {
-				Subject string
-				Message string
-				Link    string
-			}{
-				Subject: "Soap Bible Study Forgot Password",
-				Message: `Since you forgot your password, this message is to 
-					provide a piece of the puzzle.  The code provided will be 
-					included in your request.  Type in the code below into the 
-					forgot password page, along with a new password (twice).`,
-				Link: token,
-			}
+		if uerr == nil {
+			token := user.Creds.StartForgot()
 
-			buffer := new(bytes.Buffer)
-			if err := t.Execute(buffer, data); err != nil {
-				c.JSON(http.StatusNotAcceptable, gin.H{
-					"error": err.Error(),
-				})
+			if err := con.Store.Credentials.Save(ctx, &user.Creds); err != nil {
+				con.respondStoreError(c, "Unable to Save Credentials", err)
+				return
 			}
-			body := buffer.String()
-
-			mailer := gomail.NewMessage()
 
-			mailer.SetHeader("From", os.Getenv("SMTP_FROM_EMAIL"))
-			mailer.SetHeader("To", user.Email)
-			mailer.SetHeader("Subject", data.Subject)
-			mailer.SetBody("text/html", body)
-
-			port, _ := strconv.Atoi(os.Getenv("SMTP_PORT"))
-			dialer := gomail.NewDialer(os.Getenv("SMTP_SERVER"), port,
-				os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"))
-			dialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-
-			if err := dialer.DialAndSend(mailer); err != nil {
-				c.JSON(http.StatusNotAcceptable, gin.H{
-					"error": err,
-				})
+			err := sendEmail(ctx, con.Templates, con.Mail, con.Metrics,
+				user.Email, templates.ForgotEmail,
+				userPreference(c, con.Store, con.Templates, user.ID),
+				PublicLink(con.BaseURL, "api/v1/auth/forgot", token))
+			if err != nil {
+				cErr := &communications.ErrorMessage{
+					ErrorType:  "email",
+					StatusCode: http.StatusNotAcceptable,
+					Message:    err.Error(),
+				}
+				logger(c).Error("reset email not sent", "event", "email_failed",
+					"user_id", user.ID, "error", err)
+				con.respondError(c, cErr)
+				return
 			}
-			c.JSON(http.StatusOK, gin.H{
-				"message": "Email Sent",
+			con.record(c, audit.Event{
+				Action:   audit.ActionPasswordResetRequest,
+				TargetID: user.ID})
+			con.respondMessage(c, "Email Sent", verificationData{
+				Title:   "Email Sent",
+				Message: "An email with the link to reset your password was sent.",
 			})
 		} else {
-			cErr := communications.ErrorMessage{
+			con.respondError(c, &communications.ErrorMessage{
 				ErrorType:  "user",
 				StatusCode: http.StatusNotFound,
 				Message:    "No user for Email Address Given",
-			}
-			c.JSON(int(cErr.StatusCode), gin.H{
-				"error": cErr.Message,
 			})
 		}
 	} else {
-		cErr := communications.ErrorMessage{
+		con.respondError(c, &communications.ErrorMessage{
 			ErrorType:  "request",
 			StatusCode: http.StatusBadRequest,
 			Message:    err.Error(),
-		}
-		c.JSON(int(cErr.StatusCode), gin.H{
-			"error": cErr.Message,
 		})
 	}
 }
@@ -597,43 +665,128 @@ func (con *Controller) ForgotPassword(c *gin.Context) {
 // @Description Process reset token to create a web page for changing the user password.
 // @ID forgot-password-get
 // @Accept plain
-// @Produce html
+// @Produce html,json
 // @Param token path string true "Reset Token"
 // @Success 200 {html} resetpassword
-// @Failure 400,401,404 {object} communications.ErrorMessage
+// @Failure 400,404 {object} communications.ErrorMessage
 // @Router /auth/forgot/{token} [get]
+func (con *Controller) ForgotPasswordForm(c *gin.Context) {
+	ctx := c.Request.Context()
+	resetToken := c.Param("token")
+
+	cred, cerr := con.Store.Credentials.ByResetToken(ctx, resetToken)
+	if isStoreError(cerr) {
+		con.respondStoreError(c, "Unable to Find Credentials", cerr)
+		return
+	}
+
+	if cerr != nil {
+		con.respondError(c, &communications.ErrorMessage{
+			ErrorType:  "credentials",
+			StatusCode: http.StatusNotFound,
+			Message:    "Reset Token not found",
+		})
+		return
+	}
+	if cred.ResetExpires.Before(time.Now()) {
+		con.respondError(c, &communications.ErrorMessage{
+			ErrorType:  "credentials",
+			StatusCode: http.StatusBadRequest,
+			Message:    "Reset Token expired",
+		})
+		return
+	}
+	con.respond(c, http.StatusOK, templates.ChangePage, changeData{
+		UserID:     cred.UserID,
+		ResetToken: resetToken,
+		Action:     PublicLink(con.BaseURL, "api/v1/auth/forgot"),
+	}, gin.H{
+		"userid":     cred.UserID,
+		"resettoken": resetToken,
+	})
+}
+
+// Step 3 Forgot Password (godoc)
+// @Summary Change a forgotten password
+// @Description Set the user's new password using the reset token sent by email.
+// @ID forgot-password-put
+// @Accept json
+// @Produce json,html
+// @Param request body communications.ForgotPasswordChangeRequest true "Reset Token and New Password"
+// @Success 200 {object} communications.MessageResponse
+// @Failure 400,404 {object} communications.ErrorMessage
+// @Router /auth/forgot [put]
 func (con *Controller) ForgotPasswordChange(c *gin.Context) {
+	ctx := c.Request.Context()
 	var request communications.ForgotPasswordChangeRequest
 	if err := c.BindJSON(&request); err == nil {
-		var user models.User
-
-		con.DB.Preload("Name").Preload("Creds").Preload("Remotes").
-			Preload("Studies.Periods.StudyDays.References").
-			Where("id = ?", request.UserID).Find(&user)
+		user, uerr := con.Store.Users.ByID(ctx, request.UserID)
+		if isStoreError(uerr) {
+			con.respondStoreError(c, "Unable to Find User", uerr)
+			return
+		}
 
-		if user.ID != "" {
+		if uerr == nil {
 
-			if user.Creds.ResetToken == request.ResetToken {
-				user.Creds.SetPassword(request.NewPassword)
+			if user.Creds.ResetToken != "" &&
+				user.Creds.ResetToken == request.ResetToken &&
+				user.Creds.ResetExpires.Before(time.Now()) {
+				con.record(c, audit.Event{
+					Action: audit.ActionPasswordReset, Outcome: audit.Failure,
+					Reason: reasonTokenExpired, TargetID: user.ID})
+				con.respondError(c, &communications.ErrorMessage{
+					ErrorType:  "credentials",
+					StatusCode: http.StatusBadRequest,
+					Message:    "Reset Token expired",
+				})
+				return
+			}
+			if user.Creds.ResetToken != "" &&
+				user.Creds.ResetToken == request.ResetToken {
+				_, pErr := setPassword(ctx, &user.Creds,
+					request.NewPassword)
+				if pErr != nil {
+					con.respondError(c, toErrorMessage(pErr))
+					return
+				}
 				user.Creds.ResetToken = ""
 				user.Creds.ResetExpires = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
-				con.DB.Save(&user.Creds)
-				c.JSON(http.StatusOK, gin.H{
-					"message": "Password Changed",
-				})
+				if err := con.Store.Credentials.Save(ctx, &user.Creds); err != nil {
+					con.respondStoreError(c, "Unable to Save Credentials", err)
+					return
+				}
+				logger(c).Info("password reset", "event", "password_reset",
+					"user_id", user.ID)
+				con.record(c, audit.Event{
+					Action: audit.ActionPasswordReset, ActorID: user.ID,
+					TargetID: user.ID})
+				con.respondMessage(c, "Password Changed",
+					verificationData{
+						Title:   "Password Changed",
+						Message: "Your password is reset.  You can now log in.",
+					})
 				return
 			}
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Reset Token doesn't match",
+			con.record(c, audit.Event{
+				Action: audit.ActionPasswordReset, Outcome: audit.Failure,
+				Reason: reasonTokenMismatch, TargetID: user.ID})
+			con.respondError(c, &communications.ErrorMessage{
+				ErrorType:  "credentials",
+				StatusCode: http.StatusBadRequest,
+				Message:    "Reset Token doesn't match",
 			})
 			return
 		}
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "User Not Found",
+		con.respondError(c, &communications.ErrorMessage{
+			ErrorType:  "user",
+			StatusCode: http.StatusNotFound,
+			Message:    "User Not Found",
 		})
 		return
 	}
-	c.JSON(http.StatusBadRequest, gin.H{
-		"error": "Request Data Malformed",
+	con.respondError(c, &communications.ErrorMessage{
+		ErrorType:  "request",
+		StatusCode: http.StatusBadRequest,
+		Message:    "Request Data Malformed",
 	})
 }
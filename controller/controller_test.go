@@ -0,0 +1,677 @@
+package controller_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"go-soapauth/config"
+	"go-soapauth/controller"
+	"go-soapauth/store"
+	"go-soapauth/templates"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	models "github.com/antonerne/go-soap/models"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+// clientIP is the address requests made by httptest come from.
+const clientIP = "192.0.2.1"
+
+const (
+	testEmail    = "reader@example.com"
+	testPassword = "correct horse battery staple"
+	newPassword  = "a different, longer passphrase"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Setenv("JWT_SECRET", "controller test secret")
+	os.Exit(m.Run())
+}
+
+// mailServer is an smtp server accepting every message sent to it, keeping
+// the recipients of each.
+type mailServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	sent     []string
+}
+
+// newMailServer starts a mail server on a port of the loopback address,
+// closed when the test ends.
+func newMailServer(t *testing.T) *mailServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mailServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// serve speaks just enough smtp, without STARTTLS or AUTH, to be sent a
+// message.
+func (s *mailServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ready")
+	var to []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "RCPT":
+			to = append(to, strings.Trim(line[strings.Index(line, ":")+1:],
+				" <>\r\n"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			for {
+				data, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if data == ".\r\n" {
+					break
+				}
+			}
+			s.mu.Lock()
+			s.sent = append(s.sent, to...)
+			s.mu.Unlock()
+			to = nil
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// count returns the number of messages sent to the address.
+func (s *mailServer) count(address string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, to := range s.sent {
+		if to == address {
+			n++
+		}
+	}
+	return n
+}
+
+// testServer is the auth, user and audit routes, backed by a memory store,
+// and the mail server they send through.
+type testServer struct {
+	engine *gin.Engine
+	store  *store.Store
+	mail   *mailServer
+	user   *models.User
+}
+
+// newServer returns the routes with a verified user, who has logged in from
+// the client's address before, in the store.
+func newServer(t *testing.T) *testServer {
+	t.Helper()
+	tmpl, err := templates.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail := newMailServer(t)
+	_, port, _ := net.SplitHostPort(mail.listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	st := store.NewMemoryStore()
+	user := &models.User{
+		ID:    "4b9b0b36-2f4c-4d64-9c36-1f1d4e0e6c11",
+		Email: testEmail,
+		Name:  models.UserName{First: "Test", Last: "Reader"},
+	}
+	if ok, err := user.Creds.SetPassword(testPassword); !ok || err != nil {
+		t.Fatalf("password not set: %v", err)
+	}
+	user.Creds.Verified = true
+	user.Creds.Remotes = []models.UserRemote{{
+		CredentialsUserID: user.ID,
+		RemoteIP:          clientIP,
+	}}
+	if err := st.Users.Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	mailConfig := config.SMTP{
+		Server: "127.0.0.1",
+		Port:   portNum,
+		From:   "support@example.com",
+	}
+	con := &controller.Controller{
+		Store:     st,
+		BaseURL:   "http://auth.example.com",
+		Templates: tmpl,
+		Mail:      mailConfig,
+	}
+	userCon := &controller.UserController{
+		Store:     st,
+		BaseURL:   "http://auth.example.com",
+		Templates: tmpl,
+		Mail:      mailConfig,
+	}
+	r := gin.New()
+	auth := r.Group("/api/v1/auth")
+	auth.POST("", con.Login)
+	auth.PUT("", con.RefreshToken)
+	auth.DELETE("", con.Logout)
+	auth.GET("verify/:token", con.VerifyEmailAddress)
+	auth.GET("remote/:token", con.ApproveRemote)
+	auth.PUT("password", con.ChangePassword)
+	auth.POST("forgot", con.ForgotPassword)
+	auth.GET("forgot/:token", con.ForgotPasswordForm)
+	auth.PUT("forgot", con.ForgotPasswordChange)
+	users := auth.Group("/users")
+	users.GET("/:id", con.Authorize, userCon.GetUser)
+	users.GET("/:id/studies", con.Authorize, userCon.GetStudies)
+	users.POST("/", userCon.AddUser)
+	users.PUT("/", con.Authorize, userCon.UpdateUser)
+	users.DELETE("/:id", con.Authorize, userCon.DeleteUser)
+	r.GET("/api/v1/audit", con.Authorize, con.RequireEditor, con.AuditEvents)
+	return &testServer{engine: r, store: st, mail: mail, user: user}
+}
+
+// do sends the request, with the body as json and the token as bearer
+// token when given, and returns the status and the json body answered.
+func (s *testServer) do(t *testing.T, method, path, token string,
+	body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return s.send(t, req)
+}
+
+// send serves the request, returning the status and the json body
+// answered.
+func (s *testServer) send(t *testing.T, req *http.Request) (int,
+	map[string]interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, req)
+	answer := map[string]interface{}{}
+	if w.Body.Len() > 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+			t.Fatalf("%s %s answered %q: %v", req.Method, req.URL.Path,
+				w.Body, err)
+		}
+	}
+	if e, ok := answer["error"]; ok {
+		if _, isString := e.(string); !isString {
+			t.Errorf("%s %s answered error %v, not a string", req.Method,
+				req.URL.Path, e)
+		}
+	}
+	return w.Code, answer
+}
+
+// login logs the user in with the password given, returning the token.
+func (s *testServer) login(t *testing.T, password string) string {
+	t.Helper()
+	status, body := s.do(t, http.MethodPost, "/api/v1/auth", "",
+		gin.H{"email": testEmail, "password": password})
+	if status != http.StatusOK {
+		t.Fatalf("login answered %d %v", status, body)
+	}
+	token, _ := body["token"].(string)
+	if token == "" {
+		t.Fatalf("login answered no token: %v", body)
+	}
+	return token
+}
+
+// stored returns the user as kept in the store.
+func (s *testServer) stored(t *testing.T) *models.User {
+	t.Helper()
+	user, err := s.store.Users.ByID(context.Background(), s.user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// update changes the user as kept in the store.
+func (s *testServer) update(t *testing.T, change func(*models.User)) {
+	t.Helper()
+	user := s.stored(t)
+	change(user)
+	if err := s.store.Users.Save(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tokenOnRecord reports whether the token is on record, not yet removed at
+// logout or refresh.
+func (s *testServer) tokenOnRecord(t *testing.T, token string) bool {
+	t.Helper()
+	creds := new(models.Credentials)
+	parsed, err := creds.ValidateToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := creds.GetClaims(parsed.Claims.(jwt.MapClaims))
+	_, err = s.store.Tokens.ByID(context.Background(), claims.Uuid)
+	return err == nil
+}
+
+func TestLogin(t *testing.T) {
+	s := newServer(t)
+	token := s.login(t, testPassword)
+	if !s.tokenOnRecord(t, token) {
+		t.Error("token issued isn't on record")
+	}
+}
+
+func TestLoginUnknownEmail(t *testing.T) {
+	s := newServer(t)
+	status, _ := s.do(t, http.MethodPost, "/api/v1/auth", "",
+		gin.H{"email": "nobody@example.com", "password": testPassword})
+	if status != http.StatusNotFound {
+		t.Errorf("status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestLoginBadPassword(t *testing.T) {
+	s := newServer(t)
+	status, body := s.do(t, http.MethodPost, "/api/v1/auth", "",
+		gin.H{"email": testEmail, "password": "not the password"})
+	if status != http.StatusUnauthorized {
+		t.Errorf("status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if body["token"] != nil {
+		t.Errorf("token given for a bad password")
+	}
+	if s.stored(t).Creds.BadAttempts != 1 {
+		t.Errorf("bad attempt not saved")
+	}
+}
+
+func TestLoginUnverified(t *testing.T) {
+	s := newServer(t)
+	s.update(t, func(u *models.User) { u.Creds.Verified = false })
+	status, _ := s.do(t, http.MethodPost, "/api/v1/auth", "",
+		gin.H{"email": testEmail, "password": testPassword})
+	if status != http.StatusUnauthorized {
+		t.Errorf("status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if s.stored(t).Creds.VerificationToken == "" {
+		t.Error("verification not started")
+	}
+	if s.mail.count(testEmail) != 1 {
+		t.Error("verification email not sent")
+	}
+}
+
+func TestLoginNewRemote(t *testing.T) {
+	s := newServer(t)
+	s.update(t, func(u *models.User) { u.Creds.Remotes = nil })
+	status, _ := s.do(t, http.MethodPost, "/api/v1/auth", "",
+		gin.H{"email": testEmail, "password": testPassword})
+	if status != http.StatusUnauthorized {
+		t.Errorf("status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if s.stored(t).Creds.NewRemoteToken == "" {
+		t.Error("remote approval not started")
+	}
+	if s.mail.count(testEmail) != 1 {
+		t.Error("new computer email not sent")
+	}
+}
+
+func TestLogout(t *testing.T) {
+	s := newServer(t)
+	token := s.login(t, testPassword)
+	status, body := s.do(t, http.MethodDelete, "/api/v1/auth", token, nil)
+	if status != http.StatusOK {
+		t.Fatalf("status %d %v, want %d", status, body, http.StatusOK)
+	}
+	if s.tokenOnRecord(t, token) {
+		t.Error("token still on record after logout")
+	}
+}
+
+func TestLogoutInvalidToken(t *testing.T) {
+	s := newServer(t)
+	status, _ := s.do(t, http.MethodDelete, "/api/v1/auth", "not-a-token",
+		nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	s := newServer(t)
+	token := s.login(t, testPassword)
+	status, body := s.do(t, http.MethodPut, "/api/v1/auth", token, nil)
+	if status != http.StatusOK {
+		t.Fatalf("status %d %v, want %d", status, body, http.StatusOK)
+	}
+	refreshed, _ := body["token"].(string)
+	if refreshed == "" || refreshed == token {
+		t.Fatalf("no new token: %v", body)
+	}
+	if s.tokenOnRecord(t, token) {
+		t.Error("old token still on record")
+	}
+	if !s.tokenOnRecord(t, refreshed) {
+		t.Error("new token not on record")
+	}
+}
+
+func TestRefreshTokenInvalid(t *testing.T) {
+	s := newServer(t)
+	status, body := s.do(t, http.MethodPut, "/api/v1/auth", "not-a-token",
+		nil)
+	if status != http.StatusNotAcceptable {
+		t.Errorf("status %d, want %d", status, http.StatusNotAcceptable)
+	}
+	if body["token"] != nil {
+		t.Error("token given for an invalid one")
+	}
+}
+
+func TestVerifyEmailAddress(t *testing.T) {
+	s := newServer(t)
+	var verifyToken string
+	s.update(t, func(u *models.User) {
+		u.Creds.Verified = false
+		verifyToken = u.Creds.StartVerification()
+	})
+	status, body := s.do(t, http.MethodGet,
+		"/api/v1/auth/verify/"+verifyToken, "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("status %d %v, want %d", status, body, http.StatusOK)
+	}
+	if !s.stored(t).Creds.Verified {
+		t.Error("email address not verified")
+	}
+	s.login(t, testPassword)
+}
+
+func TestVerifyEmailAddressUnknownToken(t *testing.T) {
+	s := newServer(t)
+	s.update(t, func(u *models.User) {
+		u.Creds.Verified = false
+		u.Creds.StartVerification()
+	})
+	status, _ := s.do(t, http.MethodGet, "/api/v1/auth/verify/unknown", "",
+		nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", status, http.StatusBadRequest)
+	}
+	if s.stored(t).Creds.Verified {
+		t.Error("email address verified by an unknown token")
+	}
+}
+
+func TestApproveRemote(t *testing.T) {
+	s := newServer(t)
+	var remoteToken string
+	s.update(t, func(u *models.User) {
+		u.Creds.Remotes = nil
+		remoteToken = u.Creds.StartRemoteToken()
+	})
+	status, body := s.do(t, http.MethodGet,
+		"/api/v1/auth/remote/"+remoteToken, "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("status %d %v, want %d", status, body, http.StatusOK)
+	}
+	creds := s.stored(t).Creds
+	if creds.NewRemoteToken != "" {
+		t.Error("remote token not cleared")
+	}
+	if !creds.HasRemote(clientIP) {
+		t.Error("remote not added")
+	}
+	s.login(t, testPassword)
+}
+
+func TestApproveRemoteUnknownToken(t *testing.T) {
+	s := newServer(t)
+	status, _ := s.do(t, http.MethodGet, "/api/v1/auth/remote/unknown", "",
+		nil)
+	if status != http.StatusNotFound {
+		t.Errorf("status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	s := newServer(t)
+	token := s.login(t, testPassword)
+	status, body := s.do(t, http.MethodPut, "/api/v1/auth/password", token,
+		gin.H{"id": s.user.ID, "oldpassword": testPassword,
+			"newpassword": newPassword})
+	if status != http.StatusOK {
+		t.Fatalf("status %d %v, want %d", status, body, http.StatusOK)
+	}
+	if s.tokenOnRecord(t, token) {
+		t.Error("old token still on record")
+	}
+	s.login(t, newPassword)
+}
+
+func TestChangePasswordBadPassword(t *testing.T) {
+	s := newServer(t)
+	token := s.login(t, testPassword)
+	status, _ := s.do(t, http.MethodPut, "/api/v1/auth/password", token,
+		gin.H{"id": s.user.ID, "oldpassword": "not the password",
+			"newpassword": newPassword})
+	if status == http.StatusOK {
+		t.Fatal("password changed without the old one")
+	}
+	s.login(t, testPassword)
+}
+
+func TestChangePasswordInvalidToken(t *testing.T) {
+	s := newServer(t)
+	status, _ := s.do(t, http.MethodPut, "/api/v1/auth/password",
+		"not-a-token", gin.H{"id": s.user.ID, "oldpassword": testPassword,
+			"newpassword": newPassword})
+	if status != http.StatusNotAcceptable {
+		t.Errorf("status %d, want %d", status, http.StatusNotAcceptable)
+	}
+}
+
+func TestChangePasswordUnknownUser(t *testing.T) {
+	s := newServer(t)
+	token := s.login(t, testPassword)
+	status, _ := s.do(t, http.MethodPut, "/api/v1/auth/password", token,
+		gin.H{"id": "unknown", "oldpassword": testPassword,
+			"newpassword": newPassword})
+	if status != http.StatusNotFound {
+		t.Errorf("status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestForgotPassword(t *testing.T) {
+	s := newServer(t)
+	status, body := s.do(t, http.MethodPost, "/api/v1/auth/forgot", "",
+		gin.H{"email": testEmail})
+	if status != http.StatusOK {
+		t.Fatalf("status %d %v, want %d", status, body, http.StatusOK)
+	}
+	if s.mail.count(testEmail) != 1 {
+		t.Error("reset email not sent")
+	}
+	resetToken := s.stored(t).Creds.ResetToken
+	if resetToken == "" {
+		t.Fatal("reset not started")
+	}
+
+	status, body = s.do(t, http.MethodGet,
+		"/api/v1/auth/forgot/"+resetToken, "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("form status %d %v, want %d", status, body, http.StatusOK)
+	}
+	if body["userid"] != s.user.ID || body["resettoken"] != resetToken {
+		t.Errorf("form answered %v", body)
+	}
+
+	status, body = s.do(t, http.MethodPut, "/api/v1/auth/forgot", "",
+		gin.H{"userid": s.user.ID, "resettoken": resetToken,
+			"newpassword": newPassword})
+	if status != http.StatusOK {
+		t.Fatalf("change status %d %v, want %d", status, body,
+			http.StatusOK)
+	}
+	if s.stored(t).Creds.ResetToken != "" {
+		t.Error("reset token not cleared")
+	}
+	s.login(t, newPassword)
+
+	status, _ = s.do(t, http.MethodPut, "/api/v1/auth/forgot", "",
+		gin.H{"userid": s.user.ID, "resettoken": resetToken,
+			"newpassword": testPassword})
+	if status != http.StatusBadRequest {
+		t.Errorf("reused token status %d, want %d", status,
+			http.StatusBadRequest)
+	}
+}
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	s := newServer(t)
+	status, _ := s.do(t, http.MethodPost, "/api/v1/auth/forgot", "",
+		gin.H{"email": "nobody@example.com"})
+	if status != http.StatusNotFound {
+		t.Errorf("status %d, want %d", status, http.StatusNotFound)
+	}
+	if s.mail.count("nobody@example.com") != 0 {
+		t.Error("reset email sent to an unknown address")
+	}
+}
+
+func TestForgotPasswordFormUnknownToken(t *testing.T) {
+	s := newServer(t)
+	status, _ := s.do(t, http.MethodGet, "/api/v1/auth/forgot/unknown", "",
+		nil)
+	if status != http.StatusNotFound {
+		t.Errorf("status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestForgotPasswordChangeMismatch(t *testing.T) {
+	s := newServer(t)
+	s.update(t, func(u *models.User) { u.Creds.StartForgot() })
+	status, _ := s.do(t, http.MethodPut, "/api/v1/auth/forgot", "",
+		gin.H{"userid": s.user.ID, "resettoken": "unknown",
+			"newpassword": newPassword})
+	if status != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", status, http.StatusBadRequest)
+	}
+	s.login(t, testPassword)
+}
+
+func TestForgotPasswordExpired(t *testing.T) {
+	s := newServer(t)
+	var resetToken string
+	s.update(t, func(u *models.User) {
+		resetToken = u.Creds.StartForgot()
+		u.Creds.ResetExpires = time.Now().Add(-time.Minute)
+	})
+	status, _ := s.do(t, http.MethodGet, "/api/v1/auth/forgot/"+resetToken,
+		"", nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("form status %d, want %d", status, http.StatusBadRequest)
+	}
+	status, _ = s.do(t, http.MethodPut, "/api/v1/auth/forgot", "",
+		gin.H{"userid": s.user.ID, "resettoken": resetToken,
+			"newpassword": newPassword})
+	if status != http.StatusBadRequest {
+		t.Errorf("change status %d, want %d", status, http.StatusBadRequest)
+	}
+	s.login(t, testPassword)
+}
+
+func TestAddUser(t *testing.T) {
+	s := newServer(t)
+	status, body := s.do(t, http.MethodPost, "/api/v1/auth/users/", "",
+		gin.H{"email": "new@example.com", "first": "New", "last": "Reader",
+			"password": testPassword})
+	if status != http.StatusCreated {
+		t.Fatalf("status %d %v, want %d", status, body, http.StatusCreated)
+	}
+	if s.mail.count("new@example.com") != 1 {
+		t.Error("verification email not sent")
+	}
+	user, err := s.store.Users.ByEmail(context.Background(),
+		"new@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Creds.VerificationToken == "" {
+		t.Error("verification not started")
+	}
+}
+
+func TestAddUserEmailInUse(t *testing.T) {
+	s := newServer(t)
+	status, _ := s.do(t, http.MethodPost, "/api/v1/auth/users/", "",
+		gin.H{"email": testEmail, "first": "Test", "last": "Reader",
+			"password": testPassword})
+	if status != http.StatusConflict {
+		t.Errorf("status %d, want %d", status, http.StatusConflict)
+	}
+}
+
+func TestAddUserEmailNotSent(t *testing.T) {
+	s := newServer(t)
+	s.mail.listener.Close()
+	status, body := s.do(t, http.MethodPost, "/api/v1/auth/users/", "",
+		gin.H{"email": "new@example.com", "first": "New", "last": "Reader",
+			"password": testPassword})
+	if status != http.StatusBadRequest {
+		t.Errorf("status %d %v, want %d", status, body,
+			http.StatusBadRequest)
+	}
+	if body["message"] != nil {
+		t.Errorf("answered twice: %v", body)
+	}
+	_, err := s.store.Users.ByEmail(context.Background(), "new@example.com")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("user who can't be verified kept: %v", err)
+	}
+}
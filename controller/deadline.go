@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"go-soapauth/store"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deadline is middleware giving each request the time given to complete.
+// The request's context is cancelled when the time is up, so the database
+// calls made for it give up rather than tie up the handler.
+func Deadline(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// storeFailure returns the status and message to answer a request with when
+// the store fails: a timeout when the request's deadline passed, service
+// unavailable when the database can't be reached or the request was
+// cancelled, and the message given otherwise.
+func storeFailure(ctx context.Context, err error, message string) (int,
+	string) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "Request Timed Out"
+	case errors.Is(err, context.Canceled) || errors.Is(err, driver.ErrBadConn) ||
+		errors.As(err, &netErr):
+		return http.StatusServiceUnavailable, "Service Unavailable"
+	}
+	return http.StatusInternalServerError, message
+}
+
+// isStoreError reports whether the error from the store is a failure, rather
+// than the record asked for not being found.
+func isStoreError(err error) bool {
+	return err != nil && !errors.Is(err, store.ErrNotFound)
+}
@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"go-soapauth/config"
+	"go-soapauth/metrics"
+	"go-soapauth/preferences"
+	"go-soapauth/templates"
+	"go-soapauth/tracing"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	gomail "gopkg.in/mail.v2"
+)
+
+// PublicLink joins the public base url of the service with the api path
+// given, so emails can contain full clickable links.
+func PublicLink(base string, path ...string) string {
+	link := strings.TrimRight(base, "/")
+	for _, p := range path {
+		link += "/" + strings.Trim(p, "/")
+	}
+	return link
+}
+
+// sendEmail renders the kind of email given in the wording of the user's
+// locale and the look of their brand, with its button pointing at the link,
+// and delivers it through the configured smtp server as a plain text message
+// with an html alternative, counting it as sent or failed and tracing its
+// delivery.
+func sendEmail(ctx context.Context, t *templates.Templates,
+	smtp config.SMTP, m *metrics.Metrics, to, kind string,
+	pref preferences.UserPreference, link string) (err error) {
+	_, span := tracing.Start(ctx, "email.send",
+		attribute.String("email.kind", kind),
+		semconv.NetPeerNameKey.String(smtp.Server))
+	defer func() {
+		m.Email(kind, err)
+		tracing.End(span, err)
+	}()
+
+	email, err := t.RenderEmail(kind, pref.Locale, pref.Brand, link)
+	if err != nil {
+		return err
+	}
+
+	from := email.From
+	if from == "" {
+		from = smtp.From
+	}
+
+	mailer := gomail.NewMessage()
+
+	mailer.SetHeader("From", from)
+	mailer.SetHeader("To", to)
+	mailer.SetHeader("Subject", email.Subject)
+	mailer.SetBody("text/plain", email.Text)
+	mailer.AddAlternative("text/html", email.HTML)
+
+	dialer := gomail.NewDialer(smtp.Server, smtp.Port, smtp.User,
+		smtp.CurrentPassword())
+	if smtp.TLSVerify == config.SMTPInsecure {
+		dialer.TLSConfig = &tls.Config{ServerName: smtp.Server,
+			InsecureSkipVerify: true}
+	}
+
+	return dialer.DialAndSend(mailer)
+}
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"go-soapauth/cache"
+	"go-soapauth/health"
+	"go-soapauth/server"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HealthController answers the probes of the orchestrator and the status
+// page listing the state of each dependency, and the hits and misses of the
+// cache when it is given one.
+type HealthController struct {
+	Checker *health.Checker
+	Ready   *server.Readiness
+	Cache   *cache.Metered
+}
+
+// Healthz godoc
+// @Summary Liveness probe
+// @Description Answers while the process is running
+// @ID healthz
+// @Produce json
+// @Success 200 {object} map[string]string
+// @Router /healthz [get]
+func (h *HealthController) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+// Readyz godoc
+// @Summary Readiness probe
+// @Description Answers 200 when the database can be reached, its migrations
+// are applied and tokens can be signed, and 503 otherwise or while the
+// service is shutting down
+// @ID readyz
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 503 {object} map[string]interface{}
+// @Router /readyz [get]
+func (h *HealthController) Readyz(c *gin.Context) {
+	if !h.Ready.Ready() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "shutting down",
+		})
+		return
+	}
+	states, ok := h.Checker.Ready(c.Request.Context())
+	h.respond(c, states, ok, nil)
+}
+
+// Status godoc
+// @Summary Dependency status
+// @Description Lists the state, latency and last error of each dependency,
+// and the hits and misses of the cache
+// @ID status
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 401,503 {object} map[string]interface{}
+// @Router /status [get]
+func (h *HealthController) Status(c *gin.Context) {
+	states, ok := h.Checker.Status(c.Request.Context())
+	var stats *cache.Stats
+	if h.Cache != nil {
+		s := h.Cache.Stats()
+		stats = &s
+	}
+	h.respond(c, states, ok && h.Ready.Ready(), stats)
+}
+
+// respond answers with the states of the dependencies, as unavailable
+// unless ok, and the cache's stats when given.
+func (h *HealthController) respond(c *gin.Context, states []health.State,
+	ok bool, stats *cache.Stats) {
+	status, text := http.StatusOK, "ok"
+	if !ok {
+		status, text = http.StatusServiceUnavailable, "unavailable"
+	}
+	body := gin.H{
+		"status":       text,
+		"dependencies": states,
+	}
+	if stats != nil {
+		body["cache"] = stats
+	}
+	c.JSON(status, body)
+}
@@ -0,0 +1,26 @@
+package controller
+
+import (
+	"context"
+	"go-soapauth/tracing"
+
+	"github.com/antonerne/go-soap/models"
+)
+
+// logIn checks the password and remote address against the credentials,
+// in a span of its own as hashing the password is slow by design.
+func logIn(ctx context.Context, creds *models.Credentials, password,
+	ip string) (bool, *models.ErrorMessage) {
+	_, span := tracing.Start(ctx, "password.verify")
+	defer span.End()
+	return creds.LogIn(password, ip)
+}
+
+// setPassword hashes the password into the credentials, in a span of its
+// own.
+func setPassword(ctx context.Context, creds *models.Credentials,
+	password string) (bool, *models.ErrorMessage) {
+	_, span := tracing.Start(ctx, "password.hash")
+	defer span.End()
+	return creds.SetPassword(password)
+}
@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"go-soapauth/preferences"
+	"go-soapauth/store"
+	"go-soapauth/templates"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestLocale returns the locale to answer the request in, based on its
+// Accept-Language header.
+func requestLocale(c *gin.Context, t *templates.Templates) string {
+	return t.MatchLocale(
+		templates.ParseAcceptLanguage(c.GetHeader("Accept-Language"))...)
+}
+
+// translate returns the text in the locale asked for by the request.
+func translate(c *gin.Context, t *templates.Templates, text string) string {
+	return t.Translate(requestLocale(c, t), text)
+}
+
+// requestBrand returns the brand of the site the request came from, based on
+// its Origin or Referer header, or the host it was sent to.  The default
+// brand is returned when none of them match a brand.
+func requestBrand(c *gin.Context, t *templates.Templates) templates.Brand {
+	for _, header := range []string{"Origin", "Referer"} {
+		if u, err := url.Parse(c.GetHeader(header)); err == nil && u.Host != "" {
+			if brand, ok := t.BrandForHost(u.Host); ok {
+				return brand
+			}
+		}
+	}
+	if brand, ok := t.BrandForHost(c.Request.Host); ok {
+		return brand
+	}
+	return t.Brand("")
+}
+
+// userPreference returns the user's stored preferences, with the locale and
+// brand of the request filling in for any the user doesn't have.
+func userPreference(c *gin.Context, st *store.Store, t *templates.Templates,
+	userID string) preferences.UserPreference {
+	pref := preferences.UserPreference{UserID: userID}
+	stored, err := st.Preferences.Get(c.Request.Context(), userID)
+	if err == nil {
+		pref = *stored
+	}
+	if pref.Locale == "" {
+		pref.Locale = requestLocale(c, t)
+	}
+	if pref.Brand == "" {
+		pref.Brand = requestBrand(c, t).ID
+	}
+	return pref
+}
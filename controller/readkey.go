@@ -0,0 +1,28 @@
+package controller
+
+import (
+	"context"
+	"go-soapauth/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReadKey is middleware giving the request's store calls the client's
+// address as their read key, so a client reading just after writing is
+// answered from the primary database rather than a replica yet to catch up.
+// Once the request is known to be a user's, readAs keys it by the user
+// instead, so users behind a shared address don't pin each other and a user
+// whose address changes still reads their own writes.
+func ReadKey(c *gin.Context) {
+	c.Request = c.Request.WithContext(
+		store.WithReadKey(c.Request.Context(), "ip:"+c.ClientIP()))
+	c.Next()
+}
+
+// readAs keys the rest of the request's store calls by the user's id, and
+// returns the request's context so keyed.
+func readAs(c *gin.Context, userID string) context.Context {
+	ctx := store.WithReadKey(c.Request.Context(), "user:"+userID)
+	c.Request = c.Request.WithContext(ctx)
+	return ctx
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"bytes"
+	"go-soapauth/communications"
+	"go-soapauth/logging"
+	"go-soapauth/templates"
+	"log/slog"
+	"net/http"
+
+	models "github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// verificationData holds the values shown on the verification web page.
+type verificationData struct {
+	Title   string
+	Message string
+	Action  string
+	Footer  string
+}
+
+// changeData holds the values used by the forgotten password change page.
+type changeData struct {
+	UserID     string
+	ResetToken string
+	Action     string
+}
+
+// logger returns the logger of the request, holding its id, the client's
+// address and, once authorized, the user's id.
+func logger(c *gin.Context) *slog.Logger {
+	return logging.From(c.Request.Context())
+}
+
+// wantsHTML reports whether the caller, based on its Accept header, prefers
+// a web page to a json response.
+func wantsHTML(c *gin.Context) bool {
+	return c.NegotiateFormat(binding.MIMEJSON, binding.MIMEHTML) ==
+		binding.MIMEHTML
+}
+
+// respond answers the request with the json body given, or for a browser,
+// with the html template filled in from data.  If the template can't be
+// rendered, the json body is sent instead.
+func (con *Controller) respond(c *gin.Context, status int, tmpl string,
+	data interface{}, body interface{}) {
+	if wantsHTML(c) {
+		err := renderPage(c, con.Templates, status, tmpl, templates.Page{
+			Brand:  requestBrand(c, con.Templates),
+			Locale: requestLocale(c, con.Templates),
+			Data:   data,
+		})
+		if err == nil {
+			return
+		}
+		logger(c).Error("page not rendered", "event", "render_failed",
+			"template", tmpl, "error", err)
+	}
+	c.JSON(status, body)
+}
+
+// respondError answers the request with the error message, either as json,
+// shaped like the other errors as {"error": message}, or as the error web
+// page.
+func (con *Controller) respondError(c *gin.Context,
+	cErr *communications.ErrorMessage) {
+	localized := *cErr
+	localized.Message = translate(c, con.Templates, cErr.Message)
+	con.respond(c, int(cErr.StatusCode), templates.ErrorPage, &localized,
+		gin.H{
+			"error": localized.Message,
+		})
+}
+
+// respondStoreError logs an error from the store and answers the request
+// with the message given as a server error, leaving the database details
+// out of the response.
+func (con *Controller) respondStoreError(c *gin.Context, message string,
+	err error) {
+	logger(c).Error(message, "event", "store_error", "error", err)
+	status, message := storeFailure(c.Request.Context(), err, message)
+	con.respondError(c, &communications.ErrorMessage{
+		ErrorType:  "database",
+		StatusCode: int32(status),
+		Message:    message,
+	})
+}
+
+// respondMessage answers the request with a simple message as json, or with
+// the verification web page for a browser.
+func (con *Controller) respondMessage(c *gin.Context, message string,
+	page verificationData) {
+	if page.Footer == "" {
+		page.Footer = "Sent by {brand} Support"
+	}
+	locale := requestLocale(c, con.Templates)
+	brand := requestBrand(c, con.Templates)
+	page.Title = brand.Apply(con.Templates.Translate(locale, page.Title))
+	page.Message = brand.Apply(con.Templates.Translate(locale, page.Message))
+	page.Action = brand.Apply(con.Templates.Translate(locale, page.Action))
+	page.Footer = brand.Apply(con.Templates.Translate(locale, page.Footer))
+	con.respond(c, http.StatusOK, templates.VerificationPage, page,
+		communications.MessageResponse{Message: message})
+}
+
+// toErrorMessage converts an error message from the models package into the
+// communications error message returned to callers.
+func toErrorMessage(mErr *models.ErrorMessage) *communications.ErrorMessage {
+	return &communications.ErrorMessage{
+		ErrorType:  mErr.ErrorType,
+		StatusCode: mErr.StatusCode,
+		Message:    mErr.Message,
+	}
+}
+
+// renderPage fills in the named page template and writes it as the response
+// with the status provided.
+func renderPage(c *gin.Context, t *templates.Templates, status int,
+	tmpl string, data templates.Page) error {
+	buffer := new(bytes.Buffer)
+	if err := t.ExecutePage(buffer, tmpl, data); err != nil {
+		return err
+	}
+	c.Data(status, "text/html; charset=utf-8", buffer.Bytes())
+	return nil
+}
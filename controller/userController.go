@@ -1,68 +1,114 @@
 package controller
 
 import (
-	"bytes"
-	"crypto/tls"
-	"fmt"
+	"context"
+	"go-soapauth/audit"
+	"go-soapauth/cache"
 	"go-soapauth/communications"
+	"go-soapauth/config"
+	"go-soapauth/metrics"
+	"go-soapauth/preferences"
+	"go-soapauth/store"
+	"go-soapauth/templates"
+	"go-soapauth/webhook"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	models "github.com/antonerne/go-soap/models"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	gomail "gopkg.in/mail.v2"
-
-	"gorm.io/gorm"
 )
 
 type UserController struct {
-	DB        *gorm.DB
-	ErrorLog  *models.LogFile
-	AccessLog *models.LogFile
+	Store     *store.Store
+	BaseURL   string
+	Templates *templates.Templates
+	Mail      config.SMTP
+	Cache     cache.Cache
+	CacheTTL  time.Duration
+	Metrics   *metrics.Metrics
+	Webhooks  *webhook.Dispatcher
+	AuditKey  audit.Key
 }
 
 func (e *UserController) GetUser(c *gin.Context) {
+	ctx := c.Request.Context()
 	userid := c.Param("id")
 	if userid != "" {
-		var user models.User
-		e.DB.Preload("Name").Preload("Creds").Where("id = ?", userid).
-			Find(&user)
-		var studies []models.UserBibleStudy
-		e.DB.Preload("Periods.StudyDays.References").
-			Where("userid = ?", userid).Where("startdate <= ?", time.Now()).
-			Where("enddate >= ?", time.Now()).Find(&studies)
-		user.Studies = append(user.Studies, studies...)
+		user, err := e.Store.Users.ByID(ctx, userid)
+		if isStoreError(err) {
+			e.respondStoreError(c, "Unable to Find User", err)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": translate(c, e.Templates, "User Not Found"),
+			})
+			return
+		}
+		studies, err := e.Store.Users.CurrentStudies(ctx, userid, time.Now())
+		if err != nil {
+			e.respondStoreError(c, "Unable to Find User", err)
+			return
+		}
+		user.Studies = studies
 		c.JSON(http.StatusOK, gin.H{
 			"user": user,
 		})
 		return
 	}
 	c.JSON(http.StatusBadRequest, gin.H{
-		"error": "No User ID provided",
+		"error": translate(c, e.Templates, "No User ID provided"),
+	})
+}
+
+// GetStudies returns all of the user's bible studies, with their periods,
+// days and references, which the other user and auth routes don't load.
+func (e *UserController) GetStudies(c *gin.Context) {
+	ctx := c.Request.Context()
+	userid := c.Param("id")
+	_, err := e.Store.Users.ByID(ctx, userid)
+	if isStoreError(err) {
+		e.respondStoreError(c, "Unable to Find User", err)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": translate(c, e.Templates, "User Not Found"),
+		})
+		return
+	}
+	studies, err := e.Store.Users.Studies(ctx, userid)
+	if err != nil {
+		e.respondStoreError(c, "Unable to Find Studies", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"studies": studies,
 	})
 }
 
 func (e *UserController) AddUser(c *gin.Context) {
+	ctx := c.Request.Context()
 	var newUser communications.NewUserRequest
 	if err := c.BindJSON(&newUser); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "No Request Data - " + err.Error(),
+			"error": translate(c, e.Templates, "No Request Data") + " - " +
+				err.Error(),
 		})
 		return
 	}
 
-	var olduser models.User
-
-	e.DB.Where("email = ?", newUser.Email).Find(&olduser)
-
-	if olduser.ID != "" {
+	_, err := e.Store.Users.ByEmail(ctx, newUser.Email)
+	if isStoreError(err) {
+		e.respondStoreError(c, "Unable to Find User", err)
+		return
+	}
+	if err == nil {
 		c.JSON(http.StatusConflict, gin.H{
-			"error": "Email Address already in use",
+			"error": translate(c, e.Templates, "Email Address already in use"),
 		})
 		return
 	}
@@ -75,130 +121,220 @@ func (e *UserController) AddUser(c *gin.Context) {
 	user.Name.Last = newUser.LastName
 	user.Name.Suffix = newUser.NameSuffix
 
-	_, uerr := user.Creds.SetPassword(newUser.Password)
+	_, uerr := setPassword(ctx, &user.Creds, newUser.Password)
 	if uerr != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Error Creating User - " + uerr.Message,
+			"error": translate(c, e.Templates, "Error Creating User") + " - " +
+				translate(c, e.Templates, uerr.Message),
 		})
 		return
 	}
 
-	e.DB.Create(&user)
-
 	token := user.Creds.StartVerification()
 
-	err := e.SendVerificationEmail(user, token)
+	// the user's locale comes from the request, or from the languages the
+	// browser asks for, and their brand from the request or the site it came
+	// from.  Both are used for the emails sent to them.
+	locale := e.Templates.MatchLocale(append([]string{newUser.Locale},
+		templates.ParseAcceptLanguage(c.GetHeader("Accept-Language"))...)...)
+	brand := requestBrand(c, e.Templates).ID
+	if newUser.Brand != "" {
+		brand = e.Templates.Brand(newUser.Brand).ID
+	}
+	// the user is only added along with their preferences.
+	err = e.Store.Transaction(ctx,
+		func(ctx context.Context, tx *store.Store) error {
+			if err := tx.Users.Create(ctx, user); err != nil {
+				return err
+			}
+			return tx.Preferences.Save(ctx, &preferences.UserPreference{
+				UserID: user.ID, Locale: locale, Brand: brand})
+		})
+	if err != nil {
+		e.respondStoreError(c, "Error Creating User", err)
+		return
+	}
+
+	// the email is sent once the preferences it is worded by are saved.  A
+	// user who can't be sent it is removed again, so the address can be
+	// signed up with once more rather than being taken by an account which
+	// can't be verified.
+	err = e.SendVerificationEmail(c, user, token)
 	if err != nil {
+		logger(c).Error("verification email not sent",
+			"event", "email_failed", "target_id", user.ID, "error", err)
+		if derr := e.Store.Users.Delete(ctx, user.ID); derr != nil {
+			logger(c).Error("unverifiable user not removed",
+				"event", "store_error", "target_id", user.ID, "error", derr)
+		}
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Problem Sending Verification Message",
+			"error": translate(c, e.Templates, "Problem Sending Verification Message"),
 		})
+		return
 	}
+	logger(c).Info("user added", "event", "user_added", "target_id", user.ID)
+	e.record(c, audit.Event{Action: audit.ActionUserCreated,
+		TargetID: user.ID})
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Verification Email Sent",
 	})
 }
 
-func (e *UserController) SendVerificationEmail(user *models.User,
-	token string) error {
-
-	t, err := template.ParseFiles("email.template.html")
-	if err != nil {
-		return err
-	}
-
-	data := struct {
-		Subject string
-		Message string
-		Link    string
-	}{
-		Subject: "SOAP Bible Study Email Confirmation",
-		Message: `You must verify your email address in the system before you
-			are allowed to log into the system.  Use the following token string
-			to verify your email address.  Type it in the space provided by the
-			web site.`,
-		Link: token,
-	}
-
-	fmt.Println(user.Email)
-
-	buffer := new(bytes.Buffer)
-	if err := t.Execute(buffer, data); err != nil {
-		return err
-	}
-	body := buffer.String()
-
-	mailer := gomail.NewMessage()
-
-	mailer.SetHeader("From", os.Getenv("SMTP_FROM_EMAIL"))
-	mailer.SetHeader("To", user.Email)
-	mailer.SetHeader("Subject", data.Subject)
-	mailer.SetBody("text/html", body)
-
-	port, _ := strconv.Atoi(os.Getenv("SMTP_PORT"))
-	dialer := gomail.NewDialer(os.Getenv("SMTP_SERVER"), port,
-		os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"))
-	dialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-
-	if err := dialer.DialAndSend(mailer); err != nil {
-		return err
-	}
-	return nil
+// SendVerificationEmail sends the user an email containing the link used to
+// verify their email address.
+func (e *UserController) SendVerificationEmail(c *gin.Context,
+	user *models.User, token string) error {
+	return sendEmail(c.Request.Context(), e.Templates, e.Mail,
+		e.Metrics, user.Email, templates.VerificationEmail,
+		userPreference(c, e.Store, e.Templates, user.ID),
+		PublicLink(e.BaseURL, "api/v1/auth/verify", token))
 }
 
 func (u *UserController) UpdateUser(c *gin.Context) {
+	ctx := c.Request.Context()
 	var req communications.UpdateUserRequest
 	if err := c.BindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "No Request Data - " + err.Error(),
+			"error": translate(c, u.Templates, "No Request Data") + " - " +
+				err.Error(),
 		})
 		return
 	}
 
-	var user models.User
-	u.DB.Preload("Name").Preload("Creds.Remotes").
-		Where("id = ? OR email = ?", req.ID, req.Email).Find(&user)
+	user, err := u.Store.Users.ByID(ctx, req.ID)
+	if err != nil {
+		user, err = u.Store.Users.ByEmail(ctx, req.Email)
+	}
+	if isStoreError(err) {
+		u.respondStoreError(c, "Unable to Find User", err)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": translate(c, u.Templates, "User Not Found"),
+		})
+		return
+	}
 
 	switch strings.ToLower(req.Field) {
 	case "email":
 		user.Email = req.Value
 		token := user.Creds.StartVerification()
-		u.DB.Save(&user)
-		u.SendVerificationEmail(&user, token)
+		if err := u.Store.Users.Save(ctx, user); err != nil {
+			u.respondStoreError(c, "Unable to Update User", err)
+			return
+		}
+		logger(c).Info("email changed", "event", "email_changed",
+			"target_id", user.ID)
+		u.record(c, audit.Event{Action: audit.ActionEmailChanged,
+			TargetID: user.ID})
+		if err := u.SendVerificationEmail(c, user, token); err != nil {
+			logger(c).Error("verification email not sent",
+				"event", "email_failed", "target_id", user.ID, "error", err)
+		}
 		c.JSON(http.StatusOK, gin.H{
 			"message": "Verification sent",
 		})
 		return
 	case "first":
 		user.Name.First = req.Value
-		u.DB.Save(&user.Name)
+		err = u.Store.Users.SaveName(ctx, &user.Name)
 	case "middle":
 		user.Name.Middle = req.Value
-		u.DB.Save(&user.Name)
+		err = u.Store.Users.SaveName(ctx, &user.Name)
 	case "last":
 		user.Name.Last = req.Value
-		u.DB.Save(&user.Name)
+		err = u.Store.Users.SaveName(ctx, &user.Name)
 	case "suffix":
 		user.Name.Suffix = req.Value
-		u.DB.Save(&user.Name)
+		err = u.Store.Users.SaveName(ctx, &user.Name)
 	case "password":
-		user.Creds.SetPassword(req.Value)
-		u.DB.Save(&user.Creds)
+		if _, pErr := setPassword(ctx, &user.Creds,
+			req.Value); pErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": translate(c, u.Templates, pErr.Message),
+			})
+			return
+		}
+		if err = u.Store.Credentials.Save(ctx, &user.Creds); err == nil {
+			u.record(c, audit.Event{
+				Action: audit.ActionPasswordChanged, TargetID: user.ID})
+		}
+	case "editor":
+		// only editors may make others editors, or stop them being one.
+		editor, pErr := strconv.ParseBool(req.Value)
+		if pErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": translate(c, u.Templates, "No Request Data"),
+			})
+			return
+		}
+		if !c.GetBool("editor") {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": translate(c, u.Templates, "Not Authorized"),
+			})
+			return
+		}
+		user.Editor = editor
+		if err = u.Store.Users.Save(ctx, user); err == nil {
+			forget(ctx, u.Cache, roleKey(user.ID))
+			role := "user"
+			if editor {
+				role = "editor"
+			}
+			u.record(c, audit.Event{Action: audit.ActionRoleChanged,
+				Reason: role, TargetID: user.ID})
+		}
+	case "locale":
+		pref := userPreference(c, u.Store, u.Templates, user.ID)
+		pref.Locale = u.Templates.MatchLocale(req.Value)
+		err = u.Store.Preferences.Save(ctx, &pref)
+	case "brand":
+		pref := userPreference(c, u.Store, u.Templates, user.ID)
+		pref.Brand = u.Templates.Brand(req.Value).ID
+		err = u.Store.Preferences.Save(ctx, &pref)
 	}
+	if err != nil {
+		u.respondStoreError(c, "Unable to Update User", err)
+		return
+	}
+	logger(c).Info("user updated", "event", "user_updated",
+		"target_id", user.ID, "field", strings.ToLower(req.Field))
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Update Complete",
 	})
 }
 
 func (u *UserController) DeleteUser(c *gin.Context) {
+	ctx := c.Request.Context()
 	id := c.Param("id")
 	if id != "" {
-		u.DB.Where("id = ?", id).Delete(models.User{})
+		if err := u.Store.Users.Delete(ctx, id); err != nil {
+			u.respondStoreError(c, "Unable to Delete User", err)
+			return
+		}
+		forget(ctx, u.Cache, roleKey(id))
+		logger(c).Info("user deleted", "event", "user_deleted",
+			"target_id", id)
+		u.record(c, audit.Event{Action: audit.ActionUserDeleted,
+			TargetID: id})
 		c.JSON(http.StatusOK, gin.H{
 			"message": "User deleted",
 		})
 		return
 	}
 	c.JSON(http.StatusNotFound, gin.H{
-		"error": "No ID provided for deletion",
+		"error": translate(c, u.Templates, "No ID provided for deletion"),
+	})
+}
+
+// respondStoreError logs an error from the store and answers the request
+// with the message given as a server error.
+func (u *UserController) respondStoreError(c *gin.Context, message string,
+	err error) {
+	logger(c).Error(message, "event", "store_error", "error", err)
+	status, message := storeFailure(c.Request.Context(), err, message)
+	c.JSON(status, gin.H{
+		"error": translate(c, u.Templates, message),
 	})
 }
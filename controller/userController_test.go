@@ -0,0 +1,263 @@
+package controller_test
+
+import (
+	"context"
+	"errors"
+	"go-soapauth/store"
+	"net/http"
+	"testing"
+	"time"
+
+	models "github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+)
+
+// otherID is the id of the second user added to the store.
+const otherID = "9d7c1e52-5b0e-4a3f-8f4e-2c6a7b9d0e21"
+
+// addOther adds a second user, with the studies given, to the store.
+func (s *testServer) addOther(t *testing.T,
+	studies ...models.UserBibleStudy) *models.User {
+	t.Helper()
+	user := &models.User{ID: otherID, Email: "other@example.com",
+		Name:    models.UserName{First: "Other", Last: "Reader"},
+		Studies: studies}
+	if ok, err := user.Creds.SetPassword(testPassword); !ok || err != nil {
+		t.Fatalf("password not set: %v", err)
+	}
+	user.Creds.Verified = true
+	user.Creds.Remotes = []models.UserRemote{{CredentialsUserID: otherID,
+		RemoteIP: clientIP}}
+	if err := s.store.Users.Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// study returns a study running from the days before now given to those
+// after.
+func study(id uint, from, to int) models.UserBibleStudy {
+	now := time.Now()
+	return models.UserBibleStudy{ID: id, UserID: otherID,
+		StartDate: now.AddDate(0, 0, from), EndDate: now.AddDate(0, 0, to)}
+}
+
+func TestGetUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		status int
+	}{
+		{name: "self", id: "4b9b0b36-2f4c-4d64-9c36-1f1d4e0e6c11",
+			status: http.StatusOK},
+		{name: "other user", id: otherID, status: http.StatusOK},
+		{name: "unknown user", id: "unknown", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t)
+			s.addOther(t)
+			status, body := s.do(t, http.MethodGet,
+				"/api/v1/auth/users/"+tt.id, s.login(t, testPassword), nil)
+			if status != tt.status {
+				t.Fatalf("status %d %v, want %d", status, body, tt.status)
+			}
+			if status == http.StatusOK && body["user"] == nil {
+				t.Errorf("no user answered: %v", body)
+			}
+			if status != http.StatusOK && body["error"] == nil {
+				t.Errorf("no error answered: %v", body)
+			}
+		})
+	}
+}
+
+func TestGetStudies(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		status  int
+		studies int
+	}{
+		{name: "every study", id: otherID, status: http.StatusOK,
+			studies: 3},
+		{name: "user without studies",
+			id:     "4b9b0b36-2f4c-4d64-9c36-1f1d4e0e6c11",
+			status: http.StatusOK},
+		{name: "unknown user", id: "unknown", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t)
+			s.addOther(t, study(1, -400, -35), study(2, -30, 30),
+				study(3, 35, 400))
+			status, body := s.do(t, http.MethodGet,
+				"/api/v1/auth/users/"+tt.id+"/studies",
+				s.login(t, testPassword), nil)
+			if status != tt.status {
+				t.Fatalf("status %d %v, want %d", status, body, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			studies, ok := body["studies"].([]interface{})
+			if body["studies"] != nil && !ok {
+				t.Fatalf("studies answered %v", body["studies"])
+			}
+			if len(studies) != tt.studies {
+				t.Errorf("%d studies answered, want %d", len(studies),
+					tt.studies)
+			}
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		editor bool
+		target string
+		field  string
+		value  string
+		status int
+		// check inspects the target as kept in the store afterwards.
+		check func(t *testing.T, s *testServer, user *models.User)
+	}{
+		{name: "first name", target: otherID, field: "first", value: "New",
+			status: http.StatusOK,
+			check: func(t *testing.T, _ *testServer, user *models.User) {
+				if user.Name.First != "New" {
+					t.Errorf("first name %q", user.Name.First)
+				}
+			}},
+		{name: "middle name", target: otherID, field: "Middle",
+			value: "Q", status: http.StatusOK,
+			check: func(t *testing.T, _ *testServer, user *models.User) {
+				if user.Name.Middle != "Q" {
+					t.Errorf("middle name %q", user.Name.Middle)
+				}
+			}},
+		{name: "last name", target: otherID, field: "last", value: "Other",
+			status: http.StatusOK,
+			check: func(t *testing.T, _ *testServer, user *models.User) {
+				if user.Name.Last != "Other" {
+					t.Errorf("last name %q", user.Name.Last)
+				}
+			}},
+		{name: "suffix", target: otherID, field: "suffix", value: "Jr",
+			status: http.StatusOK,
+			check: func(t *testing.T, _ *testServer, user *models.User) {
+				if user.Name.Suffix != "Jr" {
+					t.Errorf("suffix %q", user.Name.Suffix)
+				}
+			}},
+		{name: "email", target: otherID, field: "email",
+			value: "changed@example.com", status: http.StatusOK,
+			check: func(t *testing.T, s *testServer, user *models.User) {
+				if user.Email != "changed@example.com" {
+					t.Errorf("email %q", user.Email)
+				}
+				if user.Creds.VerificationToken == "" {
+					t.Error("verification not started")
+				}
+				if s.mail.count("changed@example.com") != 1 {
+					t.Error("verification email not sent")
+				}
+			}},
+		{name: "password", target: otherID, field: "password",
+			value: newPassword, status: http.StatusOK,
+			check: func(t *testing.T, s *testServer, user *models.User) {
+				status, _ := s.do(t, http.MethodPost, "/api/v1/auth", "",
+					gin.H{"email": user.Email, "password": newPassword})
+				if status != http.StatusOK {
+					t.Errorf("login with the new password answered %d",
+						status)
+				}
+			}},
+		{name: "password too short", target: otherID, field: "password",
+			value: "short", status: http.StatusBadRequest},
+		{name: "locale", target: otherID, field: "locale", value: "es",
+			status: http.StatusOK,
+			check: func(t *testing.T, s *testServer, user *models.User) {
+				pref, err := s.store.Preferences.Get(context.Background(),
+					user.ID)
+				if err != nil || pref.Locale != "es" {
+					t.Errorf("locale %q, %v; want es", pref.Locale, err)
+				}
+			}},
+		{name: "editor by a user", target: otherID, field: "editor",
+			value: "true", status: http.StatusForbidden,
+			check: func(t *testing.T, _ *testServer, user *models.User) {
+				if user.Editor {
+					t.Error("made an editor by a user who isn't one")
+				}
+			}},
+		{name: "editor by an editor", editor: true, target: otherID,
+			field: "editor", value: "true", status: http.StatusOK,
+			check: func(t *testing.T, _ *testServer, user *models.User) {
+				if !user.Editor {
+					t.Error("not made an editor")
+				}
+			}},
+		{name: "editor not a boolean", editor: true, target: otherID,
+			field: "editor", value: "sometimes",
+			status: http.StatusBadRequest},
+		{name: "unknown user", target: "unknown", field: "first",
+			value: "New", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t)
+			s.update(t, func(u *models.User) { u.Editor = tt.editor })
+			s.addOther(t)
+			status, body := s.do(t, http.MethodPut, "/api/v1/auth/users/",
+				s.login(t, testPassword),
+				gin.H{"id": tt.target, "field": tt.field, "value": tt.value})
+			if status != tt.status {
+				t.Fatalf("status %d %v, want %d", status, body, tt.status)
+			}
+			if tt.check == nil {
+				return
+			}
+			user, err := s.store.Users.ByID(context.Background(), tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, s, user)
+		})
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	s := newServer(t)
+	s.addOther(t)
+	token := s.login(t, testPassword)
+	status, body := s.do(t, http.MethodDelete, "/api/v1/auth/users/"+otherID,
+		token, nil)
+	if status != http.StatusOK {
+		t.Fatalf("status %d %v, want %d", status, body, http.StatusOK)
+	}
+	_, err := s.store.Users.ByID(context.Background(), otherID)
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("user still stored: %v", err)
+	}
+	status, _ = s.do(t, http.MethodGet, "/api/v1/auth/users/"+otherID, token,
+		nil)
+	if status != http.StatusNotFound {
+		t.Errorf("deleted user answered %d, want %d", status,
+			http.StatusNotFound)
+	}
+
+	// a user deleting themselves can't use their token any longer.
+	status, _ = s.do(t, http.MethodDelete, "/api/v1/auth/users/"+s.user.ID,
+		token, nil)
+	if status != http.StatusOK {
+		t.Fatalf("status %d, want %d", status, http.StatusOK)
+	}
+	status, _ = s.do(t, http.MethodGet, "/api/v1/auth/users/"+s.user.ID,
+		token, nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("deleted user's token answered %d, want %d", status,
+			http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,295 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"go-soapauth/audit"
+	"go-soapauth/communications"
+	"go-soapauth/logging"
+	"go-soapauth/webhook"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// deliveryLimit is the number of deliveries returned when the caller
+// doesn't ask for a number.
+const deliveryLimit = 100
+
+// minSecretLength is the length of the shortest secret a subscription may
+// be given.
+const minSecretLength = 16
+
+// sampleTarget is the id of the user named by sample events, which is no
+// user's id.
+const sampleTarget = "00000000-0000-0000-0000-000000000000"
+
+// ListWebhooks godoc
+// @Summary List the webhook subscriptions
+// @Description Lists the subscriptions of services to the security events.
+// @ID list-webhooks
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 401,403,500 {object} communications.ErrorMessage
+// @Router /webhooks [get]
+func (con *Controller) ListWebhooks(c *gin.Context) {
+	subs, err := con.Store.Webhooks.All(c.Request.Context())
+	if err != nil {
+		con.respondStoreError(c, "Unable to Find Webhooks", err)
+		return
+	}
+	if subs == nil {
+		subs = []webhook.Subscription{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"webhooks": subs,
+	})
+}
+
+// AddWebhook godoc
+// @Summary Subscribe to security events
+// @Description Subscribes the url to the actions given, or "*" for all of
+// them.  The payloads posted to it are signed with the secret given, or
+// else with one made up, which is only returned here.
+// @ID add-webhook
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param request body communications.WebhookRequest true "Url, actions and secret"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400,401,403,500 {object} communications.ErrorMessage
+// @Router /webhooks [post]
+func (con *Controller) AddWebhook(c *gin.Context) {
+	var request communications.WebhookRequest
+	if err := c.BindJSON(&request); err != nil {
+		con.respondError(c, &communications.ErrorMessage{
+			ErrorType:  "request",
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+		})
+		return
+	}
+	if problem := checkWebhook(request); problem != "" {
+		con.respondError(c, &communications.ErrorMessage{
+			ErrorType:  "request",
+			StatusCode: http.StatusBadRequest,
+			Message:    problem,
+		})
+		return
+	}
+
+	secret := request.Secret
+	if secret == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			con.respondError(c, &communications.ErrorMessage{
+				ErrorType:  "webhook",
+				StatusCode: http.StatusInternalServerError,
+				Message:    "Unable to Create Secret",
+			})
+			return
+		}
+		secret = hex.EncodeToString(key)
+	}
+	sub := &webhook.Subscription{
+		ID:      uuid.NewString(),
+		URL:     request.URL,
+		Events:  strings.Join(request.Events, ","),
+		Secret:  secret,
+		Created: time.Now().UTC(),
+	}
+	err := con.Store.Webhooks.Create(c.Request.Context(), sub)
+	if err != nil {
+		con.respondStoreError(c, "Unable to Save Webhook", err)
+		return
+	}
+	logger(c).Info("webhook added", "event", "webhook_created",
+		"subscription_id", sub.ID, "url", sub.URL, "events", sub.Events)
+	con.record(c, audit.Event{Action: audit.ActionWebhookCreated,
+		TargetID: sub.ID})
+	c.JSON(http.StatusCreated, gin.H{
+		"webhook": sub,
+		"secret":  secret,
+	})
+}
+
+// checkWebhook returns what is wrong with the subscription asked for, or
+// "" when nothing is.
+func checkWebhook(request communications.WebhookRequest) string {
+	u, err := url.Parse(request.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		return "url must be an absolute http or https url"
+	}
+	if len(request.Events) == 0 {
+		return "events must name an action, or * for all of them"
+	}
+	for _, event := range request.Events {
+		if event != webhook.AllEvents && !knownAction(event) {
+			return "unknown event " + strconv.Quote(event)
+		}
+	}
+	if request.Secret != "" && len(request.Secret) < minSecretLength {
+		return "secret must be at least 16 characters"
+	}
+	return ""
+}
+
+// knownAction reports whether the action is one recorded.
+func knownAction(action string) bool {
+	for _, known := range audit.Actions {
+		if action == known {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteWebhook godoc
+// @Summary Unsubscribe from security events
+// @Description Removes the subscription and the log of its deliveries.
+// @ID delete-webhook
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path string true "Subscription ID"
+// @Success 200 {object} communications.MessageResponse
+// @Failure 401,403,404,500 {object} communications.ErrorMessage
+// @Router /webhooks/{id} [delete]
+func (con *Controller) DeleteWebhook(c *gin.Context) {
+	sub, ok := con.findWebhook(c)
+	if !ok {
+		return
+	}
+	if err := con.Store.Webhooks.Delete(c.Request.Context(),
+		sub.ID); err != nil {
+		con.respondStoreError(c, "Unable to Delete Webhook", err)
+		return
+	}
+	logger(c).Info("webhook deleted", "event", "webhook_deleted",
+		"subscription_id", sub.ID)
+	con.record(c, audit.Event{Action: audit.ActionWebhookDeleted,
+		TargetID: sub.ID})
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Webhook deleted",
+	})
+}
+
+// WebhookDeliveries godoc
+// @Summary List the deliveries of a webhook
+// @Description Lists the attempts to deliver events to the subscription,
+// newest first.
+// @ID webhook-deliveries
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path string true "Subscription ID"
+// @Param limit query int false "most deliveries returned, up to 1000"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,401,403,404,500 {object} communications.ErrorMessage
+// @Router /webhooks/{id}/deliveries [get]
+func (con *Controller) WebhookDeliveries(c *gin.Context) {
+	limit := deliveryLimit
+	if text := c.Query("limit"); text != "" {
+		var err error
+		limit, err = strconv.Atoi(text)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			con.respondError(c, &communications.ErrorMessage{
+				ErrorType:  "request",
+				StatusCode: http.StatusBadRequest,
+				Message:    "limit must be between 1 and 1000",
+			})
+			return
+		}
+	}
+	sub, ok := con.findWebhook(c)
+	if !ok {
+		return
+	}
+	deliveries, err := con.Store.Webhooks.Deliveries(c.Request.Context(),
+		sub.ID, limit)
+	if err != nil {
+		con.respondStoreError(c, "Unable to Find Deliveries", err)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []webhook.Delivery{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"deliveries": deliveries,
+	})
+}
+
+// TestWebhook godoc
+// @Summary Send a sample event to a webhook
+// @Description Delivers a sample event, marked as a test and naming no
+// user, to the subscription once, and returns the delivery.  The event is
+// of the action given, or else the first the subscription wants.
+// @ID test-webhook
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path string true "Subscription ID"
+// @Param action query string false "action of the sample event"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,401,403,404,500 {object} communications.ErrorMessage
+// @Router /webhooks/{id}/test [post]
+func (con *Controller) TestWebhook(c *gin.Context) {
+	sub, ok := con.findWebhook(c)
+	if !ok {
+		return
+	}
+	action := c.Query("action")
+	if action == "" {
+		action = audit.ActionUserDeleted
+		actions := sub.Actions()
+		if len(actions) > 0 && actions[0] != webhook.AllEvents {
+			action = actions[0]
+		}
+	}
+	if !knownAction(action) {
+		con.respondError(c, &communications.ErrorMessage{
+			ErrorType:  "request",
+			StatusCode: http.StatusBadRequest,
+			Message:    "unknown action " + strconv.Quote(action),
+		})
+		return
+	}
+
+	delivery := con.Webhooks.Test(c.Request.Context(), *sub, audit.Event{
+		At:        time.Now().UTC(),
+		Action:    action,
+		Outcome:   audit.Success,
+		ActorID:   actor(c),
+		TargetID:  sampleTarget,
+		RequestID: c.Writer.Header().Get(logging.RequestIDHeader),
+	})
+	logger(c).Info("webhook tested", "event", "webhook_tested",
+		"subscription_id", sub.ID, "delivered", delivery.Delivered)
+	c.JSON(http.StatusOK, gin.H{
+		"delivery": delivery,
+	})
+}
+
+// findWebhook returns the subscription named by the id of the path, or
+// answers the request when it can't.
+func (con *Controller) findWebhook(c *gin.Context) (*webhook.Subscription,
+	bool) {
+	sub, err := con.Store.Webhooks.ByID(c.Request.Context(), c.Param("id"))
+	if isStoreError(err) {
+		con.respondStoreError(c, "Unable to Find Webhook", err)
+		return nil, false
+	}
+	if err != nil {
+		con.respondError(c, &communications.ErrorMessage{
+			ErrorType:  "webhook",
+			StatusCode: http.StatusNotFound,
+			Message:    "Webhook Not Found",
+		})
+		return nil, false
+	}
+	return sub, true
+}
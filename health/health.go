@@ -0,0 +1,122 @@
+// Package health checks the dependencies of the service, such as its
+// database and mail server, keeping the latency and last error of each for
+// the status page.
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Check returns an error when the dependency it checks can't be used.
+type Check func(ctx context.Context) error
+
+// State is the outcome of the latest check of a dependency.  Required
+// dependencies must be usable for the service to be ready.
+type State struct {
+	Name        string     `json:"name"`
+	Required    bool       `json:"required"`
+	OK          bool       `json:"ok"`
+	CheckedAt   time.Time  `json:"checkedAt"`
+	LatencyMS   float64    `json:"latencyMs"`
+	Error       string     `json:"error,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// Checker runs the checks of the dependencies, each with a timeout.
+type Checker struct {
+	timeout time.Duration
+	checks  []named
+
+	mu     sync.Mutex
+	states map[string]State
+}
+
+type named struct {
+	name     string
+	required bool
+	check    Check
+}
+
+// NewChecker returns a checker giving each check the timeout.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout, states: make(map[string]State)}
+}
+
+// Add adds the check of the named dependency, which is required for the
+// service to be ready when required is set.
+func (h *Checker) Add(name string, required bool, check Check) {
+	h.checks = append(h.checks, named{name: name, required: required,
+		check: check})
+}
+
+// Ready runs the checks of the required dependencies, returning their
+// states and whether they all passed.
+func (h *Checker) Ready(ctx context.Context) ([]State, bool) {
+	return h.run(ctx, true)
+}
+
+// Status runs every check, returning their states ordered by name and
+// whether the required ones passed.
+func (h *Checker) Status(ctx context.Context) ([]State, bool) {
+	return h.run(ctx, false)
+}
+
+// run runs the checks at once, only the required ones when asked.
+func (h *Checker) run(ctx context.Context, required bool) ([]State, bool) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var states []State
+	for _, n := range h.checks {
+		if required && !n.required {
+			continue
+		}
+		wg.Add(1)
+		go func(n named) {
+			defer wg.Done()
+			state := h.runOne(ctx, n)
+			mu.Lock()
+			states = append(states, state)
+			mu.Unlock()
+		}(n)
+	}
+	wg.Wait()
+
+	ok := true
+	for _, state := range states {
+		if state.Required && !state.OK {
+			ok = false
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states, ok
+}
+
+// runOne runs the check, recording its state with the last error seen.
+func (h *Checker) runOne(ctx context.Context, n named) State {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	start := time.Now()
+	err := n.check(ctx)
+	state := State{Name: n.name, Required: n.required, OK: err == nil,
+		CheckedAt: start,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	previous := h.states[n.name]
+	state.LastError, state.LastErrorAt = previous.LastError,
+		previous.LastErrorAt
+	if err != nil {
+		state.Error = err.Error()
+		state.LastError = state.Error
+		state.LastErrorAt = &start
+	}
+	h.states[n.name] = state
+	return state
+}
@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the id of a request.  The id a caller sends is
+// kept, so its records and the service's can be matched; otherwise one is
+// made up.  Either way it is returned in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// Middleware gives each request a logger holding its id and the client's
+// address, and records each request once answered: as an error for server
+// errors, a warning for client errors, and information otherwise.  Requests
+// are recorded by their route pattern rather than their path, so the
+// verification, approval and reset tokens in the paths of emailed links
+// aren't written to the logs.
+func Middleware(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = uuid.NewString()
+		}
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(WithLogger(c.Request.Context(),
+			logger.With("request_id", id, "client_ip", c.ClientIP())))
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		size := c.Writer.Size()
+		if size < 0 {
+			size = 0
+		}
+		ctx := c.Request.Context()
+		From(ctx).LogAttrs(ctx, level, "request answered",
+			slog.String("event", "request"),
+			slog.String("method", c.Request.Method),
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.Int("bytes", size),
+			slog.Float64("duration_ms",
+				float64(time.Since(start).Microseconds())/1000),
+			slog.String("user_agent", c.Request.UserAgent()))
+	}
+}
+
+// With adds the fields to the logger of the request, so the records
+// written for it from then on hold them.
+func With(c *gin.Context, args ...any) {
+	ctx := c.Request.Context()
+	c.Request = c.Request.WithContext(WithLogger(ctx, From(ctx).With(args...)))
+}
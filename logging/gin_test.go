@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMiddlewareLeavesOutTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var buffer bytes.Buffer
+	r := gin.New()
+	r.Use(Middleware(slog.New(slog.NewJSONHandler(&buffer, nil))))
+	r.GET("/api/v1/auth/verify/:token", func(c *gin.Context) {
+		c.Status(http.StatusBadRequest)
+	})
+
+	const token = "3f9a1c0e5b7d4e2a"
+	req := httptest.NewRequest(http.MethodGet,
+		"/api/v1/auth/verify/"+token+"?resettoken="+token, nil)
+	req.Header.Set(RequestIDHeader, "request-1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if strings.Contains(buffer.String(), token) {
+		t.Errorf("token logged: %s", buffer.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"msg":        "request answered",
+		"level":      "WARN",
+		"route":      "/api/v1/auth/verify/:token",
+		"request_id": "request-1",
+		"status":     float64(http.StatusBadRequest),
+	}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%s = %v, want %v", key, record[key], value)
+		}
+	}
+	if got := w.Header().Get(RequestIDHeader); got != "request-1" {
+		t.Errorf("request id %q returned, want request-1", got)
+	}
+}
@@ -0,0 +1,97 @@
+// Package logging writes the logs of the service as structured records,
+// each naming its event and holding the request id, client address and
+// user of the request it was written for, to stdout or to a file rotated
+// by size and age.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Formats the logs can be written in.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// FileName is the name of the log file in the log directory; rotated files
+// have the time of their rotation added to it.
+const FileName = "authserver.log"
+
+// Rotation holds when the log file is rotated and how long rotated files
+// are kept.
+type Rotation struct {
+	// MaxSize is the size in megabytes the file is rotated at.
+	MaxSize int
+	// MaxAge is the age at which rotated files are removed, rounded up to
+	// whole days; 0 keeps them whatever their age.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files kept; 0 keeps them all.
+	MaxBackups int
+}
+
+// Output returns where the logs are written: stdout when dir is empty, or
+// else the log file in dir, rotated and removed as given.
+func Output(dir string, rotation Rotation) io.WriteCloser {
+	if dir == "" {
+		return nopCloser{os.Stdout}
+	}
+	return &lumberjack.Logger{
+		Filename:   filepath.Join(dir, FileName),
+		MaxSize:    rotation.MaxSize,
+		MaxAge:     int(math.Ceil(rotation.MaxAge.Hours() / 24)),
+		MaxBackups: rotation.MaxBackups,
+		LocalTime:  true,
+	}
+}
+
+// New returns the logger writing records at the level named ("debug",
+// "info", "warn" or "error") and above to w, in the format named.
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+	options := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+type loggerKey struct{}
+
+// WithLogger returns the context carrying the logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// From returns the logger the context carries, or the default logger when
+// it carries none.
+func From(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// nopCloser keeps stdout open when the logs are closed.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
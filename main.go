@@ -1,15 +1,34 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"go-soapauth/audit"
+	"go-soapauth/cache"
+	"go-soapauth/config"
 	"go-soapauth/controller"
-	"log"
+	"go-soapauth/health"
+	"go-soapauth/logging"
+	"go-soapauth/metrics"
+	"go-soapauth/migrations"
+	"go-soapauth/server"
+	"go-soapauth/store"
+	"go-soapauth/templates"
+	"go-soapauth/tracing"
+	"go-soapauth/webhook"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/antonerne/go-soap/models"
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
@@ -33,27 +52,218 @@ import (
 // @name Authorization
 
 func main() {
-	err := godotenv.Load()
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfig(os.Args[2:]); err != nil {
+			fatal("configuration invalid", err)
+		}
+		return
+	}
+	command := config.CommandServe
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			command = config.CommandMigrate
+		case "audit":
+			command = config.CommandAudit
+		}
+	}
+	cfg, err := config.Load("", command)
 	if err != nil {
-		log.Fatal(err)
+		fatal("configuration invalid", err)
+	}
+	if command == config.CommandMigrate {
+		if err := runMigrate(cfg, os.Args[2:]); err != nil {
+			fatal("migration failed", err)
+		}
+		return
+	}
+	if command == config.CommandAudit {
+		if err := runAudit(cfg, os.Args[2:]); err != nil {
+			fatal("audit trail not verified", err)
+		}
+		return
 	}
-	r := gin.Default()
 
-	// create database connection as a pool.
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s",
-		os.Getenv("DBHOST"), os.Getenv("DBUSER"), os.Getenv("DBPASSWD"),
-		os.Getenv("DATABASE"), os.Getenv("DBPORT"))
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	// records are written as json lines to stdout, or to a rotated file in
+	// the log directory, and are the default for the libraries using slog.
+	logs := logging.Output(cfg.Log.Dir, cfg.Log.Rotation())
+	defer logs.Close()
+	logger, err := logging.New(logs, cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		fatal("logging not set up", err)
+	}
+	slog.SetDefault(logger)
+	logger.Info("configuration loaded", "event", "config", "config", cfg)
+	if cfg.SMTP.TLSVerify == config.SMTPInsecure {
+		logger.Warn("mail server certificate not verified", "event", "config")
+	}
+
+	// the log is closed only once everything else is, so failures are
+	// logged after what was opened is closed.
+	if err := runService(cfg, logger); err != nil {
+		msg := "service failed"
+		var f *failure
+		if errors.As(err, &f) {
+			msg, err = f.msg, f.err
+		}
+		logger.Error(msg, "error", err)
+		logs.Close()
+		os.Exit(1)
+	}
+	logger.Info("server shut down", "event", "shutdown")
+}
+
+// fatal logs the error which stops the service before it has opened
+// anything needing to be closed, and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// failure is an error stopping the service, with the message it is logged
+// with.
+type failure struct {
+	msg string
+	err error
+}
+
+func (f *failure) Error() string {
+	return f.msg + ": " + f.err.Error()
+}
+
+func (f *failure) Unwrap() error {
+	return f.err
+}
+
+// closeTimeout is the time given to close each of the connections of the
+// service once it has stopped.
+const closeTimeout = 10 * time.Second
+
+// closeLogged closes what was opened, within the close timeout, logging the
+// message when it fails.
+func closeLogged(logger *slog.Logger, msg string,
+	close func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	if err := close(ctx); err != nil {
+		logger.Error(msg, "event", "shutdown", "error", err)
+	}
+}
+
+// runService opens the store and cache, serves requests until told to stop
+// and drains them, returning the error which stopped it once everything it
+// opened is closed.
+func runService(cfg *config.Config, logger *slog.Logger) error {
+	// the service drains and shuts down on SIGTERM or SIGINT, stopping the
+	// background workers, which are waited for before the store and cache
+	// are closed.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM,
+		os.Interrupt)
+	defer stop()
+	var workers sync.WaitGroup
+	background := func(work func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			work()
+		}()
+	}
+
+	// spans are traced from the start of each request, so the deadline and
+	// key middleware derive their contexts from the request's span.
+	flushSpans, err := tracing.Setup(ctx, cfg.Tracing.Exporter,
+		cfg.Tracing.SampleRatio)
+	if err != nil {
+		return &failure{"tracing not set up", err}
+	}
+	defer closeLogged(logger, "spans not flushed", flushSpans)
+	// requests are logged once answered, panics included.
+	m := metrics.New()
+	r := gin.New()
+	r.Use(tracing.Middleware, logging.Middleware(logger), gin.Recovery(),
+		m.Middleware, controller.Deadline(cfg.Server.RequestTimeout),
+		controller.ReadKey)
+
+	st, db, err := openStore(cfg.Database, m)
+	if err != nil {
+		return &failure{"database not opened", err}
+	}
+	defer closeLogged(logger, "store not closed", st.Close)
+	tokenCache, err := openCache(cfg.Cache)
+	if err != nil {
+		return &failure{"cache not opened", err}
+	}
+	defer closeLogged(logger, "cache not closed",
+		func(context.Context) error { return tokenCache.Close() })
+	m.WatchCache(tokenCache)
+
+	// email and page templates are embedded, but can be replaced by files in
+	// the template directory, which is watched for changes in dev mode.
+	tmpls, err := templates.Load(cfg.Server.TemplateDir)
 	if err != nil {
-		log.Fatal(err)
+		return &failure{"templates not loaded", err}
 	}
+	// secrets read from files or the secret store are read again, so they
+	// can be rotated without a restart.
+	if cfg.SecretStore.Refresh > 0 {
+		background(func() {
+			cfg.Secrets().Watch(ctx, cfg.SecretStore.Refresh,
+				func(names []string) {
+					logger.Info("secrets refreshed",
+						"event", "secrets_refreshed", "names", names)
+				}, func(err error) {
+					logger.Error("secrets not refreshed",
+						"event", "secrets_refresh_failed", "error", err)
+				})
+		})
+	}
+	if cfg.Server.TemplateReload {
+		background(func() {
+			tmpls.Watch(2*time.Second, ctx.Done(), func(err error) {
+				logger.Error("templates not reloaded",
+					"event", "template_reload_failed", "error", err)
+			})
+		})
+	}
+
+	// the security events recorded are delivered to the webhook
+	// subscribers until the requests in flight at shutdown are done, and
+	// those still waiting are then given the shutdown timeout to be.
+	hooksCtx, stopHooks := context.WithCancel(context.Background())
+	hooks := webhook.NewDispatcher(st.Webhooks, cfg.Webhook.Options(), m)
+	background(func() { hooks.Run(hooksCtx) })
+	// the workers are stopped and waited for before the deferred closing of
+	// the cache and store, on every path out.
+	defer func() {
+		stop()
+		drainCtx, cancel := context.WithTimeout(context.Background(),
+			cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := hooks.Shutdown(drainCtx); err != nil {
+			logger.Error("webhook events not all delivered",
+				"event", "shutdown", "error", err)
+		}
+		stopHooks()
+		workers.Wait()
+	}()
 
-	accessLog := models.LogFile{Directory: os.Getenv("LOGLOCATION"), FileType: "Access"}
-	errorLog := models.LogFile{Directory: os.Getenv("LOGLOCATION"), FileType: "Error"}
-	control := controller.Controller{DB: db, AccessLog: &accessLog,
-		ErrorLog: &errorLog}
-	userControl := controller.UserController{DB: db, AccessLog: &accessLog,
-		ErrorLog: &errorLog}
+	control := controller.Controller{Store: st,
+		BaseURL: cfg.Server.PublicURL, Templates: tmpls, Mail: cfg.SMTP,
+		Cache: tokenCache, CacheTTL: cfg.Cache.TTL, Metrics: m,
+		Webhooks: hooks, AuditKey: audit.Key(cfg.Audit.Key)}
+	userControl := controller.UserController{Store: st,
+		BaseURL: cfg.Server.PublicURL, Templates: tmpls, Mail: cfg.SMTP,
+		Cache: tokenCache, CacheTTL: cfg.Cache.TTL, Metrics: m,
+		Webhooks: hooks, AuditKey: audit.Key(cfg.Audit.Key)}
+
+	ready := new(server.Readiness)
+	healthControl := controller.HealthController{Ready: ready,
+		Checker: healthChecks(cfg, st, db, tokenCache.Cache),
+		Cache:   tokenCache}
+	r.GET("/healthz", healthControl.Healthz)
+	r.GET("/readyz", healthControl.Readyz)
+	r.GET("/status", control.Authorize, healthControl.Status)
+	r.GET("/metrics", gin.WrapH(m.Handler()))
 
 	v1 := r.Group("/api/v1")
 	{
@@ -66,18 +276,293 @@ func main() {
 			auth.GET("remote/:token", control.ApproveRemote)
 			auth.PUT("password", control.ChangePassword)
 			auth.POST("forgot", control.ForgotPassword)
+			auth.GET("forgot/:token", control.ForgotPasswordForm)
 			auth.PUT("forgot", control.ForgotPasswordChange)
 		}
 
 		user := auth.Group("/users")
 		{
-			user.GET("/:id", models.AuthorizeJWT(db, &errorLog), userControl.GetUser)
+			user.GET("/:id", control.Authorize, userControl.GetUser)
+			user.GET("/:id/studies", control.Authorize,
+				userControl.GetStudies)
 			user.POST("/", userControl.AddUser)
-			user.PUT("/", models.AuthorizeJWT(db, &errorLog), userControl.UpdateUser)
-			user.DELETE("/:id", models.AuthorizeJWT(db, &errorLog),
+			user.PUT("/", control.Authorize, userControl.UpdateUser)
+			user.DELETE("/:id", control.Authorize,
 				userControl.DeleteUser)
 		}
+
+		v1.GET("/audit", control.Authorize, control.RequireEditor,
+			control.AuditEvents)
+
+		hooks := v1.Group("/webhooks", control.Authorize,
+			control.RequireEditor)
+		{
+			hooks.GET("", control.ListWebhooks)
+			hooks.POST("", control.AddWebhook)
+			hooks.DELETE("/:id", control.DeleteWebhook)
+			hooks.GET("/:id/deliveries", control.WebhookDeliveries)
+			hooks.POST("/:id/test", control.TestWebhook)
+		}
+	}
+
+	if err := serve(ctx, cfg.Server, r, ready, background,
+		logger); err != nil {
+		return &failure{"server failed", err}
+	}
+	return nil
+}
+
+// serve answers requests with the handler on the configured address, over
+// https when the server has a certificate, which is reloaded when renewed.
+// Plain http requests to the redirect port are sent to https.  The service
+// reports it is ready once its ports are bound.  When the context ends, it
+// reports it isn't ready, then stops taking requests and waits for those
+// in flight, returning once they are done or the shutdown timeout passes.
+func serve(ctx context.Context, cfg config.Server, handler http.Handler,
+	ready *server.Readiness, background func(func()),
+	logger *slog.Logger) error {
+	srv := &http.Server{Addr: cfg.Addr(), Handler: handler}
+	var redirect *http.Server
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	listen := func() error {
+		return srv.Serve(listener)
+	}
+	if cfg.TLS() {
+		cert, err := server.LoadCertificate(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return err
+		}
+		background(func() {
+			cert.Watch(time.Minute, ctx.Done(), func(err error) {
+				logger.Error("certificate not reloaded",
+					"event", "certificate_reload_failed", "error", err)
+			})
+		})
+		if srv.TLSConfig, err = server.TLSConfig(cert, cfg.TLSClientCA,
+			cfg.TLSClientAuth); err != nil {
+			return err
+		}
+		listen = func() error {
+			return srv.ServeTLS(listener, "", "")
+		}
+		if cfg.RedirectPort != 0 {
+			redirect = &http.Server{
+				Addr: net.JoinHostPort(cfg.Host,
+					strconv.Itoa(cfg.RedirectPort)),
+				Handler: server.Redirect(cfg.Port),
+			}
+		}
+	}
+
+	// the redirect is served alongside, its failure logged rather than
+	// stopping the service, and both are waited for before returning.
+	var servers sync.WaitGroup
+	defer servers.Wait()
+	if redirect != nil {
+		redirectListener, err := net.Listen("tcp", redirect.Addr)
+		if err != nil {
+			return err
+		}
+		defer redirect.Close()
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			err := redirect.Serve(redirectListener)
+			if err != nil && err != http.ErrServerClosed {
+				logger.Error("http redirect failed",
+					"event", "redirect_failed", "error", err)
+			}
+		}()
+	}
+	failed := make(chan error, 1)
+	servers.Add(1)
+	go func() {
+		defer servers.Done()
+		failed <- listen()
+	}()
+	ready.Set(true)
+	select {
+	case err := <-failed:
+		ready.Set(false)
+		return err
+	case <-ctx.Done():
+	}
+
+	ready.Set(false)
+	time.Sleep(cfg.ShutdownDelay)
+	drainCtx, cancel := context.WithTimeout(context.Background(),
+		cfg.ShutdownTimeout)
+	defer cancel()
+	if redirect != nil {
+		redirect.Shutdown(drainCtx)
+	}
+	return srv.Shutdown(drainCtx)
+}
+
+// openStore connects to the database used for the service's records,
+// returning the sql database as well unless it is a mongo database.
+// Postgres is used unless the driver asks for a sqlite file database or a
+// mongo database.  With AutoMigrate set, the sql migrations not yet applied
+// are applied first.  The connection pools of the databases are exposed to
+// the metrics given, when there are any.
+func openStore(cfg config.Database, m *metrics.Metrics) (*store.Store,
+	*gorm.DB, error) {
+	if cfg.Driver == store.DriverMongo {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			30*time.Second)
+		defer cancel()
+		db, err := store.ConnectMongo(ctx, cfg.MongoURI, cfg.Name,
+			m.MongoPool())
+		if err != nil {
+			return nil, nil, err
+		}
+		st, err := store.NewMongoStore(ctx, db)
+		if err != nil {
+			db.Client().Disconnect(ctx)
+			return nil, nil, err
+		}
+		return st, nil, nil
+	}
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	// what was opened is closed when a later step fails.
+	opened := []*gorm.DB{db}
+	fail := func(err error) (*store.Store, *gorm.DB, error) {
+		closeDatabases(opened)
+		return nil, nil, err
+	}
+	if cfg.AutoMigrate {
+		migrator, err := migrations.New(db)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err := migrator.Up(); err != nil {
+			return fail(err)
+		}
 	}
 
-	r.Run(":6001")
+	// reads are spread over the replicas, except for clients which wrote
+	// within the pin duration.
+	var replicas []*gorm.DB
+	for _, dsn := range cfg.Replicas {
+		replica, err := store.Open(cfg.Driver, dsn)
+		if err != nil {
+			return fail(err)
+		}
+		opened = append(opened, replica)
+		replicas = append(replicas, replica)
+	}
+	for i, pool := range opened {
+		name := "primary"
+		if i > 0 {
+			name = fmt.Sprintf("replica-%d", i-1)
+		}
+		if sqlDB, err := pool.DB(); err == nil {
+			m.WatchDB(name, sqlDB)
+		}
+	}
+	return store.NewReplicatedGormStore(db, replicas, cfg.ReplicaPin), db,
+		nil
+}
+
+// closeDatabases closes the connection pools of the databases.
+func closeDatabases(dbs []*gorm.DB) {
+	for _, db := range dbs {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}
+}
+
+// openDatabase connects to the sql database named by the driver.
+func openDatabase(cfg config.Database) (*gorm.DB, error) {
+	if cfg.Driver == store.DriverSQLite {
+		return store.Open(cfg.Driver, cfg.Path)
+	}
+
+	// create database connection as a pool.
+	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d",
+		cfg.Host, cfg.User, cfg.Password, cfg.Name, cfg.Port)
+	return store.Open(cfg.Driver, dsn)
+}
+
+// openCache returns the cache of token and role lookups, in memory unless
+// its url names a redis server, counting its hits and misses.
+func openCache(cfg config.Cache) (*cache.Metered, error) {
+	c, err := cache.Open(cfg.URL, cfg.Size)
+	if err != nil {
+		return nil, err
+	}
+	return cache.NewMetered(c), nil
+}
+
+// healthChecks returns the checks of the service's dependencies.  The
+// database, its migrations and the signing of tokens are required for the
+// service to be ready; the mail server and cache aren't.
+func healthChecks(cfg *config.Config, st *store.Store, db *gorm.DB,
+	c cache.Cache) *health.Checker {
+	checker := health.NewChecker(2 * time.Second)
+	checker.Add("database", true, st.Ping)
+	if db != nil {
+		checker.Add("migrations", true, func(ctx context.Context) error {
+			migrator, err := migrations.New(db.WithContext(ctx))
+			if err != nil {
+				return err
+			}
+			statuses, err := migrator.Status()
+			if err != nil {
+				return err
+			}
+			pending := 0
+			for _, status := range statuses {
+				if !status.Applied {
+					pending++
+				}
+			}
+			if pending > 0 {
+				return fmt.Errorf("%d migrations pending", pending)
+			}
+			return nil
+		})
+	}
+	checker.Add("signingkey", true, func(ctx context.Context) error {
+		if cfg.Secrets().Get("JWT_SECRET", cfg.Server.JWTSecret) == "" {
+			return errors.New("JWT_SECRET isn't set")
+		}
+		creds := new(models.Credentials)
+		signed, _, err := creds.CreateJWTToken("health", "health@localhost",
+			false, "")
+		if err != nil {
+			return err
+		}
+		token, err := creds.ValidateToken(signed)
+		if err != nil {
+			return err
+		}
+		if token == nil || !token.Valid {
+			return errors.New("signed token isn't valid")
+		}
+		return nil
+	})
+	checker.Add("smtp", false, func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(
+			cfg.SMTP.Server, strconv.Itoa(cfg.SMTP.Port)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+	checker.Add("cache", false, func(ctx context.Context) error {
+		_, _, err := c.Get(ctx, "health")
+		return err
+	})
+	return checker
 }
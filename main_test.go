@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"go-soapauth/config"
+	"go-soapauth/controller"
+	"go-soapauth/health"
+	"go-soapauth/metrics"
+	"go-soapauth/server"
+	"go-soapauth/store"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// get returns the status answered to a GET of the url, or 0 when it isn't
+// answered.
+func get(url string) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode
+}
+
+func TestServeDrains(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	cfg := config.Server{Host: "127.0.0.1", Port: port,
+		ShutdownDelay: 300 * time.Millisecond, ShutdownTimeout: 5 * time.Second}
+	base := "http://127.0.0.1:" + strconv.Itoa(port)
+
+	ready := new(server.Readiness)
+	healthControl := controller.HealthController{Ready: ready,
+		Checker: health.NewChecker(time.Second)}
+	r := gin.New()
+	r.GET("/readyz", healthControl.Readyz)
+	r.GET("/slow", func(c *gin.Context) {
+		time.Sleep(500 * time.Millisecond)
+		c.String(http.StatusOK, "done")
+	})
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, cfg, r, ready, func(work func()) { go work() },
+			slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+	for i := 0; get(base+"/readyz") != http.StatusOK; i++ {
+		if i == 100 {
+			t.Fatal("service never ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	slow := make(chan int, 1)
+	go func() { slow <- get(base + "/slow") }()
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	// while draining the service still answers, but isn't ready.
+	time.Sleep(50 * time.Millisecond)
+	if status := get(base + "/readyz"); status !=
+		http.StatusServiceUnavailable {
+		t.Errorf("readyz answered %d while draining, want %d", status,
+			http.StatusServiceUnavailable)
+	}
+	if status := <-slow; status != http.StatusOK {
+		t.Errorf("request in flight answered %d, want %d", status,
+			http.StatusOK)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve returned %v", err)
+		}
+	case <-time.After(cfg.ShutdownTimeout):
+		t.Fatal("serve didn't return once drained")
+	}
+	if status := get(base + "/readyz"); status != 0 {
+		t.Errorf("readyz answered %d once shut down", status)
+	}
+}
+
+func TestServeNotReadyWhenPortTaken(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	cfg := config.Server{Host: "127.0.0.1",
+		Port:            listener.Addr().(*net.TCPAddr).Port,
+		ShutdownTimeout: time.Second}
+
+	ready := new(server.Readiness)
+	err = serve(context.Background(), cfg, gin.New(), ready,
+		func(work func()) { go work() },
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err == nil {
+		t.Fatal("serve on a port in use returned nil")
+	}
+	if ready.Ready() {
+		t.Error("ready although the port wasn't bound")
+	}
+}
+
+func TestOpenStoreWatchesPools(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Database{Driver: store.DriverSQLite,
+		Path:     filepath.Join(dir, "primary.db"),
+		Replicas: []string{filepath.Join(dir, "replica.db")}}
+	m := metrics.New()
+	st, _, err := openStore(cfg, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close(context.Background())
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics",
+		nil))
+	for _, name := range []string{"primary", "replica-0"} {
+		want := `go_sql_open_connections{db_name="` + name + `"}`
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("pool of %s not exposed", name)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Package metrics counts the requests and authentication outcomes of the
+// service, exposed to Prometheus at /metrics.
+package metrics
+
+import (
+	"database/sql"
+	"go-soapauth/cache"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// namespace prefixes the names of the service's metrics.
+const namespace = "authserver"
+
+// Reasons a login failed.
+const (
+	ReasonBadPassword = "bad_password"
+	ReasonUnverified  = "unverified"
+	ReasonNewRemote   = "new_remote"
+	ReasonLocked      = "locked"
+	ReasonUnknownUser = "unknown_user"
+)
+
+// Token events.
+const (
+	TokenIssued    = "issued"
+	TokenRefreshed = "refreshed"
+	TokenRevoked   = "revoked"
+)
+
+// Results of a webhook delivery.  Dropped events were never attempted,
+// and abandoned ones failed every attempt.
+const (
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+	WebhookAbandoned = "abandoned"
+	WebhookDropped   = "dropped"
+)
+
+// Metrics holds the collectors of the service, registered with its own
+// registry along with the process and Go runtime collectors.  A nil
+// Metrics counts nothing, so controllers can be used without it.
+type Metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	logins   *prometheus.CounterVec
+	tokens   *prometheus.CounterVec
+	emails   *prometheus.CounterVec
+	webhooks *prometheus.CounterVec
+}
+
+// New returns the metrics of the service.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Requests answered, by method, route and status.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to answer requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "logins_total",
+			Help:      "Login attempts, by outcome and reason of failure.",
+		}, []string{"outcome", "reason"}),
+		tokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tokens_total",
+			Help:      "Tokens issued, refreshed and revoked.",
+		}, []string{"event"}),
+		emails: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "emails_total",
+			Help:      "Emails sent and failed, by kind.",
+		}, []string{"kind", "result"}),
+		webhooks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_deliveries_total",
+			Help:      "Webhook delivery attempts and events, by result.",
+		}, []string{"result"}),
+	}
+	m.registry.MustRegister(m.requests, m.duration, m.logins, m.tokens,
+		m.emails, m.webhooks, collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware counts and times the requests, by their route pattern rather
+// than their path so ids don't make a series each.
+func (m *Metrics) Middleware(c *gin.Context) {
+	if m == nil {
+		c.Next()
+		return
+	}
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	status := strconv.Itoa(c.Writer.Status())
+	m.requests.WithLabelValues(c.Request.Method, route, status).Inc()
+	m.duration.WithLabelValues(c.Request.Method, route, status).
+		Observe(time.Since(start).Seconds())
+}
+
+// Login counts a successful login, or a failed one with its reason when
+// the reason isn't empty.
+func (m *Metrics) Login(reason string) {
+	if m == nil {
+		return
+	}
+	if reason == "" {
+		m.logins.WithLabelValues("success", "").Inc()
+		return
+	}
+	m.logins.WithLabelValues("failure", reason).Inc()
+}
+
+// Token counts a token event.
+func (m *Metrics) Token(event string) {
+	if m == nil {
+		return
+	}
+	m.tokens.WithLabelValues(event).Inc()
+}
+
+// Email counts an email of the kind given, as failed when err isn't nil.
+func (m *Metrics) Email(kind string, err error) {
+	if m == nil {
+		return
+	}
+	result := "sent"
+	if err != nil {
+		result = "failed"
+	}
+	m.emails.WithLabelValues(kind, result).Inc()
+}
+
+// Webhook counts a webhook delivery attempt, or an event, with its result.
+func (m *Metrics) Webhook(result string) {
+	if m == nil {
+		return
+	}
+	m.webhooks.WithLabelValues(result).Inc()
+}
+
+// WatchDB exposes the connection pool statistics of the database, labelled
+// with its name.
+func (m *Metrics) WatchDB(name string, db *sql.DB) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// MongoPool returns the monitor of the connection pools of a mongo client,
+// exposing the connections open and in use, by server address, and the
+// connections which couldn't be checked out.
+func (m *Metrics) MongoPool() *event.PoolMonitor {
+	if m == nil {
+		return nil
+	}
+	open := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mongo_pool_open_connections",
+		Help:      "Connections open to each mongo server.",
+	}, []string{"address"})
+	inUse := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mongo_pool_in_use_connections",
+		Help:      "Connections to each mongo server checked out.",
+	}, []string{"address"})
+	failed := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mongo_pool_checkout_failures_total",
+		Help:      "Connections to each mongo server not checked out.",
+	}, []string{"address"})
+	m.registry.MustRegister(open, inUse, failed)
+	return &event.PoolMonitor{Event: func(e *event.PoolEvent) {
+		switch e.Type {
+		case event.ConnectionCreated:
+			open.WithLabelValues(e.Address).Inc()
+		case event.ConnectionClosed:
+			open.WithLabelValues(e.Address).Dec()
+		case event.GetSucceeded:
+			inUse.WithLabelValues(e.Address).Inc()
+		case event.ConnectionReturned:
+			inUse.WithLabelValues(e.Address).Dec()
+		case event.GetFailed:
+			failed.WithLabelValues(e.Address).Inc()
+		}
+	}}
+}
+
+// WatchCache exposes the hits and misses of the cache.
+func (m *Metrics) WatchCache(c *cache.Metered) {
+	m.registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_hits_total",
+			Help:      "Cache lookups which found their key.",
+		}, func() float64 {
+			return float64(c.Stats().Hits)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_misses_total",
+			Help:      "Cache lookups which didn't find their key.",
+		}, func() float64 {
+			return float64(c.Stats().Misses)
+		}))
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// noDatabase connects to nothing, which is enough for the statistics of
+// a pool.
+type noDatabase struct{}
+
+func (noDatabase) Connect(context.Context) (driver.Conn, error) {
+	return nil, errors.New("no database")
+}
+
+func (d noDatabase) Driver() driver.Driver { return d }
+
+func (noDatabase) Open(string) (driver.Conn, error) {
+	return nil, errors.New("no database")
+}
+
+// scrape returns the metrics as the Prometheus text format.
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestWatchDB(t *testing.T) {
+	m := New()
+	for _, name := range []string{"primary", "replica-0"} {
+		db := sql.OpenDB(noDatabase{})
+		defer db.Close()
+		m.WatchDB(name, db)
+	}
+	body := scrape(t, m)
+	for _, want := range []string{
+		`go_sql_open_connections{db_name="primary"}`,
+		`go_sql_open_connections{db_name="replica-0"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("%s not exposed", want)
+		}
+	}
+}
+
+func TestMongoPool(t *testing.T) {
+	m := New()
+	monitor := m.MongoPool()
+	const address = "mongo-0:27017"
+	for _, kind := range []string{event.ConnectionCreated,
+		event.ConnectionCreated, event.GetSucceeded, event.GetSucceeded,
+		event.ConnectionReturned, event.GetFailed, event.ConnectionClosed} {
+		monitor.Event(&event.PoolEvent{Type: kind, Address: address})
+	}
+	body := scrape(t, m)
+	for _, want := range []string{
+		`authserver_mongo_pool_open_connections{address="mongo-0:27017"} 1`,
+		`authserver_mongo_pool_in_use_connections{address="mongo-0:27017"} 1`,
+		`authserver_mongo_pool_checkout_failures_total{address="mongo-0:27017"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("%s not exposed", want)
+		}
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	if m.MongoPool() != nil {
+		t.Error("nil metrics returned a pool monitor")
+	}
+	m.WatchDB("primary", nil)
+}
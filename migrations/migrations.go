@@ -0,0 +1,251 @@
+// Package migrations creates and evolves the tables of the sql databases
+// used by the service.  Each migration is a pair of sql files, named
+// "<version>_<name>.up.sql" and "<version>_<name>.down.sql", kept for each
+// database dialect and embedded in the binary.  The versions applied are
+// recorded in the schemamigrations table.  The first migrations create the
+// tables of the go-soap models and the user preferences only when they
+// aren't there, so existing databases are brought under the migrations
+// by applying them.
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var embedded embed.FS
+
+// lockID identifies the postgres advisory lock held while migrating, so
+// replicas starting together apply the migrations once.
+const lockID = 2021101800
+
+// Migration is a change to the database schema, with the sql applying and
+// reverting it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a migration with when it was applied, if it has been.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// applied is a row of the migration table.
+type applied struct {
+	Version   int       `gorm:"column:version;primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"column:name"`
+	AppliedAt time.Time `gorm:"column:appliedat"`
+}
+
+func (applied) TableName() string {
+	return "schemamigrations"
+}
+
+// Migrator applies and reverts the migrations of a database.
+type Migrator struct {
+	db         *gorm.DB
+	dialect    string
+	migrations []Migration
+}
+
+// New returns a migrator for the database, using the migrations of its
+// dialect.
+func New(db *gorm.DB) (*Migrator, error) {
+	dialect := db.Dialector.Name()
+	migrations, err := load(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+// Up applies every migration not yet applied, in order, and returns the
+// number applied.
+func (m *Migrator) Up() (int, error) {
+	count := 0
+	err := m.locked(func(db *gorm.DB) error {
+		done, err := m.applied(db)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Exec(migration.Up).Error; err != nil {
+					return err
+				}
+				return tx.Create(&applied{Version: migration.Version,
+					Name: migration.Name, AppliedAt: time.Now().UTC()}).Error
+			})
+			if err != nil {
+				return &Error{Migration: migration, Err: err}
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Down reverts the latest migration applied, returning it, or nil when no
+// migration has been applied.
+func (m *Migrator) Down() (*Migration, error) {
+	var reverted *Migration
+	err := m.locked(func(db *gorm.DB) error {
+		done, err := m.applied(db)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := done[migration.Version]; !ok {
+				continue
+			}
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Exec(migration.Down).Error; err != nil {
+					return err
+				}
+				return tx.Delete(&applied{Version: migration.Version}).Error
+			})
+			if err != nil {
+				return &Error{Migration: migration, Err: err}
+			}
+			reverted = &migration
+			return nil
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status returns every migration, noting which have been applied.
+func (m *Migrator) Status() ([]Status, error) {
+	done := make(map[int]applied)
+	if m.db.Migrator().HasTable(&applied{}) {
+		var err error
+		if done, err = m.applied(m.db); err != nil {
+			return nil, err
+		}
+	}
+	statuses := make([]Status, len(m.migrations))
+	for i, migration := range m.migrations {
+		statuses[i].Migration = migration
+		if row, ok := done[migration.Version]; ok {
+			statuses[i].Applied = true
+			statuses[i].AppliedAt = row.AppliedAt
+		}
+	}
+	return statuses, nil
+}
+
+// locked calls fn with a connection holding the migration lock, after
+// creating the migration table.  Postgres uses an advisory lock, held by the
+// connection; sqlite allows a single writer, so needs none.
+func (m *Migrator) locked(fn func(db *gorm.DB) error) error {
+	return m.db.Connection(func(db *gorm.DB) error {
+		if m.dialect == "postgres" {
+			if err := db.Exec("SELECT pg_advisory_lock(?)",
+				lockID).Error; err != nil {
+				return err
+			}
+			defer db.Exec("SELECT pg_advisory_unlock(?)", lockID)
+		}
+		if err := db.AutoMigrate(&applied{}); err != nil {
+			return err
+		}
+		return fn(db)
+	})
+}
+
+// applied returns the rows of the migration table by version.
+func (m *Migrator) applied(db *gorm.DB) (map[int]applied, error) {
+	var rows []applied
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	done := make(map[int]applied, len(rows))
+	for _, row := range rows {
+		done[row.Version] = row
+	}
+	return done, nil
+}
+
+// load reads the migrations of the dialect, ordered by version.
+func load(dialect string) ([]Migration, error) {
+	entries, err := fs.ReadDir(embedded, dialect)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s databases", dialect)
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		base := strings.TrimSuffix(name, ".sql")
+		direction := path.Ext(base)
+		base = strings.TrimSuffix(base, direction)
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 ||
+			(direction != ".up" && direction != ".down") {
+			return nil, fmt.Errorf("migration %s/%s: bad file name", dialect,
+				name)
+		}
+		data, err := embedded.ReadFile(path.Join(dialect, name))
+		if err != nil {
+			return nil, err
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = migration
+		}
+		if direction == ".up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %s/%04d_%s: missing up or down",
+				dialect, migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Error is returned when a migration fails to apply or revert.
+type Error struct {
+	Migration Migration
+	Err       error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("migration %04d_%s: %s", e.Migration.Version,
+		e.Migration.Name, e.Err.Error())
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
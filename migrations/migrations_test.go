@@ -0,0 +1,162 @@
+package migrations
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// goSoapSchema is the schema of a database the go-soap services created,
+// before the migrations, holding a user.
+var goSoapSchema = []string{
+	`CREATE TABLE users (id TEXT PRIMARY KEY, email TEXT NOT NULL UNIQUE,
+		editor NUMERIC NOT NULL DEFAULT 0)`,
+	`CREATE TABLE usernames (userid TEXT PRIMARY KEY, first TEXT, middle TEXT,
+		last TEXT, suffix TEXT)`,
+	`CREATE TABLE credentials (userid TEXT PRIMARY KEY, password TEXT,
+		expires DATETIME, mustchange NUMERIC, verified NUMERIC,
+		verificationtoken TEXT, badattempts INTEGER, locked NUMERIC,
+		newremotetoken TEXT, resettoken TEXT, resetexpires DATETIME)`,
+	`CREATE TABLE userremotes (id INTEGER PRIMARY KEY AUTOINCREMENT,
+		credentialsuserid TEXT, remoteip TEXT)`,
+	`CREATE TABLE tokens (id TEXT PRIMARY KEY, userid TEXT,
+		expires DATETIME)`,
+	`CREATE TABLE userbiblestudies (id INTEGER PRIMARY KEY AUTOINCREMENT,
+		userid TEXT, startdate DATETIME, enddate DATETIME)`,
+	`CREATE TABLE studyperiods (id INTEGER PRIMARY KEY AUTOINCREMENT,
+		studyid INTEGER)`,
+	`CREATE TABLE studydays (id INTEGER PRIMARY KEY AUTOINCREMENT,
+		periodid INTEGER)`,
+	`CREATE TABLE studyreferences (id INTEGER PRIMARY KEY AUTOINCREMENT,
+		dayid INTEGER)`,
+	`CREATE TABLE userpreferences (userid TEXT PRIMARY KEY, locale TEXT,
+		brand TEXT)`,
+	`CREATE INDEX idx_tokens_userid ON tokens (userid)`,
+	`INSERT INTO users (id, email) VALUES ('user-1', 'user@example.com')`,
+}
+
+// newDB returns a sqlite database in a file of its own.
+func newDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")+
+		"?_pragma=foreign_keys(1)"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// pending returns the number of migrations not applied.
+func pending(t *testing.T, m *Migrator) int {
+	t.Helper()
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, status := range statuses {
+		if !status.Applied {
+			n++
+		}
+	}
+	return n
+}
+
+func TestUpDownStatus(t *testing.T) {
+	m, err := New(newDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := len(m.migrations)
+	if got := pending(t, m); got != total {
+		t.Errorf("%d migrations pending on an empty database, want %d", got,
+			total)
+	}
+
+	count, err := m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != total || pending(t, m) != 0 {
+		t.Fatalf("%d migrations applied, want %d", count, total)
+	}
+	if count, err := m.Up(); err != nil || count != 0 {
+		t.Errorf("Up again applied %d, %v; want none", count, err)
+	}
+
+	last := m.migrations[total-1]
+	reverted, err := m.Down()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted == nil || reverted.Version != last.Version {
+		t.Fatalf("Down reverted %v, want %04d", reverted, last.Version)
+	}
+	if got := pending(t, m); got != 1 {
+		t.Errorf("%d migrations pending after Down, want 1", got)
+	}
+	if count, err := m.Up(); err != nil || count != 1 {
+		t.Errorf("Up after Down applied %d, %v; want 1", count, err)
+	}
+
+	for i := 0; i < total; i++ {
+		if _, err := m.Down(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reverted, err := m.Down(); err != nil || reverted != nil {
+		t.Errorf("Down with none applied reverted %v, %v", reverted, err)
+	}
+	if got := pending(t, m); got != total {
+		t.Errorf("%d migrations pending after reverting them all, want %d",
+			got, total)
+	}
+	if m.db.Migrator().HasTable("users") {
+		t.Error("users table left after reverting every migration")
+	}
+}
+
+func TestUpAdoptsExistingSchema(t *testing.T) {
+	db := newDB(t)
+	for _, sql := range goSoapSchema {
+		if err := db.Exec(sql).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(m.migrations) || pending(t, m) != 0 {
+		t.Errorf("%d migrations applied, want %d", count, len(m.migrations))
+	}
+	var email string
+	if err := db.Raw("SELECT email FROM users WHERE id = ?",
+		"user-1").Scan(&email).Error; err != nil {
+		t.Fatal(err)
+	}
+	if email != "user@example.com" {
+		t.Errorf("existing user's email %q, want it kept", email)
+	}
+	for _, table := range []string{"audit_events", "webhooks"} {
+		if !db.Migrator().HasTable(table) {
+			t.Errorf("%s table not created", table)
+		}
+	}
+
+	if reverted, err := m.Down(); err != nil || reverted == nil {
+		t.Errorf("Down reverted %v, %v", reverted, err)
+	}
+}
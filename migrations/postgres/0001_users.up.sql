@@ -0,0 +1,48 @@
+-- users and their names, credentials, approved remotes and tokens, with the
+-- columns of the go-soap models.  Tables and indexes already there are
+-- kept, so databases the go-soap services created are adopted.
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	email TEXT NOT NULL UNIQUE,
+	editor BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS usernames (
+	userid TEXT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	first TEXT NOT NULL DEFAULT '',
+	middle TEXT NOT NULL DEFAULT '',
+	last TEXT NOT NULL DEFAULT '',
+	suffix TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS credentials (
+	userid TEXT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	password TEXT NOT NULL DEFAULT '',
+	expires TIMESTAMP WITH TIME ZONE,
+	mustchange BOOLEAN NOT NULL DEFAULT FALSE,
+	verified BOOLEAN NOT NULL DEFAULT FALSE,
+	verificationtoken TEXT NOT NULL DEFAULT '',
+	badattempts INTEGER NOT NULL DEFAULT 0,
+	locked BOOLEAN NOT NULL DEFAULT FALSE,
+	newremotetoken TEXT NOT NULL DEFAULT '',
+	resettoken TEXT NOT NULL DEFAULT '',
+	resetexpires TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS credentials_verificationtoken ON credentials (verificationtoken);
+CREATE INDEX IF NOT EXISTS credentials_newremotetoken ON credentials (newremotetoken);
+CREATE INDEX IF NOT EXISTS credentials_resettoken ON credentials (resettoken);
+
+CREATE TABLE IF NOT EXISTS userremotes (
+	id SERIAL PRIMARY KEY,
+	credentialsuserid TEXT NOT NULL
+		REFERENCES credentials (userid) ON DELETE CASCADE,
+	remoteip TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS userremotes_credentialsuserid ON userremotes (credentialsuserid);
+
+CREATE TABLE IF NOT EXISTS tokens (
+	id TEXT PRIMARY KEY,
+	userid TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	expires TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS tokens_userid ON tokens (userid);
@@ -0,0 +1,4 @@
+DROP TABLE studyreferences;
+DROP TABLE studydays;
+DROP TABLE studyperiods;
+DROP TABLE userbiblestudies;
@@ -0,0 +1,27 @@
+-- the bible studies of users, loaded with the user.
+CREATE TABLE IF NOT EXISTS userbiblestudies (
+	id SERIAL PRIMARY KEY,
+	userid TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	startdate TIMESTAMP WITH TIME ZONE NOT NULL,
+	enddate TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX IF NOT EXISTS userbiblestudies_userid ON userbiblestudies (userid);
+
+CREATE TABLE IF NOT EXISTS studyperiods (
+	id SERIAL PRIMARY KEY,
+	studyid INTEGER NOT NULL
+		REFERENCES userbiblestudies (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS studyperiods_studyid ON studyperiods (studyid);
+
+CREATE TABLE IF NOT EXISTS studydays (
+	id SERIAL PRIMARY KEY,
+	periodid INTEGER NOT NULL REFERENCES studyperiods (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS studydays_periodid ON studydays (periodid);
+
+CREATE TABLE IF NOT EXISTS studyreferences (
+	id SERIAL PRIMARY KEY,
+	dayid INTEGER NOT NULL REFERENCES studydays (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS studyreferences_dayid ON studyreferences (dayid);
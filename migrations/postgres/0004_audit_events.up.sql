@@ -0,0 +1,19 @@
+-- the trail of security events, each holding the hash of the one before
+-- it.  Events outlive the users they name, so the ids aren't references.
+CREATE TABLE audit_events (
+	seq BIGINT PRIMARY KEY,
+	at TIMESTAMP WITH TIME ZONE NOT NULL,
+	action TEXT NOT NULL,
+	outcome TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	actorid TEXT NOT NULL DEFAULT '',
+	targetid TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	useragent TEXT NOT NULL DEFAULT '',
+	requestid TEXT NOT NULL DEFAULT '',
+	prevhash TEXT NOT NULL,
+	hash TEXT NOT NULL
+);
+CREATE INDEX audit_events_at ON audit_events (at);
+CREATE INDEX audit_events_actorid ON audit_events (actorid);
+CREATE INDEX audit_events_targetid ON audit_events (targetid);
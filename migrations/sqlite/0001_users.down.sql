@@ -0,0 +1,5 @@
+DROP TABLE tokens;
+DROP TABLE userremotes;
+DROP TABLE credentials;
+DROP TABLE usernames;
+DROP TABLE users;
@@ -0,0 +1,27 @@
+-- the bible studies of users, loaded with the user.
+CREATE TABLE IF NOT EXISTS userbiblestudies (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	userid TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	startdate DATETIME NOT NULL,
+	enddate DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS userbiblestudies_userid ON userbiblestudies (userid);
+
+CREATE TABLE IF NOT EXISTS studyperiods (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	studyid INTEGER NOT NULL
+		REFERENCES userbiblestudies (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS studyperiods_studyid ON studyperiods (studyid);
+
+CREATE TABLE IF NOT EXISTS studydays (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	periodid INTEGER NOT NULL REFERENCES studyperiods (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS studydays_periodid ON studydays (periodid);
+
+CREATE TABLE IF NOT EXISTS studyreferences (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	dayid INTEGER NOT NULL REFERENCES studydays (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS studyreferences_dayid ON studyreferences (dayid);
@@ -0,0 +1,6 @@
+-- the service's own preferences for each user.
+CREATE TABLE IF NOT EXISTS userpreferences (
+	userid TEXT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	locale TEXT NOT NULL DEFAULT '',
+	brand TEXT NOT NULL DEFAULT ''
+);
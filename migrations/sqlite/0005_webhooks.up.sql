@@ -0,0 +1,24 @@
+-- the subscriptions of other services to the security events, and the log
+-- of every attempt to deliver an event to them.
+CREATE TABLE webhooks (
+	id TEXT PRIMARY KEY,
+	url TEXT NOT NULL,
+	events TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	created DATETIME NOT NULL
+);
+CREATE TABLE webhook_deliveries (
+	id TEXT PRIMARY KEY,
+	subscriptionid TEXT NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+	payloadid TEXT NOT NULL,
+	action TEXT NOT NULL,
+	test BOOLEAN NOT NULL DEFAULT 0,
+	attempt INTEGER NOT NULL,
+	at DATETIME NOT NULL,
+	statuscode INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	durationms INTEGER NOT NULL DEFAULT 0,
+	delivered BOOLEAN NOT NULL DEFAULT 0
+);
+CREATE INDEX webhook_deliveries_subscriptionid
+	ON webhook_deliveries (subscriptionid, at);
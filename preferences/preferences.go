@@ -0,0 +1,16 @@
+// Package preferences holds the per user settings kept by the authentication
+// service, which aren't part of the shared user model.
+package preferences
+
+// UserPreference holds a user's settings, such as the locale their emails
+// and messages are written in and the brand of product they signed up for.
+type UserPreference struct {
+	UserID string `gorm:"column:userid;primaryKey" json:"userid"`
+	Locale string `gorm:"column:locale" json:"locale"`
+	Brand  string `gorm:"column:brand" json:"brand"`
+}
+
+// TableName gives the table the preferences are kept in.
+func (UserPreference) TableName() string {
+	return "userpreferences"
+}
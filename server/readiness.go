@@ -0,0 +1,24 @@
+package server
+
+import "sync/atomic"
+
+// Readiness reports whether the service should be sent new requests.  It
+// is set once the service has started, and cleared when it begins to
+// drain so load balancers stop sending it requests.
+type Readiness struct {
+	ready int32
+}
+
+// Set marks the service as ready or not.
+func (r *Readiness) Set(ready bool) {
+	var value int32
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&r.ready, value)
+}
+
+// Ready reports whether the service is ready.
+func (r *Readiness) Ready() bool {
+	return atomic.LoadInt32(&r.ready) == 1
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Redirect returns the handler sending plain http requests to the same url
+// over https, served on the port given.
+func Redirect(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		// the default port is left out, but ipv6 hosts keep their brackets.
+		host = strings.TrimSuffix(net.JoinHostPort(host,
+			strconv.Itoa(httpsPort)), ":443")
+		target := "https://" + host + r.URL.RequestURI()
+		// permanent redirects keep the method and body of other requests.
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target, status)
+	})
+}
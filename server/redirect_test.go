@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		port   int
+		want   string
+		status int
+	}{
+		{name: "default port", host: "auth.example.com", port: 443,
+			want: "https://auth.example.com/api/v1/auth?x=1"},
+		{name: "plain port dropped", host: "auth.example.com:80", port: 443,
+			want: "https://auth.example.com/api/v1/auth?x=1"},
+		{name: "other port", host: "auth.example.com:8080", port: 8443,
+			want: "https://auth.example.com:8443/api/v1/auth?x=1"},
+		{name: "ipv6 default port", host: "[::1]:80", port: 443,
+			want: "https://[::1]/api/v1/auth?x=1"},
+		{name: "ipv6 other port", host: "[::1]:8080", port: 8443,
+			want: "https://[::1]:8443/api/v1/auth?x=1"},
+		{name: "ipv6 without port", host: "[2001:db8::1]", port: 443,
+			want: "https://[2001:db8::1]/api/v1/auth?x=1"},
+		{name: "post keeps its method", method: http.MethodPost,
+			host: "auth.example.com", port: 443,
+			want:   "https://auth.example.com/api/v1/auth?x=1",
+			status: http.StatusPermanentRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, status := tt.method, tt.status
+			if method == "" {
+				method, status = http.MethodGet, http.StatusMovedPermanently
+			}
+			req := httptest.NewRequest(method, "/api/v1/auth?x=1", nil)
+			req.Host = tt.host
+			w := httptest.NewRecorder()
+			Redirect(tt.port).ServeHTTP(w, req)
+			if w.Code != status {
+				t.Errorf("status %d, want %d", w.Code, status)
+			}
+			if got := w.Header().Get("Location"); got != tt.want {
+				t.Errorf("redirected to %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+// Package server holds what the http server of the service needs besides
+// its routes: certificates reloaded when renewed, client certificate
+// checks, and the redirect of plain http requests to https.
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client authentication modes: a client certificate is verified when one
+// is given, or is required.
+const (
+	ClientAuthVerify  = "verify"
+	ClientAuthRequire = "require"
+)
+
+// Certificate is the server's certificate, read again from its files when
+// they change so a renewed certificate is used without a restart.
+type Certificate struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+// LoadCertificate reads the certificate and its key from the PEM files.
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the certificate and key again.  The previous certificate
+// stays in use when they can't be read.
+func (c *Certificate) Reload() error {
+	modified := c.lastModified()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.modified = modified
+	return nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate,
+	error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Watch checks the certificate and key files for changes every interval
+// and reloads them when one is found, until stop is closed.  Reload errors
+// are passed to onError and the previous certificate stays in use.
+func (c *Certificate) Watch(interval time.Duration, stop <-chan struct{},
+	onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.mu.RLock()
+			last := c.modified
+			c.mu.RUnlock()
+			if c.lastModified().Equal(last) {
+				continue
+			}
+			if err := c.Reload(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// lastModified returns the latest modification time of the files.
+func (c *Certificate) lastModified() time.Time {
+	var latest time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(file); err == nil &&
+			info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// TLSConfig returns the tls settings of a server presenting the
+// certificate.  With a client CA file, client certificates signed by its
+// CAs are verified, and required when clientAuth is ClientAuthRequire.
+func TLSConfig(cert *Certificate, clientCAFile,
+	clientAuth string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cert.GetCertificate,
+	}
+	if clientCAFile == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates found", clientCAFile)
+	}
+	config.ClientCAs = pool
+	switch clientAuth {
+	case ClientAuthVerify:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.New("unknown client authentication " + clientAuth)
+	}
+	return config, nil
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for the name, and its
+// key, to the files, returning the certificate.
+func writeCertificate(t *testing.T, certFile, keyFile, name string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return der
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// touch moves the modification time of the files forward, so a change is
+// seen however coarse the file system's clock.
+func touch(t *testing.T, later time.Duration, files ...string) {
+	t.Helper()
+	at := time.Now().Add(later)
+	for _, file := range files {
+		if err := os.Chtimes(file, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// served returns the certificate the server presents.
+func served(t *testing.T, c *Certificate) []byte {
+	t.Helper()
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Certificate[0]
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	first := writeCertificate(t, certFile, keyFile, "first.example.com")
+	c, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(served(t, c), first) {
+		t.Fatal("loaded certificate not served")
+	}
+
+	second := writeCertificate(t, certFile, keyFile, "second.example.com")
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(served(t, c), second) {
+		t.Error("reloaded certificate not served")
+	}
+
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reload(); err == nil {
+		t.Error("reload of a broken key returned nil")
+	}
+	if !bytes.Equal(served(t, c), second) {
+		t.Error("previous certificate not kept when the reload failed")
+	}
+
+	if _, err := LoadCertificate(filepath.Join(dir, "missing.pem"),
+		keyFile); err == nil {
+		t.Error("load of a missing certificate returned nil")
+	}
+}
+
+func TestCertificateWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, "first.example.com")
+	c, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var errs []error
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		c.Watch(5*time.Millisecond, stop, func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		})
+	}()
+	defer func() {
+		close(stop)
+		<-watched
+	}()
+
+	// waitFor waits until the condition holds.
+	waitFor := func(what string, condition func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not seen", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	renewed := writeCertificate(t, certFile, keyFile, "renewed.example.com")
+	touch(t, time.Minute, certFile, keyFile)
+	waitFor("renewed certificate", func() bool {
+		return bytes.Equal(served(t, c), renewed)
+	})
+
+	if err := os.WriteFile(certFile, []byte("not a cert"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, 2*time.Minute, certFile)
+	waitFor("reload error", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(errs) > 0
+	})
+	if !bytes.Equal(served(t, c), renewed) {
+		t.Error("renewed certificate not kept when the reload failed")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, "auth.example.com")
+	c, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	writeCertificate(t, caFile, filepath.Join(dir, "ca-key.pem"),
+		"ca.example.com")
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		clientCA   string
+		clientAuth string
+		want       tls.ClientAuthType
+		fails      bool
+	}{
+		{name: "no client ca", want: tls.NoClientCert},
+		{name: "verify", clientCA: caFile, clientAuth: ClientAuthVerify,
+			want: tls.VerifyClientCertIfGiven},
+		{name: "require", clientCA: caFile, clientAuth: ClientAuthRequire,
+			want: tls.RequireAndVerifyClientCert},
+		{name: "unknown mode", clientCA: caFile, clientAuth: "sometimes",
+			fails: true},
+		{name: "no certificates", clientCA: empty,
+			clientAuth: ClientAuthVerify, fails: true},
+		{name: "missing ca file", clientCA: filepath.Join(dir, "missing"),
+			clientAuth: ClientAuthVerify, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := TLSConfig(c, tt.clientCA, tt.clientAuth)
+			if tt.fails {
+				if err == nil {
+					t.Error("returned no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ClientAuth != tt.want ||
+				config.MinVersion != tls.VersionTLS12 {
+				t.Errorf("client auth %v, min version %x", config.ClientAuth,
+					config.MinVersion)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"go-soapauth/audit"
+	"sync"
+	"testing"
+	"time"
+)
+
+var auditKey = audit.Key("0123456789abcdef0123456789abcdef")
+
+// auditStore is a store under test, with a way to change an event behind
+// its back, as someone writing to the database directly would.
+type auditStore struct {
+	name string
+	open func(t *testing.T) (st *Store,
+		tamper func(t *testing.T, seq int64, reason string))
+}
+
+var auditStores = []auditStore{
+	{name: "memory", open: func(t *testing.T) (*Store,
+		func(*testing.T, int64, string)) {
+		st := NewMemoryStore()
+		m := st.Audit.(*memoryAudit).m
+		return st, func(t *testing.T, seq int64, reason string) {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.events[seq-1].Reason = reason
+		}
+	}},
+	{name: "sqlite", open: func(t *testing.T) (*Store,
+		func(*testing.T, int64, string)) {
+		db := openSQLite(t)
+		return NewGormStore(db), func(t *testing.T, seq int64,
+			reason string) {
+			if err := db.Exec("UPDATE audit_events SET reason = ? "+
+				"WHERE seq = ?", reason, seq).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}},
+}
+
+// appendEvents appends n login events of the actor to the trail.
+func appendEvents(t *testing.T, st *Store, actor string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		err := st.Audit.Append(context.Background(), &audit.Event{
+			At: time.Now(), Action: audit.ActionLogin,
+			Outcome: audit.Success, ActorID: actor}, auditKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// verify checks the whole trail with the key, a few events at a time as
+// the audit command does, returning the number checked.
+func verify(st *Store, key audit.Key) (int, error) {
+	chain := audit.Chain{Key: key}
+	count, after := 0, int64(0)
+	for {
+		events, err := st.Audit.Chain(context.Background(), after, 3)
+		if err != nil {
+			return count, err
+		}
+		for _, e := range events {
+			if err := chain.Check(e); err != nil {
+				return count, err
+			}
+			count++
+			after = e.Seq
+		}
+		if len(events) < 3 {
+			return count, nil
+		}
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	for _, s := range auditStores {
+		t.Run(s.name, func(t *testing.T) {
+			st, _ := s.open(t)
+			appendEvents(t, st, "user-1", 7)
+			count, err := verify(st, auditKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 7 {
+				t.Errorf("%d events verified, want 7", count)
+			}
+			events, err := st.Audit.Find(context.Background(),
+				audit.Query{Limit: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 2 || events[0].Seq != 7 {
+				t.Errorf("newest events %v, want 7 and 6", events)
+			}
+			if _, err := verify(st, audit.Key("another key")); err == nil {
+				t.Error("trail verified with another key")
+			}
+		})
+	}
+}
+
+func TestAuditTampered(t *testing.T) {
+	for _, s := range auditStores {
+		t.Run(s.name, func(t *testing.T) {
+			st, tamper := s.open(t)
+			appendEvents(t, st, "user-1", 5)
+			tamper(t, 3, "changed")
+			count, err := verify(st, auditKey)
+			var broken *audit.BrokenError
+			if !errors.As(err, &broken) || broken.Seq != 3 {
+				t.Fatalf("verify returned %v, want event 3 broken", err)
+			}
+			if count != 2 {
+				t.Errorf("%d events verified before the break, want 2",
+					count)
+			}
+		})
+	}
+}
+
+func TestAuditConcurrentAppend(t *testing.T) {
+	const writers, each = 8, 10
+	for _, s := range auditStores {
+		t.Run(s.name, func(t *testing.T) {
+			st, _ := s.open(t)
+			var wg sync.WaitGroup
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < each; j++ {
+						err := st.Audit.Append(context.Background(),
+							&audit.Event{At: time.Now(),
+								Action:  audit.ActionLogin,
+								Outcome: audit.Success}, auditKey)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			count, err := verify(st, auditKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != writers*each {
+				t.Errorf("%d events verified, want %d", count, writers*each)
+			}
+		})
+	}
+}
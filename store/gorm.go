@@ -0,0 +1,413 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-soapauth/audit"
+	"go-soapauth/preferences"
+	"go-soapauth/webhook"
+	"time"
+
+	models "github.com/antonerne/go-soap/models"
+	"gorm.io/gorm"
+)
+
+// NewGormStore returns a store keeping its records in the database given.
+func NewGormStore(db *gorm.DB) *Store {
+	st := newGormStore(db, nil)
+	st.ping, st.close = pinger(db), closer(db)
+	return st
+}
+
+// NewReplicatedGormStore returns a store writing its records to the primary
+// database and reading them from the replicas, taking turns.  A read which
+// fails on a replica is retried on the primary, and reads made with the read
+// key of a write made within the pin duration go to the primary.  A replica
+// lagging behind finds nothing, so reads finding nothing are retried too.
+func NewReplicatedGormStore(primary *gorm.DB, replicas []*gorm.DB,
+	pin time.Duration) *Store {
+	if len(replicas) == 0 {
+		return NewGormStore(primary)
+	}
+	st := newGormStore(primary, &replicaSet{replicas: replicas, pin: pin,
+		writes: make(map[string]time.Time)})
+	all := append([]*gorm.DB{primary}, replicas...)
+	st.ping, st.close = pinger(all...), closer(all...)
+	return st
+}
+
+// pinger returns the function pinging the databases, the primary first,
+// returning the first error.
+func pinger(dbs ...*gorm.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		for i, db := range dbs {
+			sqlDB, err := db.DB()
+			if err == nil {
+				err = sqlDB.PingContext(ctx)
+			}
+			if err != nil && i > 0 {
+				return fmt.Errorf("replica %d: %w", i, err)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// closer returns the function closing the connection pools of the
+// databases, returning the first error.
+func closer(dbs ...*gorm.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var first error
+		for _, db := range dbs {
+			sqlDB, err := db.DB()
+			if err == nil {
+				err = sqlDB.Close()
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+}
+
+func newGormStore(db *gorm.DB, rs *replicaSet) *Store {
+	return &Store{
+		Users:       &gormUsers{db: db, rs: rs},
+		Credentials: &gormCredentials{db: db, rs: rs},
+		Tokens:      &gormTokens{db: db, rs: rs},
+		Remotes:     &gormRemotes{db: db, rs: rs},
+		Preferences: &gormPreferences{db: db, rs: rs},
+		Audit:       &gormAudit{db: db, rs: rs},
+		Webhooks:    &gormWebhooks{db: db, rs: rs},
+		transaction: func(ctx context.Context,
+			fn func(ctx context.Context, tx *Store) error) error {
+			// everything within the transaction is done on the primary.
+			return rs.wrote(ctx, db.WithContext(ctx).Transaction(
+				func(tx *gorm.DB) error {
+					return fn(ctx, NewGormStore(tx))
+				}))
+		},
+	}
+}
+
+// find loads the first record matching the query into dest, returning
+// ErrNotFound when there is none.
+func find(query *gorm.DB, dest interface{}) error {
+	result := query.Limit(1).Find(dest)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type gormUsers struct {
+	db *gorm.DB
+	rs *replicaSet
+}
+
+func load(db *gorm.DB) *gorm.DB {
+	return db.Preload("Name").Preload("Creds.Remotes")
+}
+
+func (r *gormUsers) ByID(ctx context.Context, id string) (*models.User,
+	error) {
+	user := new(models.User)
+	err := r.rs.read(ctx, r.db, func(db *gorm.DB) error {
+		return find(load(db).Where("id = ?", id), user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *gormUsers) ByEmail(ctx context.Context, email string) (*models.User,
+	error) {
+	user := new(models.User)
+	err := r.rs.read(ctx, r.db, func(db *gorm.DB) error {
+		return find(load(db).Where("email = ?", email), user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *gormUsers) Studies(ctx context.Context,
+	userID string) ([]models.UserBibleStudy, error) {
+	var studies []models.UserBibleStudy
+	err := r.rs.read(ctx, r.db, func(db *gorm.DB) error {
+		return db.Preload("Periods.StudyDays.References").
+			Where("userid = ?", userID).Find(&studies).Error
+	})
+	return studies, err
+}
+
+func (r *gormUsers) CurrentStudies(ctx context.Context, userID string,
+	at time.Time) ([]models.UserBibleStudy, error) {
+	var studies []models.UserBibleStudy
+	err := r.rs.read(ctx, r.db, func(db *gorm.DB) error {
+		return db.Preload("Periods.StudyDays.References").
+			Where("userid = ?", userID).Where("startdate <= ?", at).
+			Where("enddate >= ?", at).Find(&studies).Error
+	})
+	return studies, err
+}
+
+func (r *gormUsers) Create(ctx context.Context, user *models.User) error {
+	return r.rs.wrote(ctx, r.db.WithContext(ctx).Create(user).Error)
+}
+
+func (r *gormUsers) Save(ctx context.Context, user *models.User) error {
+	return r.rs.wrote(ctx,
+		r.db.WithContext(ctx).Omit("Studies").Save(user).Error)
+}
+
+func (r *gormUsers) SaveName(ctx context.Context,
+	name *models.UserName) error {
+	return r.rs.wrote(ctx, r.db.WithContext(ctx).Save(name).Error)
+}
+
+func (r *gormUsers) Delete(ctx context.Context, id string) error {
+	return r.rs.wrote(ctx, r.db.WithContext(ctx).Where("id = ?", id).
+		Delete(models.User{}).Error)
+}
+
+type gormCredentials struct {
+	db *gorm.DB
+	rs *replicaSet
+}
+
+func (r *gormCredentials) byColumn(ctx context.Context, column,
+	token string) (*models.Credentials, error) {
+	creds := new(models.Credentials)
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	err := r.rs.read(ctx, r.db, func(db *gorm.DB) error {
+		return find(db.Where(column+" = ?", token), creds)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func (r *gormCredentials) ByVerificationToken(ctx context.Context,
+	token string) (*models.Credentials, error) {
+	return r.byColumn(ctx, "verificationtoken", token)
+}
+
+func (r *gormCredentials) ByRemoteToken(ctx context.Context,
+	token string) (*models.Credentials, error) {
+	return r.byColumn(ctx, "newremotetoken", token)
+}
+
+func (r *gormCredentials) ByResetToken(ctx context.Context,
+	token string) (*models.Credentials, error) {
+	return r.byColumn(ctx, "resettoken", token)
+}
+
+func (r *gormCredentials) Save(ctx context.Context,
+	creds *models.Credentials) error {
+	return r.rs.wrote(ctx, r.db.WithContext(ctx).Save(creds).Error)
+}
+
+type gormTokens struct {
+	db *gorm.DB
+	rs *replicaSet
+}
+
+func (r *gormTokens) ByID(ctx context.Context, id string) (*models.Token,
+	error) {
+	token := new(models.Token)
+	err := r.rs.read(ctx, r.db, func(db *gorm.DB) error {
+		return find(db.Where("id = ?", id), token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (r *gormTokens) Create(ctx context.Context, token *models.Token) error {
+	return r.rs.wrote(ctx, r.db.WithContext(ctx).Create(token).Error)
+}
+
+func (r *gormTokens) Delete(ctx context.Context, id string) error {
+	return r.rs.wrote(ctx, r.db.WithContext(ctx).Where("id = ?", id).
+		Delete(models.Token{}).Error)
+}
+
+type gormRemotes struct {
+	db *gorm.DB
+	rs *replicaSet
+}
+
+func (r *gormRemotes) Create(ctx context.Context,
+	remote *models.UserRemote) error {
+	return r.rs.wrote(ctx, r.db.WithContext(ctx).Create(remote).Error)
+}
+
+type gormPreferences struct {
+	db *gorm.DB
+	rs *replicaSet
+}
+
+func (r *gormPreferences) Get(ctx context.Context,
+	userID string) (*preferences.UserPreference, error) {
+	pref := new(preferences.UserPreference)
+	err := r.rs.read(ctx, r.db, func(db *gorm.DB) error {
+		return find(db.Where("userid = ?", userID), pref)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pref, nil
+}
+
+func (r *gormPreferences) Save(ctx context.Context,
+	pref *preferences.UserPreference) error {
+	return r.rs.wrote(ctx, r.db.WithContext(ctx).Save(pref).Error)
+}
+
+// auditLockID identifies the postgres advisory lock held while appending
+// to the audit trail, so servers appending at once take turns.
+const auditLockID = 2021101801
+
+type gormAudit struct {
+	db *gorm.DB
+	rs *replicaSet
+}
+
+// Append seals the event after the last one within a transaction.
+// Postgres holds the audit lock until it ends; sqlite allows a single
+// writer, so needs none.
+func (r *gormAudit) Append(ctx context.Context, event *audit.Event,
+	key audit.Key) error {
+	return r.rs.wrote(ctx, r.db.WithContext(ctx).Transaction(
+		func(tx *gorm.DB) error {
+			if tx.Dialector.Name() == DriverPostgres {
+				err := tx.Exec("SELECT pg_advisory_xact_lock(?)",
+					auditLockID).Error
+				if err != nil {
+					return err
+				}
+			}
+			var last *audit.Event
+			found := new(audit.Event)
+			err := find(tx.Order("seq DESC"), found)
+			if err == nil {
+				last = found
+			} else if !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			event.Seal(last, key)
+			return tx.Create(event).Error
+		}))
+}
+
+func (r *gormAudit) Find(ctx context.Context,
+	query audit.Query) ([]audit.Event, error) {
+	var events []audit.Event
+	err := r.rs.read(ctx, r.db, func(db *gorm.DB) error {
+		for column, value := range map[string]string{
+			"action": query.Action, "outcome": query.Outcome,
+			"actorid": query.ActorID, "targetid": query.TargetID,
+		} {
+			if value != "" {
+				db = db.Where(column+" = ?", value)
+			}
+		}
+		if !query.Since.IsZero() {
+			db = db.Where("at >= ?", query.Since)
+		}
+		if !query.Until.IsZero() {
+			db = db.Where("at < ?", query.Until)
+		}
+		if query.Before != 0 {
+			db = db.Where("seq < ?", query.Before)
+		}
+		if query.Limit > 0 {
+			db = db.Limit(query.Limit)
+		}
+		return db.Order("seq DESC").Find(&events).Error
+	})
+	return events, err
+}
+
+func (r *gormAudit) Chain(ctx context.Context, after int64,
+	limit int) ([]audit.Event, error) {
+	var events []audit.Event
+	err := r.rs.read(ctx, r.db, func(db *gorm.DB) error {
+		return db.Where("seq > ?", after).Order("seq").Limit(limit).
+			Find(&events).Error
+	})
+	return events, err
+}
+
+type gormWebhooks struct {
+	db *gorm.DB
+	rs *replicaSet
+}
+
+func (r *gormWebhooks) All(ctx context.Context) ([]webhook.Subscription,
+	error) {
+	var subs []webhook.Subscription
+	err := r.rs.read(ctx, r.db, func(db *gorm.DB) error {
+		return db.Order("created").Find(&subs).Error
+	})
+	return subs, err
+}
+
+func (r *gormWebhooks) ByID(ctx context.Context,
+	id string) (*webhook.Subscription, error) {
+	sub := new(webhook.Subscription)
+	err := r.rs.read(ctx, r.db, func(db *gorm.DB) error {
+		return find(db.Where("id = ?", id), sub)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (r *gormWebhooks) Create(ctx context.Context,
+	sub *webhook.Subscription) error {
+	return r.rs.wrote(ctx, r.db.WithContext(ctx).Create(sub).Error)
+}
+
+func (r *gormWebhooks) Delete(ctx context.Context, id string) error {
+	return r.rs.wrote(ctx, r.db.WithContext(ctx).Transaction(
+		func(tx *gorm.DB) error {
+			err := tx.Where("subscriptionid = ?", id).
+				Delete(webhook.Delivery{}).Error
+			if err != nil {
+				return err
+			}
+			return tx.Where("id = ?", id).Delete(webhook.Subscription{}).Error
+		}))
+}
+
+func (r *gormWebhooks) AddDelivery(ctx context.Context,
+	delivery *webhook.Delivery) error {
+	return r.rs.wrote(ctx, r.db.WithContext(ctx).Create(delivery).Error)
+}
+
+func (r *gormWebhooks) Deliveries(ctx context.Context, subscriptionID string,
+	limit int) ([]webhook.Delivery, error) {
+	var deliveries []webhook.Delivery
+	err := r.rs.read(ctx, r.db, func(db *gorm.DB) error {
+		return db.Where("subscriptionid = ?", subscriptionID).
+			Order("at DESC").Limit(limit).Find(&deliveries).Error
+	})
+	return deliveries, err
+}
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"go-soapauth/migrations"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Sizes of the studies of the benchmark user: studies of periods of days,
+// each day with its references, so thousands of study days in all.
+const (
+	benchStudies    = 10
+	benchPeriods    = 12
+	benchDays       = 30
+	benchReferences = 3
+	benchUserID     = "bench-user"
+)
+
+// openSQLite returns a migrated sqlite database, closed when the test
+// ends.
+func openSQLite(tb testing.TB) *gorm.DB {
+	tb.Helper()
+	db, err := Open(DriverSQLite, filepath.Join(tb.TempDir(), "test.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	migrator, err := migrations.New(db)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+// newBenchStore returns a store on a migrated sqlite database holding the
+// benchmark user and their studies.
+func newBenchStore(b *testing.B) *Store {
+	b.Helper()
+	db := openSQLite(b)
+	if err := db.Transaction(seedStudies); err != nil {
+		b.Fatal(err)
+	}
+	return NewGormStore(db)
+}
+
+// seedStudies adds the benchmark user, with their name, credentials, a
+// remote and their studies, using the columns of the migrations.
+func seedStudies(tx *gorm.DB) error {
+	insert := func(sql string, values ...interface{}) (int64, error) {
+		var id int64
+		err := tx.Raw(sql+" RETURNING id", values...).Scan(&id).Error
+		return id, err
+	}
+	statements := []string{
+		"INSERT INTO users (id, email) VALUES (?, 'bench@example.com')",
+		"INSERT INTO usernames (userid, first, last) " +
+			"VALUES (?, 'Bench', 'Reader')",
+		"INSERT INTO credentials (userid, verified) VALUES (?, 1)",
+		"INSERT INTO userremotes (credentialsuserid, remoteip) " +
+			"VALUES (?, '192.0.2.1')",
+	}
+	for _, sql := range statements {
+		if err := tx.Exec(sql, benchUserID).Error; err != nil {
+			return err
+		}
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for s := 0; s < benchStudies; s++ {
+		studyID, err := insert("INSERT INTO userbiblestudies "+
+			"(userid, startdate, enddate) VALUES (?, ?, ?)", benchUserID,
+			start.AddDate(s, 0, 0), start.AddDate(s+1, 0, -1))
+		if err != nil {
+			return err
+		}
+		for p := 0; p < benchPeriods; p++ {
+			periodID, err := insert("INSERT INTO studyperiods (studyid) "+
+				"VALUES (?)", studyID)
+			if err != nil {
+				return err
+			}
+			for d := 0; d < benchDays; d++ {
+				dayID, err := insert("INSERT INTO studydays (periodid) "+
+					"VALUES (?)", periodID)
+				if err != nil {
+					return err
+				}
+				for r := 0; r < benchReferences; r++ {
+					if err := tx.Exec("INSERT INTO studyreferences "+
+						"(dayid) VALUES (?)", dayID).Error; err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// BenchmarkUserByID loads the user as the auth paths do, without their
+// studies.
+func BenchmarkUserByID(b *testing.B) {
+	st := newBenchStore(b)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		user, err := st.Users.ByID(ctx, benchUserID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(user.Studies) != 0 {
+			b.Fatal("studies loaded with the user")
+		}
+	}
+}
+
+// BenchmarkUserStudies loads all the studies of the user, with their
+// periods, days and references, as the studies endpoint does.
+func BenchmarkUserStudies(b *testing.B) {
+	st := newBenchStore(b)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		studies, err := st.Users.Studies(ctx, benchUserID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(studies) != benchStudies {
+			b.Fatalf("%d studies loaded, want %d", len(studies),
+				benchStudies)
+		}
+	}
+}
+
+// BenchmarkUserCurrentStudies loads only the studies under way.
+func BenchmarkUserCurrentStudies(b *testing.B) {
+	st := newBenchStore(b)
+	ctx := context.Background()
+	at := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		studies, err := st.Users.CurrentStudies(ctx, benchUserID, at)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(studies) != 1 {
+			b.Fatalf("%d studies loaded, want 1", len(studies))
+		}
+	}
+}
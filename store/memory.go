@@ -0,0 +1,483 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"go-soapauth/audit"
+	"go-soapauth/preferences"
+	"go-soapauth/webhook"
+	"sort"
+	"sync"
+	"time"
+
+	models "github.com/antonerne/go-soap/models"
+)
+
+// errDuplicate is returned when creating a user whose id or email address is
+// already in use.
+var errDuplicate = errors.New("record already exists")
+
+// memory holds the records of an in-memory store.  Records are copied in and
+// out so callers never share them with the store.
+type memory struct {
+	// txMu is held by a transaction, so only one runs at a time.
+	txMu   sync.Mutex
+	mu     sync.RWMutex
+	users  map[string]*models.User
+	tokens map[string]models.Token
+	prefs  map[string]preferences.UserPreference
+	events []audit.Event
+	hooks  map[string]webhook.Subscription
+	// deliveries are logged oldest first.
+	deliveries []webhook.Delivery
+}
+
+// NewMemoryStore returns an empty store keeping its records in memory, for
+// tests and local development.  Its calls are immediate, so ignore the
+// context given.
+func NewMemoryStore() *Store {
+	m := &memory{
+		users:  make(map[string]*models.User),
+		tokens: make(map[string]models.Token),
+		prefs:  make(map[string]preferences.UserPreference),
+		hooks:  make(map[string]webhook.Subscription),
+	}
+	return &Store{
+		Users:       &memoryUsers{m},
+		Credentials: &memoryCredentials{m},
+		Tokens:      &memoryTokens{m},
+		Remotes:     &memoryRemotes{m},
+		Preferences: &memoryPreferences{m},
+		Audit:       &memoryAudit{m},
+		Webhooks:    &memoryWebhooks{m},
+		transaction: m.transaction,
+	}
+}
+
+// transaction runs fn against the store, putting back the records as they
+// were before it when it fails.  Writes made outside the transaction while
+// it runs are not isolated from it.
+func (m *memory) transaction(ctx context.Context,
+	fn func(ctx context.Context, tx *Store) error) error {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	m.mu.RLock()
+	users := make(map[string]*models.User, len(m.users))
+	for id, user := range m.users {
+		users[id] = copyUser(user)
+	}
+	tokens := make(map[string]models.Token, len(m.tokens))
+	for id, token := range m.tokens {
+		tokens[id] = token
+	}
+	prefs := make(map[string]preferences.UserPreference, len(m.prefs))
+	for id, pref := range m.prefs {
+		prefs[id] = pref
+	}
+	events := m.events
+	hooks := make(map[string]webhook.Subscription, len(m.hooks))
+	for id, sub := range m.hooks {
+		hooks[id] = sub
+	}
+	deliveries := m.deliveries
+	m.mu.RUnlock()
+
+	tx := &Store{
+		Users:       &memoryUsers{m},
+		Credentials: &memoryCredentials{m},
+		Tokens:      &memoryTokens{m},
+		Remotes:     &memoryRemotes{m},
+		Preferences: &memoryPreferences{m},
+		Audit:       &memoryAudit{m},
+		Webhooks:    &memoryWebhooks{m},
+	}
+	if err := fn(ctx, tx); err != nil {
+		m.mu.Lock()
+		m.users, m.tokens, m.prefs = users, tokens, prefs
+		m.events, m.hooks, m.deliveries = events, hooks, deliveries
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// withoutStudies returns a copy of the user, as loaded by the repository,
+// without the bible studies.
+func withoutStudies(user *models.User) *models.User {
+	c := copyUser(user)
+	c.Studies = nil
+	return c
+}
+
+// copyUser returns a copy of the user which shares no slices with it.
+func copyUser(user *models.User) *models.User {
+	c := *user
+	c.Creds.Remotes = append([]models.UserRemote(nil), user.Creds.Remotes...)
+	c.Studies = append([]models.UserBibleStudy(nil), user.Studies...)
+	return &c
+}
+
+type memoryUsers struct {
+	m *memory
+}
+
+func (r *memoryUsers) ByID(ctx context.Context, id string) (*models.User,
+	error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+	user, ok := r.m.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return withoutStudies(user), nil
+}
+
+func (r *memoryUsers) ByEmail(ctx context.Context,
+	email string) (*models.User, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+	for _, user := range r.m.users {
+		if user.Email == email {
+			return withoutStudies(user), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryUsers) Studies(ctx context.Context,
+	userID string) ([]models.UserBibleStudy, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+	user, ok := r.m.users[userID]
+	if !ok {
+		return nil, nil
+	}
+	return append([]models.UserBibleStudy(nil), user.Studies...), nil
+}
+
+func (r *memoryUsers) CurrentStudies(ctx context.Context, userID string,
+	at time.Time) ([]models.UserBibleStudy, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+	user, ok := r.m.users[userID]
+	if !ok {
+		return nil, nil
+	}
+	return currentStudies(user.Studies, at), nil
+}
+
+func (r *memoryUsers) Create(ctx context.Context, user *models.User) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if _, ok := r.m.users[user.ID]; ok {
+		return errDuplicate
+	}
+	for _, u := range r.m.users {
+		if u.Email == user.Email {
+			return errDuplicate
+		}
+	}
+	user.Creds.UserID = user.ID
+	user.Name.UserID = user.ID
+	r.m.users[user.ID] = copyUser(user)
+	return nil
+}
+
+func (r *memoryUsers) Save(ctx context.Context, user *models.User) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	saved := copyUser(user)
+	saved.Studies = nil
+	if stored, ok := r.m.users[user.ID]; ok {
+		saved.Studies = stored.Studies
+	}
+	r.m.users[user.ID] = saved
+	return nil
+}
+
+func (r *memoryUsers) SaveName(ctx context.Context,
+	name *models.UserName) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	user, ok := r.m.users[name.UserID]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Name = *name
+	return nil
+}
+
+func (r *memoryUsers) Delete(ctx context.Context, id string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	delete(r.m.users, id)
+	delete(r.m.prefs, id)
+	return nil
+}
+
+type memoryCredentials struct {
+	m *memory
+}
+
+// byToken returns a copy of the first credentials the match function
+// accepts.
+func (r *memoryCredentials) byToken(token string,
+	match func(*models.Credentials) string) (*models.Credentials, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+	for _, user := range r.m.users {
+		if match(&user.Creds) == token {
+			creds := copyUser(user).Creds
+			return &creds, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryCredentials) ByVerificationToken(ctx context.Context,
+	token string) (*models.Credentials, error) {
+	return r.byToken(token, func(c *models.Credentials) string {
+		return c.VerificationToken
+	})
+}
+
+func (r *memoryCredentials) ByRemoteToken(ctx context.Context,
+	token string) (*models.Credentials, error) {
+	return r.byToken(token, func(c *models.Credentials) string {
+		return c.NewRemoteToken
+	})
+}
+
+func (r *memoryCredentials) ByResetToken(ctx context.Context,
+	token string) (*models.Credentials, error) {
+	return r.byToken(token, func(c *models.Credentials) string {
+		return c.ResetToken
+	})
+}
+
+func (r *memoryCredentials) Save(ctx context.Context,
+	creds *models.Credentials) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	user, ok := r.m.users[creds.UserID]
+	if !ok {
+		return ErrNotFound
+	}
+	remotes := user.Creds.Remotes
+	user.Creds = *creds
+	if creds.Remotes == nil {
+		user.Creds.Remotes = remotes
+	} else {
+		user.Creds.Remotes = append([]models.UserRemote(nil),
+			creds.Remotes...)
+	}
+	return nil
+}
+
+type memoryTokens struct {
+	m *memory
+}
+
+func (r *memoryTokens) ByID(ctx context.Context, id string) (*models.Token,
+	error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+	token, ok := r.m.tokens[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &token, nil
+}
+
+func (r *memoryTokens) Create(ctx context.Context, token *models.Token) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.m.tokens[token.ID] = *token
+	return nil
+}
+
+func (r *memoryTokens) Delete(ctx context.Context, id string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	delete(r.m.tokens, id)
+	return nil
+}
+
+type memoryRemotes struct {
+	m *memory
+}
+
+func (r *memoryRemotes) Create(ctx context.Context,
+	remote *models.UserRemote) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	user, ok := r.m.users[remote.CredentialsUserID]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Creds.Remotes = append(user.Creds.Remotes, *remote)
+	return nil
+}
+
+type memoryPreferences struct {
+	m *memory
+}
+
+func (r *memoryPreferences) Get(ctx context.Context,
+	userID string) (*preferences.UserPreference, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+	pref, ok := r.m.prefs[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &pref, nil
+}
+
+func (r *memoryPreferences) Save(ctx context.Context,
+	pref *preferences.UserPreference) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.m.prefs[pref.UserID] = *pref
+	return nil
+}
+
+type memoryAudit struct {
+	m *memory
+}
+
+func (r *memoryAudit) Append(ctx context.Context, event *audit.Event,
+	key audit.Key) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var last *audit.Event
+	if n := len(r.m.events); n > 0 {
+		last = &r.m.events[n-1]
+	}
+	event.Seal(last, key)
+	// appending to a copy leaves the events a transaction put back alone.
+	events := make([]audit.Event, len(r.m.events), len(r.m.events)+1)
+	copy(events, r.m.events)
+	r.m.events = append(events, *event)
+	return nil
+}
+
+func (r *memoryAudit) Find(ctx context.Context,
+	query audit.Query) ([]audit.Event, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+	var events []audit.Event
+	for i := len(r.m.events) - 1; i >= 0; i-- {
+		if query.Limit > 0 && len(events) == query.Limit {
+			break
+		}
+		e := r.m.events[i]
+		if (query.Action != "" && e.Action != query.Action) ||
+			(query.Outcome != "" && e.Outcome != query.Outcome) ||
+			(query.ActorID != "" && e.ActorID != query.ActorID) ||
+			(query.TargetID != "" && e.TargetID != query.TargetID) ||
+			(!query.Since.IsZero() && e.At.Before(query.Since)) ||
+			(!query.Until.IsZero() && !e.At.Before(query.Until)) ||
+			(query.Before != 0 && e.Seq >= query.Before) {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (r *memoryAudit) Chain(ctx context.Context, after int64,
+	limit int) ([]audit.Event, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+	var events []audit.Event
+	for _, e := range r.m.events {
+		if e.Seq > after && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+type memoryWebhooks struct {
+	m *memory
+}
+
+func (r *memoryWebhooks) All(ctx context.Context) ([]webhook.Subscription,
+	error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+	var subs []webhook.Subscription
+	for _, sub := range r.m.hooks {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Created.Before(subs[j].Created)
+	})
+	return subs, nil
+}
+
+func (r *memoryWebhooks) ByID(ctx context.Context,
+	id string) (*webhook.Subscription, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+	sub, ok := r.m.hooks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &sub, nil
+}
+
+func (r *memoryWebhooks) Create(ctx context.Context,
+	sub *webhook.Subscription) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if _, ok := r.m.hooks[sub.ID]; ok {
+		return errDuplicate
+	}
+	r.m.hooks[sub.ID] = *sub
+	return nil
+}
+
+func (r *memoryWebhooks) Delete(ctx context.Context, id string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	delete(r.m.hooks, id)
+	var kept []webhook.Delivery
+	for _, d := range r.m.deliveries {
+		if d.SubscriptionID != id {
+			kept = append(kept, d)
+		}
+	}
+	r.m.deliveries = kept
+	return nil
+}
+
+func (r *memoryWebhooks) AddDelivery(ctx context.Context,
+	delivery *webhook.Delivery) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	// appending to a copy leaves the log a transaction put back alone.
+	deliveries := make([]webhook.Delivery, len(r.m.deliveries),
+		len(r.m.deliveries)+1)
+	copy(deliveries, r.m.deliveries)
+	r.m.deliveries = append(deliveries, *delivery)
+	return nil
+}
+
+func (r *memoryWebhooks) Deliveries(ctx context.Context,
+	subscriptionID string, limit int) ([]webhook.Delivery, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+	var deliveries []webhook.Delivery
+	for i := len(r.m.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if d := r.m.deliveries[i]; d.SubscriptionID == subscriptionID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,563 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"go-soapauth/audit"
+	"go-soapauth/preferences"
+	"go-soapauth/webhook"
+	"time"
+
+	models "github.com/antonerne/go-soap/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collections used by the mongo store.  Users are kept as a single document
+// holding their name, credentials, remotes and studies; the field names are
+// the lowercased model field names, as with the database columns.
+const (
+	usersCollection       = "users"
+	tokensCollection      = "tokens"
+	preferencesCollection = "userpreferences"
+	auditCollection       = "audit_events"
+	webhooksCollection    = "webhooks"
+	deliveriesCollection  = "webhook_deliveries"
+)
+
+// ErrStandalone is returned for a mongo server which is neither a member of
+// a replica set nor a sharded cluster, so can't run the transactions the
+// store relies on.
+var ErrStandalone = errors.New("mongo server is standalone, but " +
+	"transactions need a replica set or sharded cluster; run mongod with " +
+	"--replSet and rs.initiate() for a single-node replica set")
+
+// NewMongoStore returns a store keeping its records in the mongo database
+// given, after creating the indexes used to find users by their email
+// address and the tokens emailed to them.  A standalone server is refused
+// with ErrStandalone.
+func NewMongoStore(ctx context.Context, db *mongo.Database) (*Store, error) {
+	if err := checkTopology(ctx, db.Client()); err != nil {
+		return nil, err
+	}
+	if err := createIndexes(ctx, db); err != nil {
+		return nil, err
+	}
+	m := &mongoDB{db: db}
+	return &Store{
+		Users:       &mongoUsers{m},
+		Credentials: &mongoCredentials{m},
+		Tokens:      &mongoTokens{m},
+		Remotes:     &mongoRemotes{m},
+		Preferences: &mongoPreferences{m},
+		Audit:       &mongoAudit{m},
+		Webhooks:    &mongoWebhooks{m},
+		transaction: m.transaction,
+		ping: func(ctx context.Context) error {
+			return db.Client().Ping(ctx, nil)
+		},
+		close: func(ctx context.Context) error {
+			return db.Client().Disconnect(ctx)
+		},
+	}, nil
+}
+
+// ConnectMongo connects to the mongo server at the uri given and returns the
+// database named.  The events of the client's connection pools go to the
+// monitor, unless it is nil.
+func ConnectMongo(ctx context.Context, uri, database string,
+	monitor *event.PoolMonitor) (*mongo.Database, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).
+		SetPoolMonitor(monitor))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	return client.Database(database), nil
+}
+
+// checkTopology returns ErrStandalone unless the server is a member of a
+// replica set, which names its set, or a sharded cluster's router.
+func checkTopology(ctx context.Context, client *mongo.Client) error {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := client.Database("admin").RunCommand(ctx,
+		bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return err
+	}
+	if hello.SetName == "" && hello.Msg != "isdbgrid" {
+		return ErrStandalone
+	}
+	return nil
+}
+
+// createIndexes creates the indexes of each collection, which does nothing
+// for the indexes already there.
+func createIndexes(ctx context.Context, db *mongo.Database) error {
+	indexes := map[string][]mongo.IndexModel{
+		usersCollection: {
+			{Keys: bson.D{{Key: "id", Value: 1}},
+				Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "email", Value: 1}},
+				Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "creds.verificationtoken", Value: 1}}},
+			{Keys: bson.D{{Key: "creds.newremotetoken", Value: 1}}},
+			{Keys: bson.D{{Key: "creds.resettoken", Value: 1}}},
+		},
+		tokensCollection: {
+			{Keys: bson.D{{Key: "id", Value: 1}},
+				Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "userid", Value: 1}}},
+		},
+		preferencesCollection: {
+			{Keys: bson.D{{Key: "userid", Value: 1}},
+				Options: options.Index().SetUnique(true)},
+		},
+		auditCollection: {
+			{Keys: bson.D{{Key: "seq", Value: 1}},
+				Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "actorid", Value: 1}}},
+			{Keys: bson.D{{Key: "targetid", Value: 1}}},
+		},
+		webhooksCollection: {
+			{Keys: bson.D{{Key: "id", Value: 1}},
+				Options: options.Index().SetUnique(true)},
+		},
+		deliveriesCollection: {
+			{Keys: bson.D{{Key: "subscriptionid", Value: 1},
+				{Key: "at", Value: -1}}},
+		},
+	}
+	for collection, keys := range indexes {
+		_, err := db.Collection(collection).Indexes().CreateMany(ctx, keys)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mongoDB holds the database of a mongo store.
+type mongoDB struct {
+	db *mongo.Database
+}
+
+// transaction runs fn in a session transaction, which mongo only supports
+// on replica sets and sharded clusters, so standalone servers are refused
+// when the store is made.  The session is carried by the
+// context fn is given, so transactions started within it join it.
+func (m *mongoDB) transaction(ctx context.Context,
+	fn func(ctx context.Context, tx *Store) error) error {
+	if mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx, &Store{
+			Users:       &mongoUsers{m},
+			Credentials: &mongoCredentials{m},
+			Tokens:      &mongoTokens{m},
+			Remotes:     &mongoRemotes{m},
+			Preferences: &mongoPreferences{m},
+			Audit:       &mongoAudit{m},
+			Webhooks:    &mongoWebhooks{m},
+		})
+	}
+	return m.db.Client().UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc,
+			func(sc mongo.SessionContext) (interface{}, error) {
+				return nil, m.transaction(sc, fn)
+			})
+		return err
+	})
+}
+
+func (m *mongoDB) users() *mongo.Collection {
+	return m.db.Collection(usersCollection)
+}
+
+// findOne decodes the first document of the collection matching the filter
+// into dest, returning ErrNotFound when there is none.
+func findOne(ctx context.Context, collection *mongo.Collection,
+	filter interface{}, dest interface{},
+	opts ...*options.FindOneOptions) error {
+	err := collection.FindOne(ctx, filter, opts...).Decode(dest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// updateOne applies the update to the document matching the filter,
+// returning ErrNotFound when there is none.
+func updateOne(ctx context.Context, collection *mongo.Collection,
+	filter interface{}, update interface{}) error {
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// userProjection leaves the bible studies out of the users loaded.
+var userProjection = options.FindOne().SetProjection(bson.M{"studies": 0})
+
+type mongoUsers struct {
+	m *mongoDB
+}
+
+func (r *mongoUsers) ByID(ctx context.Context, id string) (*models.User,
+	error) {
+	user := new(models.User)
+	if err := findOne(ctx, r.m.users(), bson.M{"id": id}, user,
+		userProjection); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *mongoUsers) ByEmail(ctx context.Context,
+	email string) (*models.User, error) {
+	user := new(models.User)
+	err := findOne(ctx, r.m.users(), bson.M{"email": email}, user,
+		userProjection)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *mongoUsers) Studies(ctx context.Context,
+	userID string) ([]models.UserBibleStudy, error) {
+	user := new(models.User)
+	err := findOne(ctx, r.m.users(), bson.M{"id": userID}, user,
+		options.FindOne().SetProjection(bson.M{"studies": 1}))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return user.Studies, nil
+}
+
+func (r *mongoUsers) CurrentStudies(ctx context.Context, userID string,
+	at time.Time) ([]models.UserBibleStudy, error) {
+	studies, err := r.Studies(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return currentStudies(studies, at), nil
+}
+
+func (r *mongoUsers) Create(ctx context.Context, user *models.User) error {
+	user.Creds.UserID = user.ID
+	user.Name.UserID = user.ID
+	_, err := r.m.users().InsertOne(ctx, user)
+	return err
+}
+
+// Save writes the user's document, except for the bible studies.
+func (r *mongoUsers) Save(ctx context.Context, user *models.User) error {
+	fields, err := documentFields(user)
+	if err != nil {
+		return err
+	}
+	delete(fields, "studies")
+	_, err = r.m.users().UpdateOne(ctx, bson.M{"id": user.ID},
+		bson.M{"$set": fields}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (r *mongoUsers) SaveName(ctx context.Context,
+	name *models.UserName) error {
+	return updateOne(ctx, r.m.users(), bson.M{"id": name.UserID},
+		bson.M{"$set": bson.M{"name": name}})
+}
+
+func (r *mongoUsers) Delete(ctx context.Context, id string) error {
+	if _, err := r.m.users().DeleteOne(ctx, bson.M{"id": id}); err != nil {
+		return err
+	}
+	_, err := r.m.db.Collection(preferencesCollection).DeleteOne(ctx,
+		bson.M{"userid": id})
+	return err
+}
+
+type mongoCredentials struct {
+	m *mongoDB
+}
+
+func (r *mongoCredentials) byField(ctx context.Context, field,
+	token string) (*models.Credentials, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	user := new(models.User)
+	if err := findOne(ctx, r.m.users(), bson.M{"creds." + field: token},
+		user); err != nil {
+		return nil, err
+	}
+	return &user.Creds, nil
+}
+
+func (r *mongoCredentials) ByVerificationToken(ctx context.Context,
+	token string) (*models.Credentials, error) {
+	return r.byField(ctx, "verificationtoken", token)
+}
+
+func (r *mongoCredentials) ByRemoteToken(ctx context.Context,
+	token string) (*models.Credentials, error) {
+	return r.byField(ctx, "newremotetoken", token)
+}
+
+func (r *mongoCredentials) ByResetToken(ctx context.Context,
+	token string) (*models.Credentials, error) {
+	return r.byField(ctx, "resettoken", token)
+}
+
+// Save replaces the user's credentials, keeping the approved remotes when
+// the credentials given don't have them loaded.
+func (r *mongoCredentials) Save(ctx context.Context,
+	creds *models.Credentials) error {
+	fields, err := documentFields(creds)
+	if err != nil {
+		return err
+	}
+	set := bson.M{}
+	for field, value := range fields {
+		if field == "remotes" && creds.Remotes == nil {
+			continue
+		}
+		set["creds."+field] = value
+	}
+	return updateOne(ctx, r.m.users(), bson.M{"id": creds.UserID},
+		bson.M{"$set": set})
+}
+
+// documentFields returns the fields of the document a record is stored as.
+func documentFields(record interface{}) (bson.M, error) {
+	data, err := bson.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var fields bson.M
+	if err := bson.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+type mongoTokens struct {
+	m *mongoDB
+}
+
+func (r *mongoTokens) ByID(ctx context.Context, id string) (*models.Token,
+	error) {
+	token := new(models.Token)
+	err := findOne(ctx, r.m.db.Collection(tokensCollection),
+		bson.M{"id": id}, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (r *mongoTokens) Create(ctx context.Context, token *models.Token) error {
+	_, err := r.m.db.Collection(tokensCollection).InsertOne(ctx, token)
+	return err
+}
+
+func (r *mongoTokens) Delete(ctx context.Context, id string) error {
+	_, err := r.m.db.Collection(tokensCollection).DeleteOne(ctx,
+		bson.M{"id": id})
+	return err
+}
+
+type mongoRemotes struct {
+	m *mongoDB
+}
+
+func (r *mongoRemotes) Create(ctx context.Context,
+	remote *models.UserRemote) error {
+	return updateOne(ctx, r.m.users(),
+		bson.M{"id": remote.CredentialsUserID},
+		bson.M{"$push": bson.M{"creds.remotes": remote}})
+}
+
+type mongoPreferences struct {
+	m *mongoDB
+}
+
+func (r *mongoPreferences) Get(ctx context.Context,
+	userID string) (*preferences.UserPreference, error) {
+	pref := new(preferences.UserPreference)
+	err := findOne(ctx, r.m.db.Collection(preferencesCollection),
+		bson.M{"userid": userID}, pref)
+	if err != nil {
+		return nil, err
+	}
+	return pref, nil
+}
+
+func (r *mongoPreferences) Save(ctx context.Context,
+	pref *preferences.UserPreference) error {
+	_, err := r.m.db.Collection(preferencesCollection).ReplaceOne(ctx,
+		bson.M{"userid": pref.UserID}, pref,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+type mongoAudit struct {
+	m *mongoDB
+}
+
+// Append seals the event after the last one and inserts it.  The sequence
+// numbers are unique, so when another server appended first the insert
+// fails and the event is sealed again after the new last one.
+func (r *mongoAudit) Append(ctx context.Context, event *audit.Event,
+	key audit.Key) error {
+	collection := r.m.db.Collection(auditCollection)
+	for {
+		var last *audit.Event
+		found := new(audit.Event)
+		err := findOne(ctx, collection, bson.M{}, found,
+			options.FindOne().SetSort(bson.M{"seq": -1}))
+		if err == nil {
+			last = found
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		event.Seal(last, key)
+		_, err = collection.InsertOne(ctx, event)
+		if !mongo.IsDuplicateKeyError(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+func (r *mongoAudit) Find(ctx context.Context,
+	query audit.Query) ([]audit.Event, error) {
+	filter := bson.M{}
+	for field, value := range map[string]string{
+		"action": query.Action, "outcome": query.Outcome,
+		"actorid": query.ActorID, "targetid": query.TargetID,
+	} {
+		if value != "" {
+			filter[field] = value
+		}
+	}
+	at := bson.M{}
+	if !query.Since.IsZero() {
+		at["$gte"] = query.Since
+	}
+	if !query.Until.IsZero() {
+		at["$lt"] = query.Until
+	}
+	if len(at) > 0 {
+		filter["at"] = at
+	}
+	if query.Before != 0 {
+		filter["seq"] = bson.M{"$lt": query.Before}
+	}
+	opts := options.Find().SetSort(bson.M{"seq": -1})
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+	return findEvents(ctx, r.m.db.Collection(auditCollection), filter, opts)
+}
+
+func (r *mongoAudit) Chain(ctx context.Context, after int64,
+	limit int) ([]audit.Event, error) {
+	return findEvents(ctx, r.m.db.Collection(auditCollection),
+		bson.M{"seq": bson.M{"$gt": after}},
+		options.Find().SetSort(bson.M{"seq": 1}).SetLimit(int64(limit)))
+}
+
+// findEvents decodes the events matching the filter.
+func findEvents(ctx context.Context, collection *mongo.Collection,
+	filter interface{}, opts *options.FindOptions) ([]audit.Event, error) {
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var events []audit.Event
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+type mongoWebhooks struct {
+	m *mongoDB
+}
+
+func (r *mongoWebhooks) All(ctx context.Context) ([]webhook.Subscription,
+	error) {
+	cursor, err := r.m.db.Collection(webhooksCollection).Find(ctx, bson.M{},
+		options.Find().SetSort(bson.M{"created": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var subs []webhook.Subscription
+	if err := cursor.All(ctx, &subs); err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+func (r *mongoWebhooks) ByID(ctx context.Context,
+	id string) (*webhook.Subscription, error) {
+	sub := new(webhook.Subscription)
+	err := findOne(ctx, r.m.db.Collection(webhooksCollection),
+		bson.M{"id": id}, sub)
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (r *mongoWebhooks) Create(ctx context.Context,
+	sub *webhook.Subscription) error {
+	_, err := r.m.db.Collection(webhooksCollection).InsertOne(ctx, sub)
+	return err
+}
+
+func (r *mongoWebhooks) Delete(ctx context.Context, id string) error {
+	_, err := r.m.db.Collection(deliveriesCollection).DeleteMany(ctx,
+		bson.M{"subscriptionid": id})
+	if err != nil {
+		return err
+	}
+	_, err = r.m.db.Collection(webhooksCollection).DeleteOne(ctx,
+		bson.M{"id": id})
+	return err
+}
+
+func (r *mongoWebhooks) AddDelivery(ctx context.Context,
+	delivery *webhook.Delivery) error {
+	_, err := r.m.db.Collection(deliveriesCollection).InsertOne(ctx,
+		delivery)
+	return err
+}
+
+func (r *mongoWebhooks) Deliveries(ctx context.Context, subscriptionID string,
+	limit int) ([]webhook.Delivery, error) {
+	cursor, err := r.m.db.Collection(deliveriesCollection).Find(ctx,
+		bson.M{"subscriptionid": subscriptionID},
+		options.Find().SetSort(bson.M{"at": -1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []webhook.Delivery
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	models "github.com/antonerne/go-soap/models"
+)
+
+// newTestMongoStore returns a store on a database of its own on the mongo
+// server at MONGO_URI, dropped when the test ends, or skips the test when
+// MONGO_URI isn't set.
+func newTestMongoStore(t *testing.T) *Store {
+	t.Helper()
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		t.Skip("MONGO_URI not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	name := "authserver_test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	db, err := ConnectMongo(ctx, uri, name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			30*time.Second)
+		defer cancel()
+		db.Drop(ctx)
+		db.Client().Disconnect(ctx)
+	})
+	st, err := NewMongoStore(ctx, db)
+	if errors.Is(err, ErrStandalone) {
+		t.Skip("MONGO_URI is a standalone server, which the store refuses")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestMongoTransaction(t *testing.T) {
+	st := newTestMongoStore(t)
+	ctx := context.Background()
+	user := &models.User{ID: "mongo-user", Email: "mongo@example.com"}
+	if err := st.Users.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	err := st.Transaction(ctx, func(ctx context.Context, tx *Store) error {
+		user.Creds.VerificationToken = "verify"
+		if err := tx.Credentials.Save(ctx, &user.Creds); err != nil {
+			return err
+		}
+		return tx.Tokens.Create(ctx, &models.Token{ID: "kept",
+			UserID: user.ID, Expires: time.Now().Add(time.Hour)})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Tokens.ByID(ctx, "kept"); err != nil {
+		t.Errorf("token of the transaction not saved: %v", err)
+	}
+	creds, err := st.Credentials.ByVerificationToken(ctx, "verify")
+	if err != nil || creds.UserID != user.ID {
+		t.Errorf("credentials of the transaction not saved: %v", err)
+	}
+
+	failed := errors.New("failed")
+	err = st.Transaction(ctx, func(ctx context.Context, tx *Store) error {
+		if err := tx.Tokens.Delete(ctx, "kept"); err != nil {
+			return err
+		}
+		if err := tx.Tokens.Create(ctx, &models.Token{ID: "dropped",
+			UserID: user.ID, Expires: time.Now().Add(time.Hour)}); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("transaction returned %v, want %v", err, failed)
+	}
+	if _, err := st.Tokens.ByID(ctx, "kept"); err != nil {
+		t.Errorf("token deleted by a failed transaction: %v", err)
+	}
+	if _, err := st.Tokens.ByID(ctx, "dropped"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("token created by a failed transaction: %v", err)
+	}
+}
+
+func TestMongoUsers(t *testing.T) {
+	st := newTestMongoStore(t)
+	ctx := context.Background()
+	user := &models.User{ID: "mongo-user", Email: "mongo@example.com"}
+	if err := st.Users.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Users.Create(ctx, &models.User{ID: "other",
+		Email: user.Email}); err == nil {
+		t.Error("second user created with the same email address")
+	}
+	found, err := st.Users.ByEmail(ctx, user.Email)
+	if err != nil || found.ID != user.ID {
+		t.Fatalf("user not found by email address: %v", err)
+	}
+	if err := st.Remotes.Create(ctx, &models.UserRemote{
+		CredentialsUserID: user.ID, RemoteIP: "192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	found, err = st.Users.ByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found.Creds.HasRemote("192.0.2.1") {
+		t.Error("remote not added")
+	}
+	if err := st.Users.Delete(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Users.ByID(ctx, user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted user found: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"fmt"
+	"go-soapauth/tracing"
+	"strings"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// database drivers supported by the service; postgres and sqlite are used
+// through the gorm store.
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+	DriverMongo    = "mongo"
+)
+
+// Open connects to the database using the driver named, postgres when
+// empty.  For postgres the dsn is a connection string; for sqlite it is the
+// path of the database file, which is created when missing.  Each query is
+// traced.
+func Open(driver, dsn string) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch driver {
+	case "", DriverPostgres:
+		dialector = postgres.Open(dsn)
+	case DriverSQLite:
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		dialector = sqlite.Open(dsn + separator +
+			"_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Use(tracing.GormPlugin{}); err != nil {
+		return nil, err
+	}
+	if driver == DriverSQLite {
+		// sqlite allows a single writer, so share one connection rather
+		// than have requests fail with the database locked.
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
+	}
+	return db, nil
+}
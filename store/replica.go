@@ -0,0 +1,79 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// readKey is the context key of the caller's read key.
+type readKey struct{}
+
+// WithReadKey returns a context whose reads are made from the primary
+// database for a while after a write made with the same key, so callers
+// read their own writes while the replicas catch up.
+func WithReadKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, readKey{}, key)
+}
+
+// replicaSet spreads the reads of a gorm store over its read replicas.
+type replicaSet struct {
+	replicas []*gorm.DB
+	next     uint32
+	pin      time.Duration
+
+	mu     sync.Mutex
+	writes map[string]time.Time
+}
+
+// read calls fn with a replica, then with the primary database if that
+// fails, or only with the primary when there are no replicas or the caller
+// wrote recently.
+func (rs *replicaSet) read(ctx context.Context, primary *gorm.DB,
+	fn func(db *gorm.DB) error) error {
+	if rs == nil || rs.pinned(ctx) {
+		return fn(primary.WithContext(ctx))
+	}
+	i := atomic.AddUint32(&rs.next, 1) % uint32(len(rs.replicas))
+	err := fn(rs.replicas[i].WithContext(ctx))
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	return fn(primary.WithContext(ctx))
+}
+
+// wrote notes a successful write by the caller, returning the error of the
+// write as given.
+func (rs *replicaSet) wrote(ctx context.Context, err error) error {
+	key, ok := ctx.Value(readKey{}).(string)
+	if rs == nil || err != nil || !ok {
+		return err
+	}
+	now := time.Now()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.writes[key] = now
+	if len(rs.writes) > 1000 {
+		for k, at := range rs.writes {
+			if now.Sub(at) > rs.pin {
+				delete(rs.writes, k)
+			}
+		}
+	}
+	return nil
+}
+
+// pinned reports whether the caller wrote within the pinning window.
+func (rs *replicaSet) pinned(ctx context.Context) bool {
+	key, ok := ctx.Value(readKey{}).(string)
+	if !ok {
+		return false
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	at, ok := rs.writes[key]
+	return ok && time.Since(at) < rs.pin
+}
@@ -0,0 +1,156 @@
+// Package store provides the persistence used by the controllers, behind
+// repository interfaces so the handlers don't depend on a particular
+// database.  Gorm and MongoDB implementations are used by the service and an
+// in-memory implementation is available for tests and local use.
+package store
+
+import (
+	"context"
+	"go-soapauth/audit"
+	"go-soapauth/preferences"
+	"go-soapauth/webhook"
+	"time"
+
+	models "github.com/antonerne/go-soap/models"
+)
+
+// ErrNotFound is returned when the record asked for doesn't exist.  It is
+// the webhook package's too, so the dispatcher finds out when a
+// subscription it retries is removed.
+var ErrNotFound = webhook.ErrNotFound
+
+// UserRepository reads and writes users.  Users are returned with their
+// name, credentials and approved remotes loaded; their bible studies, which
+// can be large, are only loaded by Studies and CurrentStudies, and saving a
+// user leaves them as they are.
+//
+// Every repository call is made within the context given, usually the
+// request's, and gives up when it is done.
+type UserRepository interface {
+	ByID(ctx context.Context, id string) (*models.User, error)
+	ByEmail(ctx context.Context, email string) (*models.User, error)
+	Studies(ctx context.Context, userID string) ([]models.UserBibleStudy,
+		error)
+	CurrentStudies(ctx context.Context, userID string,
+		at time.Time) ([]models.UserBibleStudy, error)
+	Create(ctx context.Context, user *models.User) error
+	Save(ctx context.Context, user *models.User) error
+	SaveName(ctx context.Context, name *models.UserName) error
+	Delete(ctx context.Context, id string) error
+}
+
+// CredentialRepository reads and writes user credentials, which are found
+// by the tokens emailed to the user.
+type CredentialRepository interface {
+	ByVerificationToken(ctx context.Context,
+		token string) (*models.Credentials, error)
+	ByRemoteToken(ctx context.Context, token string) (*models.Credentials,
+		error)
+	ByResetToken(ctx context.Context, token string) (*models.Credentials,
+		error)
+	Save(ctx context.Context, creds *models.Credentials) error
+}
+
+// TokenRepository keeps the JWT tokens issued to users.
+type TokenRepository interface {
+	ByID(ctx context.Context, id string) (*models.Token, error)
+	Create(ctx context.Context, token *models.Token) error
+	Delete(ctx context.Context, id string) error
+}
+
+// RemoteRepository keeps the computers and devices approved for users.
+type RemoteRepository interface {
+	Create(ctx context.Context, remote *models.UserRemote) error
+}
+
+// PreferenceRepository keeps the users' preferences.
+type PreferenceRepository interface {
+	Get(ctx context.Context, userID string) (*preferences.UserPreference,
+		error)
+	Save(ctx context.Context, pref *preferences.UserPreference) error
+}
+
+// AuditRepository keeps the trail of security events.  Append places the
+// event after the last one, sealing it with the key, so appends made at
+// once by several servers still form a single chain.  Find returns the events matching the
+// query, newest first, and Chain returns up to limit events after the
+// sequence number given, in order, to check the chain.
+type AuditRepository interface {
+	Append(ctx context.Context, event *audit.Event, key audit.Key) error
+	Find(ctx context.Context, query audit.Query) ([]audit.Event, error)
+	Chain(ctx context.Context, after int64, limit int) ([]audit.Event,
+		error)
+}
+
+// WebhookRepository keeps the webhook subscriptions and the log of their
+// deliveries.  Deliveries returns up to limit attempts to deliver to the
+// subscription, newest first.  Deleting a subscription removes its log.
+type WebhookRepository interface {
+	All(ctx context.Context) ([]webhook.Subscription, error)
+	ByID(ctx context.Context, id string) (*webhook.Subscription, error)
+	Create(ctx context.Context, sub *webhook.Subscription) error
+	Delete(ctx context.Context, id string) error
+	AddDelivery(ctx context.Context, delivery *webhook.Delivery) error
+	Deliveries(ctx context.Context, subscriptionID string,
+		limit int) ([]webhook.Delivery, error)
+}
+
+// Store groups the repositories used by the controllers.
+type Store struct {
+	Users       UserRepository
+	Credentials CredentialRepository
+	Tokens      TokenRepository
+	Remotes     RemoteRepository
+	Preferences PreferenceRepository
+	Audit       AuditRepository
+	Webhooks    WebhookRepository
+
+	// transaction runs fn as a unit of work for the implementation.
+	transaction func(ctx context.Context,
+		fn func(ctx context.Context, tx *Store) error) error
+	// ping checks the implementation can reach its database.
+	ping func(ctx context.Context) error
+	// close releases the connections of the implementation.
+	close func(ctx context.Context) error
+}
+
+// Ping returns an error when the database can't be reached.
+func (s *Store) Ping(ctx context.Context) error {
+	if s.ping == nil {
+		return nil
+	}
+	return s.ping(ctx)
+}
+
+// Close releases the connections to the database, once the requests using
+// the store are done.
+func (s *Store) Close(ctx context.Context) error {
+	if s.close == nil {
+		return nil
+	}
+	return s.close(ctx)
+}
+
+// Transaction calls fn with a store whose writes are made as a unit of work:
+// they are all kept when fn returns nil, and all undone when it returns an
+// error, which Transaction returns.  The calls fn makes must use the
+// context it is given.
+func (s *Store) Transaction(ctx context.Context,
+	fn func(ctx context.Context, tx *Store) error) error {
+	if s.transaction == nil {
+		return fn(ctx, s)
+	}
+	return s.transaction(ctx, fn)
+}
+
+// currentStudies returns the studies running at the time given.
+func currentStudies(studies []models.UserBibleStudy,
+	at time.Time) []models.UserBibleStudy {
+	var current []models.UserBibleStudy
+	for _, study := range studies {
+		if !study.StartDate.After(at) && !study.EndDate.Before(at) {
+			current = append(current, study)
+		}
+	}
+	return current
+}
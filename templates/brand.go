@@ -0,0 +1,95 @@
+package templates
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// brandsFile holds the registry of brands the service sends email and shows
+// pages for.
+const brandsFile = "brands.json"
+
+// brandPlaceholder is replaced by the brand's name in catalog text.
+const brandPlaceholder = "{brand}"
+
+// Brand is the name, sender and look of one product served by the service.
+type Brand struct {
+	ID         string      `json:"-"`
+	Name       string      `json:"name"`
+	From       string      `json:"from"`
+	LogoURL    string      `json:"logo"`
+	SupportURL string      `json:"support"`
+	Colors     BrandColors `json:"colors"`
+	Domains    []string    `json:"domains"`
+}
+
+// BrandColors are the colors used by a brand's emails and pages.
+type BrandColors struct {
+	Primary    string `json:"primary"`
+	Background string `json:"background"`
+	Text       string `json:"text"`
+}
+
+// Apply replaces the brand placeholder in the text with the brand's name.
+func (b Brand) Apply(text string) string {
+	return strings.ReplaceAll(text, brandPlaceholder, b.Name)
+}
+
+// brandRegistry is the contents of the brands file.
+type brandRegistry struct {
+	Default string            `json:"default"`
+	Brands  map[string]*Brand `json:"brands"`
+}
+
+// Brand returns the brand with the id given, or the default brand when there
+// is no such brand.
+func (t *Templates) Brand(id string) Brand {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if brand, ok := t.brands.Brands[id]; ok {
+		return *brand
+	}
+	return *t.brands.Brands[t.brands.Default]
+}
+
+// BrandForHost returns the brand whose domains include the host given,
+// either exactly or as a subdomain.
+func (t *Templates) BrandForHost(host string) (Brand, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, brand := range t.brands.Brands {
+		for _, domain := range brand.Domains {
+			domain = strings.ToLower(domain)
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return *brand, true
+			}
+		}
+	}
+	return Brand{}, false
+}
+
+// loadBrands reads the brand registry and checks its default brand exists.
+func (t *Templates) loadBrands() (*brandRegistry, error) {
+	data, err := t.read(brandsFile)
+	if err != nil {
+		return nil, err
+	}
+	registry := new(brandRegistry)
+	if err := json.Unmarshal([]byte(data), registry); err != nil {
+		return nil, fmt.Errorf("%s: %w", brandsFile, err)
+	}
+	if _, ok := registry.Brands[registry.Default]; !ok {
+		return nil, fmt.Errorf("%s: default brand %q not found", brandsFile,
+			registry.Default)
+	}
+	for id, brand := range registry.Brands {
+		brand.ID = id
+	}
+	return registry, nil
+}
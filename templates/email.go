@@ -0,0 +1,105 @@
+package templates
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// kinds of email sent by the service.  Each kind has an entry in the locale
+// catalogs and a plain text template named after it.
+const (
+	VerificationEmail = "verification"
+	RemoteEmail       = "remote"
+	ForgotEmail       = "forgot"
+)
+
+var emailKinds = []string{VerificationEmail, RemoteEmail, ForgotEmail}
+
+// EmailContent is the wording for a kind of email in a locale's catalog.
+type EmailContent struct {
+	Subject string `json:"subject"`
+	Message string `json:"message"`
+	Button  string `json:"button"`
+	Note    string `json:"note"`
+}
+
+// EmailData holds the values used to fill in the email templates.
+type EmailData struct {
+	Brand   Brand
+	Locale  string
+	Subject string
+	Message string
+	Link    string
+	Button  string
+	Note    string
+	Footer  string
+}
+
+// RenderedEmail is an email ready to send, with both an html and a plain
+// text version of the body.  From is the brand's sender address, empty when
+// the brand doesn't set one.
+type RenderedEmail struct {
+	From    string
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// MissingEmailError is returned when the default locale's catalog has no
+// entry for a kind of email.
+type MissingEmailError struct {
+	Kind string
+}
+
+func (e *MissingEmailError) Error() string {
+	return fmt.Sprintf("no email content configured for %q", e.Kind)
+}
+
+// RenderEmail fills in the html and plain text templates for the kind of
+// email given, in the locale's wording and the brand's look, pointing its
+// button at the link.
+func (t *Templates) RenderEmail(kind, locale, brandID,
+	link string) (*RenderedEmail, error) {
+	locale = t.MatchLocale(locale)
+	brand := t.Brand(brandID)
+	t.mu.RLock()
+	content, footer, ok := t.emailContent(kind, locale)
+	email := t.email
+	plain := t.text
+	t.mu.RUnlock()
+	if !ok {
+		return nil, &MissingEmailError{Kind: kind}
+	}
+
+	data := EmailData{
+		Brand:   brand,
+		Locale:  locale,
+		Subject: brand.Apply(content.Subject),
+		Message: brand.Apply(content.Message),
+		Link:    link,
+		Button:  brand.Apply(content.Button),
+		Note:    brand.Apply(content.Note),
+		Footer:  brand.Apply(footer),
+	}
+
+	html := new(bytes.Buffer)
+	if err := email.ExecuteTemplate(html, Email, data); err != nil {
+		return nil, err
+	}
+	text := new(bytes.Buffer)
+	if err := plain.ExecuteTemplate(text, textTemplate(kind), data); err != nil {
+		return nil, err
+	}
+	return &RenderedEmail{
+		From:    brand.From,
+		Subject: data.Subject,
+		HTML:    html.String(),
+		Text:    text.String(),
+	}, nil
+}
+
+// textTemplate returns the name of the plain text template for a kind of
+// email.
+func textTemplate(kind string) string {
+	return kind + ".template.txt"
+}
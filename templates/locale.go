@@ -0,0 +1,200 @@
+package templates
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLocale is used when no catalog matches the locale asked for.  Its
+// catalog must contain every kind of email.
+const DefaultLocale = "en"
+
+// localesDir holds a catalog file for each locale, named after the locale
+// ("es.json", "pt-br.json").
+const localesDir = "locales"
+
+// Catalog holds the translated text for a locale.  Messages maps the English
+// text used in the code, such as error messages, to its translation; any
+// text not found there is shown in English.
+type Catalog struct {
+	Footer   string                  `json:"footer"`
+	Emails   map[string]EmailContent `json:"emails"`
+	Messages map[string]string       `json:"messages"`
+}
+
+// MatchLocale returns the first supported locale among the candidates,
+// trying each candidate's base language before moving on to the next, so
+// "pt-BR" matches the "pt" catalog.  The default locale is returned when
+// nothing matches.
+func (t *Templates) MatchLocale(candidates ...string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, candidate := range candidates {
+		for _, locale := range fallbacks(candidate) {
+			if _, ok := t.catalogs[locale]; ok {
+				return locale
+			}
+		}
+	}
+	return DefaultLocale
+}
+
+// Translate returns the text in the locale given, falling back to the base
+// language, then to the text itself.
+func (t *Templates) Translate(locale, text string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, l := range fallbacks(locale) {
+		if catalog, ok := t.catalogs[l]; ok {
+			if translated, ok := catalog.Messages[text]; ok {
+				return translated
+			}
+		}
+	}
+	return text
+}
+
+// ParseAcceptLanguage returns the language tags of an Accept-Language header
+// ordered by preference.
+func ParseAcceptLanguage(header string) []string {
+	type tag struct {
+		name    string
+		quality float64
+	}
+	var tags []tag
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		name := strings.TrimSpace(fields[0])
+		if name == "" || name == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			tags = append(tags, tag{name: name, quality: quality})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].quality > tags[j].quality
+	})
+	names := make([]string, len(tags))
+	for i, t := range tags {
+		names[i] = t.name
+	}
+	return names
+}
+
+// emailContent returns the wording of a kind of email in the locale given,
+// falling back to the base language and then the default locale.
+func (t *Templates) emailContent(kind, locale string) (EmailContent, string,
+	bool) {
+	var footer string
+	for _, l := range append(fallbacks(locale), DefaultLocale) {
+		catalog, ok := t.catalogs[l]
+		if !ok {
+			continue
+		}
+		if footer == "" {
+			footer = catalog.Footer
+		}
+		if content, ok := catalog.Emails[kind]; ok {
+			return content, footer, true
+		}
+	}
+	return EmailContent{}, footer, false
+}
+
+// loadCatalogs reads the catalog of each locale, from the embedded files and
+// the override directory.
+func (t *Templates) loadCatalogs() (map[string]*Catalog, error) {
+	names := make(map[string]bool)
+	entries, err := fs.ReadDir(embedded, localesDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+	if t.dir != "" {
+		entries, err := os.ReadDir(filepath.Join(t.dir, localesDir))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			names[entry.Name()] = true
+		}
+	}
+
+	catalogs := make(map[string]*Catalog)
+	for name := range names {
+		if path.Ext(name) != ".json" {
+			continue
+		}
+		data, err := t.read(path.Join(localesDir, name))
+		if err != nil {
+			return nil, err
+		}
+		catalog := new(Catalog)
+		if err := json.Unmarshal([]byte(data), catalog); err != nil {
+			return nil, &CatalogError{File: name, Err: err}
+		}
+		catalogs[normalizeLocale(strings.TrimSuffix(name, ".json"))] = catalog
+	}
+
+	defaults, ok := catalogs[DefaultLocale]
+	if !ok {
+		return nil, &CatalogError{File: DefaultLocale + ".json",
+			Err: fs.ErrNotExist}
+	}
+	for _, kind := range emailKinds {
+		if _, ok := defaults.Emails[kind]; !ok {
+			return nil, &MissingEmailError{Kind: kind}
+		}
+	}
+	return catalogs, nil
+}
+
+// CatalogError is returned when a locale's catalog can't be read.
+type CatalogError struct {
+	File string
+	Err  error
+}
+
+func (e *CatalogError) Error() string {
+	return "catalog " + e.File + ": " + e.Err.Error()
+}
+
+func (e *CatalogError) Unwrap() error {
+	return e.Err
+}
+
+// fallbacks returns the locale followed by its base language, if it has one.
+func fallbacks(locale string) []string {
+	locale = normalizeLocale(locale)
+	if locale == "" {
+		return nil
+	}
+	if i := strings.Index(locale, "-"); i > 0 {
+		return []string{locale, locale[:i]}
+	}
+	return []string{locale}
+}
+
+// normalizeLocale puts a language tag in the form used for catalog names.
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale),
+		"_", "-"))
+}
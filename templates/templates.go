@@ -0,0 +1,205 @@
+// Package templates holds the email and web page templates used by the
+// service, along with the catalogs of translated email wording and messages
+// for each locale and the registry of brands the templates are themed for.
+// The files are embedded in the binary and parsed once at startup.
+// Any of them can be replaced by a file of the same name in an override
+// directory, which can be watched for changes during development.
+package templates
+
+import (
+	"embed"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// names of the templates provided.
+const (
+	Email            = "email.template.html"
+	ErrorPage        = "error.template.html"
+	VerificationPage = "verification.template.html"
+	ChangePage       = "change.template.html"
+)
+
+var (
+	emailFiles = []string{Email}
+	pageFiles  = []string{ErrorPage, VerificationPage, ChangePage}
+)
+
+//go:embed *.html *.txt *.json locales/*.json
+var embedded embed.FS
+
+// Templates is the parsed set of email and page templates.  It is safe for
+// concurrent use, including while being reloaded.
+type Templates struct {
+	dir      string
+	mu       sync.RWMutex
+	email    *htmltemplate.Template
+	text     *template.Template
+	pages    *htmltemplate.Template
+	catalogs map[string]*Catalog
+	brands   *brandRegistry
+	// loaded is the modification time of the override directory when the
+	// templates were last loaded from it.
+	loaded time.Time
+}
+
+// Page is the data given to the web page templates: the brand and locale
+// the page is shown in, and the values particular to the page.
+type Page struct {
+	Brand  Brand
+	Locale string
+	Data   interface{}
+}
+
+// Load parses the embedded templates, using any file of the same name found
+// in the override directory in place of the embedded one.  An empty
+// directory uses only the embedded templates.
+func Load(dir string) (*Templates, error) {
+	t := &Templates{dir: dir}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload parses the templates again.  If any template fails to parse, the
+// templates already loaded are kept and the error is returned.
+func (t *Templates) Reload() error {
+	var modified time.Time
+	if t.dir != "" {
+		modified = t.modified()
+	}
+	email := htmltemplate.New("email")
+	for _, name := range emailFiles {
+		text, err := t.read(name)
+		if err != nil {
+			return err
+		}
+		if _, err := email.New(name).Parse(text); err != nil {
+			return err
+		}
+	}
+
+	catalogs, err := t.loadCatalogs()
+	if err != nil {
+		return err
+	}
+	brands, err := t.loadBrands()
+	if err != nil {
+		return err
+	}
+
+	plain := template.New("text")
+	for _, kind := range emailKinds {
+		name := textTemplate(kind)
+		text, err := t.read(name)
+		if err != nil {
+			return err
+		}
+		if _, err := plain.New(name).Parse(text); err != nil {
+			return err
+		}
+	}
+
+	pages := htmltemplate.New("pages")
+	for _, name := range pageFiles {
+		text, err := t.read(name)
+		if err != nil {
+			return err
+		}
+		if _, err := pages.New(name).Parse(text); err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.email = email
+	t.text = plain
+	t.pages = pages
+	t.catalogs = catalogs
+	t.brands = brands
+	t.loaded = modified
+	return nil
+}
+
+// ExecutePage fills in the named web page template with the page given.
+func (t *Templates) ExecutePage(w io.Writer, name string, data Page) error {
+	t.mu.RLock()
+	pages := t.pages
+	t.mu.RUnlock()
+	return pages.ExecuteTemplate(w, name, data)
+}
+
+// Watch checks the override directory for changed files every interval and
+// reloads the templates when one is found, until stop is closed, including
+// files changed since they were loaded.  Reload errors are passed to
+// onError and the previous templates stay in use.
+func (t *Templates) Watch(interval time.Duration, stop <-chan struct{},
+	onError func(error)) {
+	if t.dir == "" {
+		return
+	}
+	t.mu.RLock()
+	last := t.loaded
+	t.mu.RUnlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			current := t.modified()
+			if current.Equal(last) {
+				continue
+			}
+			last = current
+			if err := t.Reload(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// read returns the text of the named template, from the override directory
+// when present there, otherwise from the embedded files.
+func (t *Templates) read(name string) (string, error) {
+	if t.dir != "" {
+		data, err := os.ReadFile(filepath.Join(t.dir, name))
+		if err == nil {
+			return string(data), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	data, err := fs.ReadFile(embedded, name)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// modified returns the latest modification time of the files in the
+// override directory, including the directory itself so added and removed
+// files are noticed.
+func (t *Templates) modified() time.Time {
+	var latest time.Time
+	filepath.WalkDir(t.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
@@ -0,0 +1,229 @@
+package templates
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const link = "https://auth.example.com/api/v1/auth/forgot/token"
+
+// override writes the files, by name, to a new override directory,
+// returning it.
+func override(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		writeFile(t, filepath.Join(dir, name), contents)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// render renders the forgot password email in the locale, failing the
+// test when it can't.
+func render(t *testing.T, tmpl *Templates, locale string) *RenderedEmail {
+	t.Helper()
+	email, err := tmpl.RenderEmail(ForgotEmail, locale, "", link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return email
+}
+
+func TestLoadEmbedded(t *testing.T) {
+	tmpl, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := render(t, tmpl, "en")
+	if email.Subject != "SOAP Bible Study Forgot Password" {
+		t.Errorf("subject %q", email.Subject)
+	}
+	if !strings.Contains(email.HTML, link) ||
+		!strings.Contains(email.Text, link) {
+		t.Error("link missing from the email")
+	}
+	if strings.Contains(email.Text, brandPlaceholder) {
+		t.Errorf("brand not filled in: %s", email.Text)
+	}
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	dir := override(t, map[string]string{
+		textTemplate(ForgotEmail): "Reset at {{.Link}}",
+		"locales/es.json": `{"footer": "Pie de {brand}",
+			"emails": {"forgot": {"subject": "Otra clave para {brand}"}}}`,
+		"locales/fr.json": `{"emails": {"forgot":
+			{"subject": "Mot de passe oublié"}}}`,
+		"brands.json": `{"default": "local", "brands": {"local":
+			{"name": "Local Study", "domains": ["study.example.com"]}}}`,
+	})
+	tmpl, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email := render(t, tmpl, "es")
+	if email.Text != "Reset at "+link {
+		t.Errorf("text %q, want the override template", email.Text)
+	}
+	if email.Subject != "Otra clave para Local Study" {
+		t.Errorf("subject %q, want the override catalog and brand",
+			email.Subject)
+	}
+	// the html template isn't overridden, so the embedded one is used.
+	if !strings.Contains(email.HTML, "<html") ||
+		!strings.Contains(email.HTML, "Pie de Local Study") {
+		t.Errorf("embedded html template not used: %s", email.HTML)
+	}
+	// a locale only in the override directory is added to those embedded.
+	if got := tmpl.MatchLocale("fr-CA"); got != "fr" {
+		t.Errorf("fr-CA matched %q, want fr", got)
+	}
+	if got := tmpl.MatchLocale("pt"); got != "pt" {
+		t.Errorf("pt matched %q, want the embedded catalog", got)
+	}
+	if brand, ok := tmpl.BrandForHost("www.study.example.com:443"); !ok ||
+		brand.ID != "local" {
+		t.Errorf("host matched %+v, %t; want the override brand", brand, ok)
+	}
+	if brand := tmpl.Brand("soap"); brand.ID != "local" {
+		t.Errorf("brand not in the override registry gave %q, want the "+
+			"default", brand.ID)
+	}
+}
+
+func TestLocaleFallback(t *testing.T) {
+	dir := override(t, map[string]string{
+		// a catalog without the forgot email falls back to the default's.
+		"locales/de.json": `{"footer": "Gesendet von {brand}",
+			"emails": {}, "messages": {"User Not Found":
+			"Benutzer nicht gefunden"}}`,
+	})
+	tmpl, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		locale  string
+		subject string
+	}{
+		{locale: "ja", subject: "SOAP Bible Study Forgot Password"},
+		{locale: "", subject: "SOAP Bible Study Forgot Password"},
+		{locale: "pt-BR", subject: "SOAP Bible Study: senha esquecida"},
+		{locale: "de", subject: "SOAP Bible Study Forgot Password"},
+	}
+	for _, tt := range tests {
+		email := render(t, tmpl, tt.locale)
+		if email.Subject != tt.subject {
+			t.Errorf("%q subject %q, want %q", tt.locale, email.Subject,
+				tt.subject)
+		}
+	}
+	if email := render(t, tmpl, "de"); !strings.Contains(email.Text,
+		"Gesendet von SOAP Bible Study") {
+		t.Errorf("footer of the locale not kept: %s", email.Text)
+	}
+
+	translations := []struct {
+		locale, text, want string
+	}{
+		{"es-MX", "User Not Found", "Usuario no encontrado"},
+		{"de_AT", "User Not Found", "Benutzer nicht gefunden"},
+		{"ja", "User Not Found", "User Not Found"},
+		{"es", "Not in any catalog", "Not in any catalog"},
+	}
+	for _, tt := range translations {
+		if got := tmpl.Translate(tt.locale, tt.text); got != tt.want {
+			t.Errorf("%q in %q translated as %q, want %q", tt.text,
+				tt.locale, got, tt.want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	name := textTemplate(ForgotEmail)
+	dir := override(t, map[string]string{name: "first {{.Link}}"})
+	tmpl, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email := render(t, tmpl, "en"); email.Text != "first "+link {
+		t.Fatalf("text %q", email.Text)
+	}
+
+	writeFile(t, filepath.Join(dir, name), "second {{.Link}}")
+	if err := tmpl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if email := render(t, tmpl, "en"); email.Text != "second "+link {
+		t.Errorf("text %q after reload, want the changed file", email.Text)
+	}
+
+	// a template which doesn't parse leaves those loaded in use.
+	writeFile(t, filepath.Join(dir, name), "broken {{.Link")
+	if err := tmpl.Reload(); err == nil {
+		t.Error("reload of a broken template returned nil")
+	}
+	if email := render(t, tmpl, "en"); email.Text != "second "+link {
+		t.Errorf("text %q after a failed reload, want it kept", email.Text)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	name := textTemplate(ForgotEmail)
+	dir := override(t, map[string]string{name: "first {{.Link}}"})
+	tmpl, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var errs []error
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		tmpl.Watch(5*time.Millisecond, stop, func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		})
+	}()
+	defer func() {
+		close(stop)
+		<-watched
+	}()
+
+	path := filepath.Join(dir, name)
+	writeFile(t, path, "second {{.Link}}")
+	// the modification time is moved on, however coarse the file system's.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for render(t, tmpl, "en").Text != "second "+link {
+		if time.Now().After(deadline) {
+			t.Fatal("changed file not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) > 0 {
+		t.Errorf("reload errors: %v", errs)
+	}
+}
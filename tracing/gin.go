@@ -0,0 +1,56 @@
+package tracing
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware records a span of each request, named by its method and route
+// pattern, continuing the caller's trace when the request has a
+// traceparent header.  It must come before the middleware which replaces
+// the request's context, so theirs derive from the span's.  The span holds
+// the route rather than the path, so the verification, approval and reset
+// tokens in the paths of emailed links aren't exported.
+func Middleware(c *gin.Context) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(),
+		propagation.HeaderCarrier(c.Request.Header))
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	ctx, span := tracer().Start(ctx, c.Request.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(serverAttributes(route, c.Request)...),
+		trace.WithAttributes(semconv.HTTPClientIPKey.String(c.ClientIP())))
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status,
+		trace.SpanKindServer))
+	for _, err := range c.Errors {
+		span.RecordError(err.Err)
+	}
+}
+
+// serverAttributes returns the attributes of a request made to the route,
+// without http.target, which holds the path and query of the request.
+func serverAttributes(route string, req *http.Request) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	for _, attr := range semconv.HTTPServerAttributesFromHTTPRequest(name,
+		route, req) {
+		if attr.Key != semconv.HTTPTargetKey {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,57 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+)
+
+func TestMiddlewareLeavesOutTokens(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Middleware)
+	r.GET("/api/v1/auth/forgot/:token", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	const token = "3f9a1c0e5b7d4e2a"
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet,
+		"/api/v1/auth/forgot/"+token+"?resettoken="+token, nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("%d spans recorded, want 1", len(spans))
+	}
+	span := spans[0]
+	if want := "GET /api/v1/auth/forgot/:token"; span.Name() != want {
+		t.Errorf("span named %q, want %q", span.Name(), want)
+	}
+	var route string
+	for _, attr := range span.Attributes() {
+		if attr.Key == semconv.HTTPTargetKey {
+			t.Errorf("http.target exported: %s", attr.Value.Emit())
+		}
+		if strings.Contains(attr.Value.Emit(), token) {
+			t.Errorf("token exported in %s", attr.Key)
+		}
+		if attr.Key == semconv.HTTPRouteKey {
+			route = attr.Value.AsString()
+		}
+	}
+	if route != "/api/v1/auth/forgot/:token" {
+		t.Errorf("http.route = %q, want the route pattern", route)
+	}
+}
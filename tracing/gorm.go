@@ -0,0 +1,91 @@
+package tracing
+
+import (
+	"errors"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// spanKey keeps the span of a query among the settings of its statement.
+const spanKey = "tracing:span"
+
+// GormPlugin records a span of each query made through a gorm database,
+// as a child of the span in the context it was given.  The spans hold the
+// statements without their values, so passwords and tokens aren't
+// exported.
+type GormPlugin struct{}
+
+func (GormPlugin) Name() string {
+	return "tracing"
+}
+
+func (p GormPlugin) Initialize(db *gorm.DB) error {
+	type register func(name string, fn func(*gorm.DB)) error
+	callbacks := db.Callback()
+	for _, op := range []struct {
+		name          string
+		before, after register
+	}{
+		{"create", callbacks.Create().Before("*").Register,
+			callbacks.Create().After("*").Register},
+		{"query", callbacks.Query().Before("*").Register,
+			callbacks.Query().After("*").Register},
+		{"update", callbacks.Update().Before("*").Register,
+			callbacks.Update().After("*").Register},
+		{"delete", callbacks.Delete().Before("*").Register,
+			callbacks.Delete().After("*").Register},
+		{"row", callbacks.Row().Before("*").Register,
+			callbacks.Row().After("*").Register},
+		{"raw", callbacks.Raw().Before("*").Register,
+			callbacks.Raw().After("*").Register},
+	} {
+		if err := op.before("tracing:before_"+op.name,
+			p.before(op.name)); err != nil {
+			return err
+		}
+		if err := op.after("tracing:after_"+op.name, p.after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// before starts the span of the operation, leaving its context to the
+// statement.
+func (GormPlugin) before(operation string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		if db.Statement == nil || db.Statement.Context == nil {
+			return
+		}
+		ctx, span := tracer().Start(db.Statement.Context, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemKey.String(db.Dialector.Name())))
+		db.Statement.Context = ctx
+		db.InstanceSet(spanKey, span)
+	}
+}
+
+// after ends the span of the statement, with its sql and table, failing
+// it when the statement failed other than by finding nothing.
+func (GormPlugin) after(db *gorm.DB) {
+	value, ok := db.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+	span.SetAttributes(semconv.DBStatementKey.String(db.Statement.SQL.String()))
+	if db.Statement.Table != "" {
+		span.SetAttributes(semconv.DBSQLTableKey.String(db.Statement.Table))
+	}
+	err := db.Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = nil
+	}
+	End(span, err)
+}
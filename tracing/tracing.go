@@ -0,0 +1,96 @@
+// Package tracing records OpenTelemetry spans of the requests answered by
+// the service, its database queries, password hashing and mail delivery,
+// continuing the traces of callers which send a W3C traceparent header.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters spans can be sent to.
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+// name names the service in its spans and their instrumentation.
+const name = "go-soapauth"
+
+// Setup sends the spans of the service to the exporter, keeping the ratio
+// of traces given unless a caller's trace was sampled, and returns the func
+// which flushes those not yet sent.  The otlp exporter sends them over http
+// to the collector set by the standard OTEL_EXPORTER_OTLP_* variables, and
+// the stdout exporter prints them to stderr for local use, away from the
+// logs on stdout.  With no exporter, spans
+// are neither recorded nor sent, but traceparent headers are still passed
+// on.
+func Setup(ctx context.Context, exporter string, ratio float64) (
+	func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var spans sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		spans, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		spans, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr),
+			stdouttrace.WithPrettyPrint())
+	default:
+		err = fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL, semconv.ServiceNameKey.String(name)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spans),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(ratio))))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span of the work named, as a child of the span in the
+// context.
+func Start(ctx context.Context, spanName string,
+	attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, spanName, trace.WithAttributes(attrs...))
+}
+
+// End ends the span, marking it as failed when err isn't nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracer returns the tracer of the service from the current provider, so
+// spans go to the exporter set up after the package was first used.
+func tracer() trace.Tracer {
+	return otel.Tracer(name)
+}
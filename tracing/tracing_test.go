@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestStdoutExporterLeavesLogsAlone(t *testing.T) {
+	dir := t.TempDir()
+	stdout, stderr := createFile(t, dir, "stdout"), createFile(t, dir, "stderr")
+	previousOut, previousErr := os.Stdout, os.Stderr
+	previous := otel.GetTracerProvider()
+	os.Stdout, os.Stderr = stdout, stderr
+	t.Cleanup(func() {
+		os.Stdout, os.Stderr = previousOut, previousErr
+		otel.SetTracerProvider(previous)
+	})
+
+	shutdown, err := Setup(context.Background(), ExporterStdout, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := Start(context.Background(), "test.span")
+	End(span, nil)
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if out := readFile(t, stdout.Name()); out != "" {
+		t.Errorf("spans written to stdout, where the logs go: %s", out)
+	}
+	if out := readFile(t, stderr.Name()); !strings.Contains(out,
+		"test.span") {
+		t.Errorf("span not written to stderr: %q", out)
+	}
+}
+
+// createFile creates the file named in the directory, closed when the
+// test ends.
+func createFile(t *testing.T, dir, name string) *os.File {
+	t.Helper()
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
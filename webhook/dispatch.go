@@ -0,0 +1,505 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-soapauth/audit"
+	"go-soapauth/logging"
+	"go-soapauth/metrics"
+	"go-soapauth/tracing"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Store finds the subscriptions events are delivered to, and logs the
+// deliveries.  ByID returns ErrNotFound when there is no subscription with
+// the id.
+type Store interface {
+	All(ctx context.Context) ([]Subscription, error)
+	ByID(ctx context.Context, id string) (*Subscription, error)
+	AddDelivery(ctx context.Context, delivery *Delivery) error
+}
+
+// ErrNotFound is returned by a Store when the subscription asked for
+// doesn't exist.
+var ErrNotFound = errors.New("record not found")
+
+// Options holds how events are delivered: each attempt is given Timeout,
+// and a failed delivery is tried up to MaxAttempts times in all, waiting
+// Backoff before the second attempt and twice as long before each after
+// it, up to MaxBackoff.  Workers deliver the events queued, up to
+// QueueSize of them waiting at once.
+type Options struct {
+	Timeout     time.Duration
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Workers     int
+	QueueSize   int
+}
+
+// Dispatcher delivers the events published to the subscriptions wanting
+// them, in the background.  Shutdown delivers the events and retries still
+// waiting; those left when it stops are dropped, and counted as such.  A
+// nil Dispatcher delivers nothing, so controllers can be used without it.
+type Dispatcher struct {
+	store    Store
+	options  Options
+	client   *http.Client
+	metrics  *metrics.Metrics
+	queue    chan job
+	done     chan struct{}
+	stop     sync.Once
+	drain    chan struct{}
+	drained  sync.Once
+	finished chan struct{}
+
+	// mu guards the retries waiting for their backoff, by their number,
+	// those held to be made at shutdown rather than waited for, and the
+	// attempts waiting for the one under way to their subscription, by
+	// its id.
+	mu       sync.Mutex
+	draining bool
+	retries  map[int]retry
+	next     int
+	held     []job
+	busy     map[string][]job
+}
+
+// retry is an attempt waiting for its timer to queue it.
+type retry struct {
+	timer *time.Timer
+	job   job
+}
+
+// job is an event to fan out to its subscriptions when sub is nil, or else
+// an attempt to deliver its payload to sub.
+type job struct {
+	parent  trace.SpanContext
+	event   audit.Event
+	sub     *Subscription
+	payload Payload
+	attempt int
+}
+
+// NewDispatcher returns the dispatcher delivering events to the
+// subscriptions of the store, once it runs.  Redirects aren't followed, so
+// a subscriber can't send the signed deliveries elsewhere.
+func NewDispatcher(store Store, options Options,
+	m *metrics.Metrics) *Dispatcher {
+	return &Dispatcher{
+		store:   store,
+		options: options,
+		client: &http.Client{
+			Timeout: options.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		metrics:  m,
+		queue:    make(chan job, options.QueueSize),
+		done:     make(chan struct{}),
+		drain:    make(chan struct{}),
+		finished: make(chan struct{}),
+		retries:  make(map[int]retry),
+		busy:     make(map[string][]job),
+	}
+}
+
+// Publish queues the event for delivery to the subscriptions wanting it,
+// as a child of the span of the context given.  It doesn't wait, so when
+// the queue is full the event is dropped.
+func (d *Dispatcher) Publish(ctx context.Context, event audit.Event) {
+	if d == nil {
+		return
+	}
+	if !d.enqueue(job{parent: trace.SpanContextFromContext(ctx),
+		event: event}) {
+		logging.From(ctx).Error("webhook event dropped",
+			"event", "webhook_dropped", "action", event.Action)
+	}
+}
+
+// enqueue queues the job unless the queue is full or the dispatcher has
+// stopped, reporting whether it was queued.
+func (d *Dispatcher) enqueue(j job) bool {
+	select {
+	case <-d.done:
+	default:
+		select {
+		case d.queue <- j:
+			return true
+		default:
+		}
+	}
+	d.metrics.Webhook(metrics.WebhookDropped)
+	return false
+}
+
+// Run delivers the events queued until the context ends, or until they
+// are all delivered once Shutdown is called.  Deliveries under way are
+// given their timeout to finish.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var workers sync.WaitGroup
+	for i := 0; i < d.options.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-d.drain:
+					d.flush(ctx)
+					return
+				case j := <-d.queue:
+					d.handle(ctx, j)
+				}
+			}
+		}()
+	}
+	workers.Wait()
+	d.stop.Do(func() { close(d.done) })
+	defer close(d.finished)
+
+	d.mu.Lock()
+	d.draining = true
+	dropped := len(d.queue) + len(d.held)
+	for id, r := range d.retries {
+		r.timer.Stop()
+		delete(d.retries, id)
+		dropped++
+	}
+	d.held = nil
+	for id, waiting := range d.busy {
+		dropped += len(waiting)
+		delete(d.busy, id)
+	}
+	d.mu.Unlock()
+	if dropped > 0 {
+		logging.From(ctx).Warn("webhook events dropped at shutdown",
+			"event", "webhook_dropped", "count", dropped)
+		for i := 0; i < dropped; i++ {
+			d.metrics.Webhook(metrics.WebhookDropped)
+		}
+	}
+}
+
+// Shutdown stops taking events, and delivers those queued and the retries
+// waiting for their backoff, which are made at once, returning when they
+// are done or the context ends.  Attempts failing meanwhile aren't tried
+// again.  Once it returns the context of Run can be cancelled, dropping
+// what is left.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	d.draining = true
+	for id, r := range d.retries {
+		r.timer.Stop()
+		delete(d.retries, id)
+		d.held = append(d.held, r.job)
+	}
+	d.mu.Unlock()
+	d.stop.Do(func() { close(d.done) })
+	d.drained.Do(func() { close(d.drain) })
+
+	select {
+	case <-d.finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush handles the jobs queued, then those held at shutdown, until there
+// are none left or the context ends.
+func (d *Dispatcher) flush(ctx context.Context) {
+	for ctx.Err() == nil {
+		var j job
+		select {
+		case j = <-d.queue:
+		default:
+			d.mu.Lock()
+			if len(d.held) == 0 {
+				d.mu.Unlock()
+				return
+			}
+			j, d.held = d.held[0], d.held[1:]
+			d.mu.Unlock()
+		}
+		d.handle(ctx, j)
+	}
+}
+
+// requeue queues the job, or holds it for Shutdown to make once that has
+// begun, reporting whether it will be handled.
+func (d *Dispatcher) requeue(j job) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		d.held = append(d.held, j)
+		return true
+	}
+	return d.enqueue(j)
+}
+
+// schedule queues the job once the wait passes, unless the dispatcher is
+// shutting down, reporting whether it will.
+func (d *Dispatcher) schedule(j job, wait time.Duration,
+	log *slog.Logger) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	id := d.next
+	d.next++
+	d.retries[id] = retry{job: j, timer: time.AfterFunc(wait, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// the retry was taken over when its entry is gone.
+		if _, ok := d.retries[id]; !ok {
+			return
+		}
+		delete(d.retries, id)
+		if !d.enqueue(j) {
+			log.Error("webhook retry dropped", "event", "webhook_dropped")
+		}
+	})}
+	return true
+}
+
+// handle fans the event of the job out to its subscriptions, queueing an
+// attempt for each, or makes the attempt and then those queued behind it
+// for the same subscription, one at a time, so a slow subscriber holds up
+// a single worker rather than the deliveries to the others.  Attempts
+// still waiting when the context of Run ends are left for it to drop.
+func (d *Dispatcher) handle(ctx context.Context, j job) {
+	if j.sub != nil {
+		if !d.claim(j) {
+			return
+		}
+		for ok := true; ok; j, ok = d.release(ctx, j.sub.ID) {
+			d.attempt(trace.ContextWithSpanContext(
+				context.WithoutCancel(ctx), j.parent), j)
+		}
+		return
+	}
+
+	ctx = trace.ContextWithSpanContext(context.WithoutCancel(ctx), j.parent)
+	subs, err := d.store.All(ctx)
+	if err != nil {
+		logging.From(ctx).Error("webhook subscriptions not found",
+			"event", "webhook_failed", "action", j.event.Action,
+			"error", err)
+		return
+	}
+	payload := Payload{Event: newEvent(j.event)}
+	for i := range subs {
+		if !subs[i].Wants(j.event.Action) {
+			continue
+		}
+		payload.ID = uuid.NewString()
+		if !d.requeue(job{parent: j.parent, sub: &subs[i],
+			payload: payload, attempt: 1}) {
+			logging.From(ctx).Error("webhook delivery dropped",
+				"event", "webhook_dropped", "subscription_id", subs[i].ID,
+				"action", j.event.Action)
+		}
+	}
+}
+
+// claim reports whether the attempt can be made now, or else holds it
+// until the one under way to its subscription is done.
+func (d *Dispatcher) claim(j job) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if waiting, ok := d.busy[j.sub.ID]; ok {
+		d.busy[j.sub.ID] = append(waiting, j)
+		return false
+	}
+	d.busy[j.sub.ID] = nil
+	return true
+}
+
+// release returns the next attempt held for the subscription, once the
+// one under way is done, unless there is none or the context has ended.
+func (d *Dispatcher) release(ctx context.Context, id string) (job, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	waiting := d.busy[id]
+	if len(waiting) == 0 {
+		delete(d.busy, id)
+		return job{}, false
+	}
+	if ctx.Err() != nil {
+		return job{}, false
+	}
+	d.busy[id] = waiting[1:]
+	return waiting[0], true
+}
+
+// attempt makes the attempt to deliver the job, scheduling the next one
+// when it fails.
+func (d *Dispatcher) attempt(ctx context.Context, j job) {
+	if j.attempt > 1 && !d.subscribed(ctx, j.sub.ID) {
+		return
+	}
+
+	delivery := d.deliver(ctx, *j.sub, j.payload, j.attempt)
+	log := logging.From(ctx).With("subscription_id", j.sub.ID,
+		"action", delivery.Action, "attempt", delivery.Attempt)
+	switch {
+	case delivery.Delivered:
+		log.Debug("webhook delivered", "event", "webhook_delivered")
+	case j.attempt < d.options.MaxAttempts:
+		wait := d.backoff(j.attempt)
+		j.attempt++
+		if !d.schedule(j, wait, log) {
+			d.metrics.Webhook(metrics.WebhookDropped)
+			log.Error("webhook not delivered, dropped at shutdown",
+				"event", "webhook_dropped", "status", delivery.StatusCode,
+				"error", delivery.Error)
+			break
+		}
+		log.Warn("webhook not delivered, will retry",
+			"event", "webhook_failed", "status", delivery.StatusCode,
+			"error", delivery.Error, "retry_in", wait.String())
+	default:
+		d.metrics.Webhook(metrics.WebhookAbandoned)
+		log.Error("webhook not delivered, giving up",
+			"event", "webhook_abandoned", "status", delivery.StatusCode,
+			"error", delivery.Error)
+	}
+}
+
+// subscribed reports whether the subscription is still there, so retries
+// stop once it is removed.  It is assumed to be when that can't be found
+// out.
+func (d *Dispatcher) subscribed(ctx context.Context, id string) bool {
+	_, err := d.store.ByID(ctx, id)
+	return !errors.Is(err, ErrNotFound)
+}
+
+// backoff returns the time waited after the attempt given fails.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	wait := d.options.Backoff
+	for i := 1; i < attempt && wait < d.options.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.options.MaxBackoff {
+		wait = d.options.MaxBackoff
+	}
+	return wait
+}
+
+// Test delivers a sample event of the action given to the subscription,
+// once, and returns the delivery, which is logged like the others.
+func (d *Dispatcher) Test(ctx context.Context, sub Subscription,
+	event audit.Event) Delivery {
+	return d.deliver(ctx, sub, Payload{ID: uuid.NewString(), Test: true,
+		Event: newEvent(event)}, 1)
+}
+
+// deliver makes the attempt to post the payload to the subscription,
+// traced and counted, and logs it.
+func (d *Dispatcher) deliver(ctx context.Context, sub Subscription,
+	payload Payload, attempt int) Delivery {
+	delivery := Delivery{
+		ID:             uuid.NewString(),
+		SubscriptionID: sub.ID,
+		PayloadID:      payload.ID,
+		Action:         payload.Event.Action,
+		Test:           payload.Test,
+		Attempt:        attempt,
+		At:             time.Now().UTC(),
+	}
+	// only the scheme and host of the subscriber are exported, as its path
+	// and query may hold secrets.
+	attrs := []attribute.KeyValue{
+		attribute.String("webhook.subscription", sub.ID),
+		attribute.String("webhook.action", delivery.Action),
+		attribute.Int("webhook.attempt", attempt),
+	}
+	if u, err := url.Parse(sub.URL); err == nil {
+		attrs = append(attrs, semconv.HTTPSchemeKey.String(u.Scheme),
+			semconv.HTTPHostKey.String(u.Host))
+	}
+	ctx, span := tracing.Start(ctx, "webhook.deliver", attrs...)
+	status, err := d.post(ctx, sub, payload)
+	if status != 0 {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+	}
+	tracing.End(span, err)
+
+	delivery.StatusCode = status
+	delivery.DurationMS = time.Since(delivery.At).Milliseconds()
+	delivery.Delivered = err == nil
+	result := metrics.WebhookDelivered
+	if err != nil {
+		delivery.Error = err.Error()
+		result = metrics.WebhookFailed
+	}
+	d.metrics.Webhook(result)
+	if lerr := d.store.AddDelivery(ctx, &delivery); lerr != nil {
+		logging.From(ctx).Error("webhook delivery not logged",
+			"event", "webhook_failed", "subscription_id", sub.ID,
+			"error", lerr)
+	}
+	return delivery
+}
+
+// post sends the payload signed to the subscriber, returning the status
+// it answered with, and an error unless it was a success.
+func (d *Dispatcher) post(ctx context.Context, sub Subscription,
+	payload Payload) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.options.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL,
+		bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "authserver-webhook")
+	req.Header.Set(IDHeader, payload.ID)
+	req.Header.Set(EventHeader, payload.Event.Action)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(SignatureHeader, "sha256="+Sign(sub.Secret, now, body))
+	otel.GetTextMapPropagator().Inject(ctx,
+		propagation.HeaderCarrier(req.Header))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("subscriber answered %s",
+			resp.Status)
+	}
+	return resp.StatusCode, nil
+}
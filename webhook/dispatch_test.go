@@ -0,0 +1,358 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"go-soapauth/audit"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+)
+
+// memoryStore holds the subscriptions and the deliveries logged.
+type memoryStore struct {
+	mu         sync.Mutex
+	subs       []Subscription
+	deliveries []Delivery
+}
+
+func (s *memoryStore) All(context.Context) ([]Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Subscription(nil), s.subs...), nil
+}
+
+func (s *memoryStore) ByID(_ context.Context, id string) (*Subscription,
+	error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.subs {
+		if sub.ID == id {
+			return &sub, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// remove removes the subscriptions.
+func (s *memoryStore) remove() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs = nil
+}
+
+func (s *memoryStore) AddDelivery(_ context.Context,
+	delivery *Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries = append(s.deliveries, *delivery)
+	return nil
+}
+
+// delivered returns the number of deliveries logged, and how many of them
+// were delivered.
+func (s *memoryStore) delivered() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, delivery := range s.deliveries {
+		if delivery.Delivered {
+			n++
+		}
+	}
+	return len(s.deliveries), n
+}
+
+// newDispatcher returns a running dispatcher delivering every event to
+// the handler, and a function stopping it as the service does.
+func newDispatcher(t *testing.T, handler http.HandlerFunc,
+	options Options) (*Dispatcher, *memoryStore, context.CancelFunc) {
+	t.Helper()
+	subscriber := httptest.NewServer(handler)
+	t.Cleanup(subscriber.Close)
+	st := &memoryStore{subs: []Subscription{{ID: "sub-1",
+		URL: subscriber.URL, Events: AllEvents, Secret: "0123456789abcdef"}}}
+	d := NewDispatcher(st, options, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan struct{})
+	go func() {
+		defer close(ran)
+		d.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-ran
+	})
+	return d, st, cancel
+}
+
+func testOptions() Options {
+	return Options{Timeout: time.Second, MaxAttempts: 3,
+		Backoff: time.Hour, MaxBackoff: time.Hour, Workers: 1, QueueSize: 10}
+}
+
+func publish(d *Dispatcher, n int) {
+	for i := 0; i < n; i++ {
+		d.Publish(context.Background(), audit.Event{At: time.Now().UTC(),
+			Action: audit.ActionUserDeleted, Outcome: audit.Success})
+	}
+}
+
+func TestShutdownDeliversQueued(t *testing.T) {
+	d, st, cancel := newDispatcher(t, func(w http.ResponseWriter,
+		r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}, testOptions())
+	publish(d, 5)
+
+	ctx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if attempts, delivered := st.delivered(); attempts != 5 ||
+		delivered != 5 {
+		t.Errorf("%d of %d attempts delivered, want 5 of 5", delivered,
+			attempts)
+	}
+	publish(d, 1)
+	if attempts, _ := st.delivered(); attempts != 5 {
+		t.Errorf("event published after shutdown delivered")
+	}
+}
+
+func TestShutdownMakesRetries(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	d, st, cancel := newDispatcher(t, func(w http.ResponseWriter,
+		r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}, testOptions())
+	publish(d, 1)
+
+	// the first attempt fails, and the second waits for its backoff.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		waiting := len(d.retries)
+		d.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("retry not scheduled")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ctx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if attempts, delivered := st.delivered(); attempts != 2 ||
+		delivered != 1 {
+		t.Errorf("%d of %d attempts delivered, want 1 of 2", delivered,
+			attempts)
+	}
+}
+
+func TestShutdownDoesNotRetry(t *testing.T) {
+	d, st, cancel := newDispatcher(t, func(w http.ResponseWriter,
+		r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, testOptions())
+	publish(d, 2)
+
+	ctx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	attempts, _ := st.delivered()
+	d.mu.Lock()
+	waiting := len(d.retries)
+	d.mu.Unlock()
+	if attempts < 2 || attempts > 3 || waiting != 0 {
+		t.Errorf("%d attempts made and %d retries waiting, want 2 or 3 "+
+			"and none", attempts, waiting)
+	}
+}
+
+func TestShutdownTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	d, _, cancel := newDispatcher(t, func(w http.ResponseWriter,
+		r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}, testOptions())
+	defer close(release)
+	publish(d, 2)
+
+	ctx, stop := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer stop()
+	if err := d.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shutdown returned %v, want the deadline exceeded", err)
+	}
+	cancel()
+}
+
+func TestDeliverExportsOnlyOrigin(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	subscriber := httptest.NewServer(http.HandlerFunc(func(
+		http.ResponseWriter, *http.Request) {
+	}))
+	t.Cleanup(subscriber.Close)
+	const secret = "5e1c7a9b3d"
+	sub := Subscription{ID: "sub-1",
+		URL:    subscriber.URL + "/hooks/" + secret + "?token=" + secret,
+		Events: AllEvents, Secret: "0123456789abcdef"}
+	d := NewDispatcher(&memoryStore{subs: []Subscription{sub}},
+		testOptions(), nil)
+	if delivery := d.Test(context.Background(), sub, audit.Event{
+		Action: audit.ActionUserDeleted}); !delivery.Delivered {
+		t.Fatalf("not delivered: %s", delivery.Error)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("%d spans recorded, want 1", len(spans))
+	}
+	var host string
+	for _, attr := range spans[0].Attributes() {
+		if attr.Key == semconv.HTTPURLKey {
+			t.Errorf("http.url exported: %s", attr.Value.Emit())
+		}
+		if strings.Contains(attr.Value.Emit(), secret) {
+			t.Errorf("secret exported in %s", attr.Key)
+		}
+		if attr.Key == semconv.HTTPHostKey {
+			host = attr.Value.AsString()
+		}
+	}
+	if want := strings.TrimPrefix(subscriber.URL, "http://"); host != want {
+		t.Errorf("http.host = %q, want %q", host, want)
+	}
+}
+
+func TestDeliverDoesNotFollowRedirects(t *testing.T) {
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(
+		http.ResponseWriter, *http.Request) {
+		t.Error("redirect followed")
+	}))
+	t.Cleanup(elsewhere.Close)
+	subscriber := httptest.NewServer(http.RedirectHandler(elsewhere.URL,
+		http.StatusTemporaryRedirect))
+	t.Cleanup(subscriber.Close)
+	sub := Subscription{ID: "sub-1", URL: subscriber.URL, Events: AllEvents,
+		Secret: "0123456789abcdef"}
+	d := NewDispatcher(&memoryStore{subs: []Subscription{sub}},
+		testOptions(), nil)
+
+	delivery := d.Test(context.Background(), sub, audit.Event{
+		Action: audit.ActionUserDeleted})
+	if delivery.Delivered ||
+		delivery.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("delivered %t with status %d, want a failure with %d",
+			delivery.Delivered, delivery.StatusCode,
+			http.StatusTemporaryRedirect)
+	}
+}
+
+func TestSlowSubscriberDoesNotHoldUpOthers(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter,
+		r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(slow.Close)
+	fast := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter,
+		*http.Request) {
+	}))
+	t.Cleanup(fast.Close)
+	st := &memoryStore{subs: []Subscription{
+		{ID: "slow", URL: slow.URL, Events: AllEvents, Secret: "slow"},
+		{ID: "fast", URL: fast.URL, Events: AllEvents, Secret: "fast"},
+	}}
+	options := testOptions()
+	options.Timeout, options.Workers = 10*time.Second, 2
+	d := NewDispatcher(st, options, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+	publish(d, 3)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, delivered := st.delivered(); delivered == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("events to the fast subscriber held up by the slow one")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRetryStopsOnceUnsubscribed(t *testing.T) {
+	var st *memoryStore
+	removed := make(chan struct{})
+	d, st, cancel := newDispatcher(t, func(w http.ResponseWriter,
+		r *http.Request) {
+		<-removed
+		st.remove()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, testOptions())
+	close(removed)
+	publish(d, 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if attempts, _ := st.delivered(); attempts == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not attempted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// the retry waiting is made at once, but finds the subscription gone.
+	ctx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if attempts, _ := st.delivered(); attempts != 1 {
+		t.Errorf("%d attempts made, want the retry skipped", attempts)
+	}
+}
@@ -0,0 +1,129 @@
+// Package webhook delivers the security events of the audit trail to the
+// services subscribed to them, such as those reacting to a user being
+// deleted or changing their email address.  Each event is posted to the
+// subscriber's url as json signed with the subscription's secret, tried
+// again with backoff when the delivery fails, and every attempt is logged.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"go-soapauth/audit"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of a delivery.  IDHeader holds the id of the payload, the same on
+// every attempt to deliver it, so subscribers can tell a retry from a new
+// event; SignatureHeader holds "sha256=" and the signature made by Sign
+// of the unix time in TimestampHeader and the body.
+const (
+	IDHeader        = "X-Webhook-ID"
+	EventHeader     = "X-Webhook-Event"
+	TimestampHeader = "X-Webhook-Timestamp"
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+// AllEvents subscribes to every action.
+const AllEvents = "*"
+
+// Subscription is a subscriber's url and the actions posted to it,
+// comma-separated, or AllEvents.  Its secret signs the payloads, and is
+// only returned when the subscription is created.
+type Subscription struct {
+	ID      string    `gorm:"column:id;primaryKey" json:"id"`
+	URL     string    `gorm:"column:url" json:"url"`
+	Events  string    `gorm:"column:events" json:"events"`
+	Secret  string    `gorm:"column:secret" json:"-"`
+	Created time.Time `gorm:"column:created" json:"created"`
+}
+
+// TableName gives the table the subscriptions are kept in.
+func (Subscription) TableName() string {
+	return "webhooks"
+}
+
+// Actions returns the actions subscribed to.
+func (s *Subscription) Actions() []string {
+	var actions []string
+	for _, action := range strings.Split(s.Events, ",") {
+		if action = strings.TrimSpace(action); action != "" {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+// Wants reports whether the action is subscribed to.
+func (s *Subscription) Wants(action string) bool {
+	for _, a := range s.Actions() {
+		if a == AllEvents || a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery is an attempt to post a payload to a subscription: the status
+// the subscriber answered with, or the error when it couldn't be reached,
+// and how long it took.
+type Delivery struct {
+	ID             string    `gorm:"column:id;primaryKey" json:"id"`
+	SubscriptionID string    `gorm:"column:subscriptionid" json:"subscriptionId"`
+	PayloadID      string    `gorm:"column:payloadid" json:"payloadId"`
+	Action         string    `gorm:"column:action" json:"action"`
+	Test           bool      `gorm:"column:test" json:"test,omitempty"`
+	Attempt        int       `gorm:"column:attempt" json:"attempt"`
+	At             time.Time `gorm:"column:at" json:"at"`
+	StatusCode     int       `gorm:"column:statuscode" json:"statusCode,omitempty"`
+	Error          string    `gorm:"column:error" json:"error,omitempty"`
+	DurationMS     int64     `gorm:"column:durationms" json:"durationMs"`
+	Delivered      bool      `gorm:"column:delivered" json:"delivered"`
+}
+
+// TableName gives the table the deliveries are logged in.
+func (Delivery) TableName() string {
+	return "webhook_deliveries"
+}
+
+// Payload is the body posted to subscribers.  Test payloads carry a sample
+// event rather than one which happened.
+type Payload struct {
+	ID    string `json:"id"`
+	Test  bool   `json:"test,omitempty"`
+	Event Event  `json:"event"`
+}
+
+// Event is the part of an audit event subscribers are sent; the client's
+// address and user agent are left out.  Seq is 0 when the event couldn't
+// be added to the trail.
+type Event struct {
+	Seq       int64     `json:"seq,omitempty"`
+	At        time.Time `json:"at"`
+	Action    string    `json:"action"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	ActorID   string    `json:"actorId,omitempty"`
+	TargetID  string    `json:"targetId,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+// newEvent returns the part of the audit event sent to subscribers.
+func newEvent(e audit.Event) Event {
+	return Event{Seq: e.Seq, At: e.At, Action: e.Action, Outcome: e.Outcome,
+		Reason: e.Reason, ActorID: e.ActorID, TargetID: e.TargetID,
+		RequestID: e.RequestID}
+}
+
+// Sign returns the signature of the body sent at the time given: the hex
+// HMAC-SHA256, keyed by the secret, of the unix time, a dot and the body.
+// Subscribers check it the same way, and refuse old timestamps so a
+// payload can't be replayed later.
+func Sign(secret string, at time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(at.Unix(), 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}